@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	APPROVAL_FILE_SUFFIX string = ".approvals"
+	PUBLIC_KEY_SUFFIX    string = ".pub"
+)
+
+//一次审批，记录审批人、时间以及审批时计划和语句的哈希
+//审批人用approval.key_file中只有自己可读的私钥对以上内容签名，apply时用approval.public_keys_dir/<审批人>.pub验证，
+//一个公钥只能验证以对应审批人名义所做的审批，能读取公钥或审批文件的人都不能伪造其他审批人
+type Approval struct {
+	Reviewer       string `json:"reviewer"`
+	Host           string `json:"host"`
+	Time           string `json:"time"`
+	PlanChecksum   string `json:"plan_checksum"`
+	StatementsHash string `json:"statements_hash"`
+	Signature      string `json:"signature,omitempty"`
+}
+
+func (this *Approval) SignedContent() []byte {
+	return []byte(fmt.Sprintf("%v\n%v\n%v\n%v\n%v\n", this.Reviewer, this.Host, this.Time, this.PlanChecksum, this.StatementsHash))
+}
+
+func (this *Approval) Sign(private_key ed25519.PrivateKey) string {
+	return hex.EncodeToString(ed25519.Sign(private_key, this.SignedContent()))
+}
+
+func (this *Approval) VerifySignature(public_key ed25519.PublicKey) bool {
+	signature, err := hex.DecodeString(this.Signature)
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(public_key, this.SignedContent(), signature)
+}
+
+//审批人的签名私钥，文件中保存十六进制的种子，由keygen命令生成
+func LoadApprovalKey() (ed25519.PrivateKey, error) {
+	key_file := GetConfigString("approval.key_file", "")
+	if key_file == "" {
+		return nil, fmt.Errorf("approval.key_file not set, run the keygen command to create a signing key")
+	}
+
+	content, err := ioutil.ReadFile(key_file)
+	if err != nil {
+		LOG_ERROR("read approval key %v error: %v", key_file, err)
+		return nil, err
+	}
+
+	seed, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("approval key %v is not a valid signing key", key_file)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+//审批人的公钥：keys_dir/<审批人>.pub，保存十六进制的公钥
+func LoadReviewerPublicKey(keys_dir string, reviewer string) (ed25519.PublicKey, error) {
+	//审批人名字来自审批文件，不能让它指向公钥目录之外的文件
+	if reviewer == "" || reviewer != filepath.Base(reviewer) || strings.HasPrefix(reviewer, ".") {
+		return nil, fmt.Errorf("invalid reviewer name %q", reviewer)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(keys_dir, reviewer+PUBLIC_KEY_SUFFIX))
+	if err != nil {
+		return nil, err
+	}
+
+	public_key, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil || len(public_key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key of reviewer %v is invalid", reviewer)
+	}
+	return ed25519.PublicKey(public_key), nil
+}
+
+//生成当前用户的签名密钥对，私钥写入approval.key_file(已存在时不覆盖)，公钥输出到stdout
+func RunKeygen() error {
+	key_file := GetConfigString("approval.key_file", "")
+	if key_file == "" {
+		return fmt.Errorf("approval.key_file not set")
+	}
+
+	reviewer := GetReviewer()
+	if reviewer == "" {
+		return fmt.Errorf("reviewer unknown")
+	}
+
+	public_key, private_key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(key_file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		LOG_ERROR("create approval key %v error: %v", key_file, err)
+		return err
+	}
+	_, err = fmt.Fprintln(f, hex.EncodeToString(private_key.Seed()))
+	if close_err := f.Close(); err == nil {
+		err = close_err
+	}
+	if err != nil {
+		LOG_ERROR("write approval key %v error: %v", key_file, err)
+		return err
+	}
+
+	fmt.Printf("signing key of %v saved in %v\n", reviewer, key_file)
+	fmt.Printf("save the public key below as %v%v in approval.public_keys_dir of the hosts running apply:\n", reviewer, PUBLIC_KEY_SUFFIX)
+	fmt.Println(hex.EncodeToString(public_key))
+
+	return nil
+}
+
+//将要执行的语句的哈希：按文件顺序覆盖文件名和其中的每条语句，不包括注释
+func StatementsHash(plan_files []*PlanFile) string {
+	hash := sha256.New()
+	for _, plan_file := range plan_files {
+		fmt.Fprintf(hash, "%v\n%v\n\n", plan_file.Name, strings.Join(plan_file.Statements, "\n"))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (this *Plan) StatementsHash() string {
+	return StatementsHash(this.Files)
+}
+
+func GetApprovalFile(plan_file string) string {
+	return plan_file + APPROVAL_FILE_SUFFIX
+}
+
+func LoadApprovals(plan_file string) ([]*Approval, error) {
+	content, err := ioutil.ReadFile(GetApprovalFile(plan_file))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var approvals []*Approval
+	err = json.Unmarshal(content, &approvals)
+	if err != nil {
+		LOG_ERROR("parse %v error: %v", GetApprovalFile(plan_file), err)
+		return nil, err
+	}
+
+	return approvals, nil
+}
+
+func SaveApprovals(plan_file string, approvals []*Approval) error {
+	content, err := json.MarshalIndent(approvals, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(GetApprovalFile(plan_file), content, 0666)
+}
+
+//审批人是执行approve命令的系统用户，不能由命令行指定
+func GetReviewer() string {
+	if current, err := user.Current(); err == nil {
+		return current.Username
+	}
+	return ""
+}
+
+//审批计划，审批记录保存在计划文件旁边的<plan>.approvals中
+func RunApprove(plan_file string) error {
+	if plan_file == "" {
+		return fmt.Errorf("plan file not specified")
+	}
+
+	plan, err := LoadPlan(plan_file)
+	if err != nil {
+		return err
+	}
+
+	reviewer := GetReviewer()
+	if reviewer == "" {
+		return fmt.Errorf("reviewer unknown")
+	}
+
+	key, err := LoadApprovalKey()
+	if err != nil {
+		return err
+	}
+
+	//计划的创建者不能审批自己的计划
+	if !GetConfigBool("approval.allow_self_approval", false) && strings.SplitN(plan.CreatedBy, "@", 2)[0] == reviewer {
+		LOG_ERROR("%v created the plan and cannot approve it", reviewer)
+		return fmt.Errorf("self approval not allowed")
+	}
+
+	approvals, err := LoadApprovals(plan_file)
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	approval := &Approval{
+		Reviewer:       reviewer,
+		Host:           hostname,
+		Time:           time.Now().Format("2006-01-02 15:04:05"),
+		PlanChecksum:   plan.Checksum,
+		StatementsHash: plan.StatementsHash(),
+	}
+	approval.Signature = approval.Sign(key)
+
+	//同一个审批人重复审批时覆盖之前的记录
+	var kept []*Approval
+	for _, existing := range approvals {
+		if existing.Reviewer != reviewer {
+			kept = append(kept, existing)
+		}
+	}
+	kept = append(kept, approval)
+
+	err = SaveApprovals(plan_file, kept)
+	if err != nil {
+		LOG_ERROR("save approvals of %v error: %v", plan_file, err)
+		return err
+	}
+
+	LOG_INFO("plan %v approved by %v, %v approvals recorded in %v", plan.Checksum, reviewer, len(kept), GetApprovalFile(plan_file))
+
+	return nil
+}
+
+//apply之前检查计划有足够的有效审批：审批时的计划校验和以及语句哈希都和当前计划一致
+func VerifyApprovals(plan_file string, plan *Plan) error {
+	required := GetConfigInt("approval.required", 0)
+	if required <= 0 {
+		return nil
+	}
+
+	approvals, err := LoadApprovals(plan_file)
+	if err != nil {
+		return err
+	}
+
+	//没有签名的审批任何人都能伪造，需要审批时必须验证签名
+	keys_dir := GetConfigString("approval.public_keys_dir", "")
+	if keys_dir == "" {
+		LOG_ERROR("approval.public_keys_dir not set, approvals can not be verified")
+		return fmt.Errorf("approval.public_keys_dir not set")
+	}
+
+	statements_hash := plan.StatementsHash()
+	reviewers := make(map[string]bool)
+	for _, approval := range approvals {
+		public_key, err := LoadReviewerPublicKey(keys_dir, approval.Reviewer)
+		if err != nil {
+			LOG_WARN("approval by %v at %v can not be verified, ignored: %v", approval.Reviewer, approval.Time, err)
+			continue
+		}
+		if !approval.VerifySignature(public_key) {
+			LOG_WARN("approval by %v at %v has an invalid signature, ignored", approval.Reviewer, approval.Time)
+			continue
+		}
+		if approval.PlanChecksum != plan.Checksum || approval.StatementsHash != statements_hash {
+			LOG_WARN("approval by %v at %v does not match the plan, ignored", approval.Reviewer, approval.Time)
+			continue
+		}
+		reviewers[approval.Reviewer] = true
+	}
+
+	if int64(len(reviewers)) < required {
+		LOG_ERROR("plan %v has %v valid approvals, %v required", plan.Checksum, len(reviewers), required)
+		return fmt.Errorf("not enough approvals")
+	}
+
+	var names []string
+	for reviewer := range reviewers {
+		names = append(names, reviewer)
+	}
+	LOG_INFO("plan %v approved by %v", plan.Checksum, strings.Join(names, ", "))
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyApprovals(t *testing.T) {
+	dir, err := ioutil.TempDir("", "approval")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keys := make(map[string]ed25519.PrivateKey)
+	for _, reviewer := range []string{"alice", "bob", "mallory"} {
+		public_key, private_key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[reviewer] = private_key
+		//mallory没有登记公钥
+		if reviewer != "mallory" {
+			ioutil.WriteFile(filepath.Join(dir, reviewer+PUBLIC_KEY_SUFFIX), []byte(hex.EncodeToString(public_key)+"\n"), 0644)
+		}
+	}
+
+	restore := SetTestConfig(t, "approval.required = 2\napproval.public_keys_dir = "+dir+"\n")
+	defer restore()
+
+	plan_file := filepath.Join(dir, "p.plan.json")
+	sql_file, _ := NewPlanFile("t.sql", "ALTER TABLE t ADD `a` int;\n")
+	plan := &Plan{Files: []*PlanFile{sql_file}, Checksum: "c1"}
+
+	NewApproval := func(reviewer string, signer string) *Approval {
+		approval := &Approval{Reviewer: reviewer, Host: "h", Time: "now", PlanChecksum: plan.Checksum, StatementsHash: plan.StatementsHash()}
+		if signer != "" {
+			approval.Signature = approval.Sign(keys[signer])
+		}
+		return approval
+	}
+
+	cases := []struct {
+		name      string
+		approvals []*Approval
+		ok        bool
+	}{
+		{"two signed reviewers", []*Approval{NewApproval("alice", "alice"), NewApproval("bob", "bob")}, true},
+		{"same reviewer twice", []*Approval{NewApproval("alice", "alice"), NewApproval("alice", "alice")}, false},
+		{"unsigned approval", []*Approval{NewApproval("alice", "alice"), NewApproval("bob", "")}, false},
+		{"signed with another reviewer's key", []*Approval{NewApproval("alice", "alice"), NewApproval("bob", "alice")}, false},
+		{"reviewer without public key", []*Approval{NewApproval("alice", "alice"), NewApproval("mallory", "mallory")}, false},
+		{"reviewer name outside keys dir", []*Approval{NewApproval("alice", "alice"), NewApproval("../bob", "bob")}, false},
+		{"stale checksum", []*Approval{NewApproval("alice", "alice"), {Reviewer: "bob", PlanChecksum: "old", StatementsHash: plan.StatementsHash()}}, false},
+	}
+
+	for _, c := range cases {
+		err = SaveApprovals(plan_file, c.approvals)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = VerifyApprovals(plan_file, plan)
+		if (err == nil) != c.ok {
+			t.Errorf("%v: VerifyApprovals error = %v, want ok=%v", c.name, err, c.ok)
+		}
+	}
+
+	//签名之后修改了审批记录
+	edited := NewApproval("bob", "bob")
+	edited.Reviewer = "carol"
+	if edited.VerifySignature(keys["bob"].Public().(ed25519.PublicKey)) {
+		t.Errorf("edited approval should not verify")
+	}
+
+	//需要审批时没有配置公钥目录，签名有效的审批也不接受
+	SaveApprovals(plan_file, []*Approval{NewApproval("alice", "alice"), NewApproval("bob", "bob")})
+	restore_required := SetTestConfig(t, "approval.required = 1\n")
+	defer restore_required()
+	if err = VerifyApprovals(plan_file, plan); err == nil {
+		t.Errorf("VerifyApprovals without approval.public_keys_dir should fail")
+	}
+}
+
+func TestLoadApprovalKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "approval")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, private_key, _ := ed25519.GenerateKey(rand.Reader)
+	key_file := filepath.Join(dir, "approval.key")
+	bad_file := filepath.Join(dir, "bad.key")
+	ioutil.WriteFile(key_file, []byte(hex.EncodeToString(private_key.Seed())+"\n"), 0600)
+	ioutil.WriteFile(bad_file, []byte("secret\n"), 0600)
+
+	cases := []struct {
+		config string
+		ok     bool
+	}{
+		{"approval.key_file = " + key_file + "\n", true},
+		{"approval.key_file = " + bad_file + "\n", false},
+		{"approval.key_file = " + filepath.Join(dir, "missing.key") + "\n", false},
+		{"", false},
+	}
+
+	for _, c := range cases {
+		restore := SetTestConfig(t, c.config)
+		key, err := LoadApprovalKey()
+		restore()
+		if (err == nil) != c.ok {
+			t.Errorf("LoadApprovalKey(%q) error = %v, want ok=%v", c.config, err, c.ok)
+		}
+		if err == nil && !private_key.Equal(key) {
+			t.Errorf("LoadApprovalKey(%q) returned another key", c.config)
+		}
+	}
+}
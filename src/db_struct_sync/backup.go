@@ -0,0 +1,709 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	BACKUP_MANIFEST_FILE string = "manifest.json"
+
+	BACKUP_FORMAT_SQL string = "sql"
+	BACKUP_FORMAT_CSV string = "csv"
+
+	BACKUP_SCOPE_FULL    string = "full"
+	BACKUP_SCOPE_COLUMNS string = "columns"
+
+	BACKUP_KIND_TABLE   string = "table"
+	BACKUP_KIND_COLUMNS string = "columns"
+
+	CSV_NULL string = "\\N"
+
+	//生成sql文件时记录每张表将被删除的字段，执行前据此备份
+	DROPPED_COLUMNS_FILE string = "DROPPED_COLUMNS.json"
+)
+
+var g_backupManager *BackupManager
+
+var g_dropTableRegExp = regexp.MustCompile("(?i)^\\s*DROP\\s+TABLE\\s+(?:IF\\s+EXISTS\\s+)?(`?[^`\\s;]+`?)")
+
+//备份的字段：字段名和字段定义
+type BackupColumn struct {
+	Name       string `json:"name"`
+	Definition string `json:"definition"`
+}
+
+//一次备份，kind为table时是整张表，为columns时是被删除的字段
+type BackupEntry struct {
+	Kind        string         `json:"kind"`
+	Table       string         `json:"table"`
+	Format      string         `json:"format"`
+	File        string         `json:"file"`
+	CreateTable string         `json:"create_table"`
+	PrimaryKey  []string       `json:"primary_key"`
+	Columns     []BackupColumn `json:"columns"`
+	DataColumns []string       `json:"data_columns"`
+	Statement   string         `json:"statement"`
+	Rows        int64          `json:"rows"`
+	Time        string         `json:"time"`
+
+	//二进制字段：sql格式写成X'..'，csv格式写成十六进制
+	BinaryColumns []string `json:"binary_columns,omitempty"`
+}
+
+type BackupManifest struct {
+	Database string         `json:"database"`
+	Created  string         `json:"created"`
+	Entries  []*BackupEntry `json:"entries"`
+}
+
+//执行DROP TABLE或删除字段之前，把受影响的数据备份到本地目录，restore命令可以根据manifest恢复
+type BackupManager struct {
+	dbAdaptor *MysqlDBAdaptor
+	dir       string
+	format    string
+	scope     string
+	run_dir   string
+	manifest  *BackupManifest
+
+	//表名 => 将被删除的字段，来自生成sql文件时的结构变更，而不是解析语句
+	dropped_columns map[string][]string
+	backed_up       map[string]bool
+}
+
+func NewBackupManager(data_dir string, dbAdaptor *MysqlDBAdaptor) (*BackupManager, error) {
+	manager := &BackupManager{
+		dbAdaptor: dbAdaptor,
+		dir:       GetBackupDir(data_dir),
+		format:    strings.ToLower(GetConfigString("backup.format", BACKUP_FORMAT_SQL)),
+		scope:     strings.ToLower(GetConfigString("backup.scope", BACKUP_SCOPE_FULL)),
+		backed_up: make(map[string]bool),
+	}
+
+	var err error
+	manager.dropped_columns, err = ReadDroppedColumns(data_dir)
+	if err != nil {
+		return nil, err
+	}
+
+	switch manager.format {
+	case BACKUP_FORMAT_SQL, BACKUP_FORMAT_CSV:
+	default:
+		return nil, fmt.Errorf("invalid backup.format: %v", manager.format)
+	}
+
+	switch manager.scope {
+	case BACKUP_SCOPE_FULL, BACKUP_SCOPE_COLUMNS:
+	default:
+		return nil, fmt.Errorf("invalid backup.scope: %v", manager.scope)
+	}
+
+	return manager, nil
+}
+
+func GetBackupDir(data_dir string) string {
+	return GetConfigString("backup.dir", filepath.Join(data_dir, "backup"))
+}
+
+//根据将要执行的语句判断是否需要备份
+func (this *BackupManager) BeforeStatement(statement string) error {
+	if this == nil {
+		return nil
+	}
+
+	if match := g_dropTableRegExp.FindStringSubmatch(statement); match != nil {
+		return this.BackupTable(strings.Trim(match[1], "`"), statement)
+	}
+
+	if !IsAlterTableSql(statement) {
+		return nil
+	}
+
+	//一张表的字段在它的第一条ALTER TABLE之前一起备份
+	table_name := GetAlterTableName(statement)
+	columns := this.dropped_columns[table_name]
+	if len(columns) == 0 || this.backed_up[table_name] {
+		return nil
+	}
+	this.backed_up[table_name] = true
+
+	return this.BackupColumns(table_name, columns, statement)
+}
+
+//结构变更中每张表被删除的字段(CHANGE_DROP_FIELD)，字段名不带反引号
+func GetDroppedColumns(table_changes_list []*TableChanges) map[string][]string {
+	dropped := make(map[string][]string)
+	for _, table_changes := range table_changes_list {
+		for _, change := range table_changes.changes {
+			if change.change_type == CHANGE_DROP_FIELD {
+				dropped[change.table_name] = append(dropped[change.table_name], strings.Trim(change.object_name, "`"))
+			}
+		}
+	}
+	return dropped
+}
+
+func WriteDroppedColumns(data_dir string, dropped map[string][]string) error {
+	content, err := json.MarshalIndent(dropped, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(filepath.Join(data_dir, DROPPED_COLUMNS_FILE), content, 0666)
+	if err != nil {
+		LOG_ERROR("write %v error: %v", DROPPED_COLUMNS_FILE, err)
+		return err
+	}
+	return nil
+}
+
+func ReadDroppedColumns(data_dir string) (map[string][]string, error) {
+	dropped := make(map[string][]string)
+
+	content, err := ioutil.ReadFile(filepath.Join(data_dir, DROPPED_COLUMNS_FILE))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return dropped, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(content, &dropped)
+	if err != nil {
+		LOG_ERROR("parse %v error: %v", DROPPED_COLUMNS_FILE, err)
+		return nil, err
+	}
+	return dropped, nil
+}
+
+func (this *BackupManager) BackupTable(table_name string, statement string) error {
+	entry := &BackupEntry{
+		Kind:      BACKUP_KIND_TABLE,
+		Table:     table_name,
+		Statement: statement,
+	}
+
+	var err error
+	entry.CreateTable, err = ShowCreateTable(this.dbAdaptor, table_name)
+	if err != nil {
+		return err
+	}
+
+	entry.PrimaryKey, err = GetPrimaryKeyColumns(this.dbAdaptor, table_name)
+	if err != nil {
+		return err
+	}
+
+	entry.DataColumns, err = GetTableColumns(this.dbAdaptor, table_name)
+	if err != nil {
+		return err
+	}
+
+	return this.Dump(entry)
+}
+
+func (this *BackupManager) BackupColumns(table_name string, columns []string, statement string) error {
+	entry := &BackupEntry{
+		Kind:      BACKUP_KIND_COLUMNS,
+		Table:     table_name,
+		Statement: statement,
+	}
+
+	create_table, err := ShowCreateTable(this.dbAdaptor, table_name)
+	if err != nil {
+		return err
+	}
+
+	//从建表语句中取出被删除字段的定义，恢复时用来重新添加字段
+	fields_struct := make(map[string]string)
+	for _, line := range strings.Split(create_table, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "`") {
+			ParseFieldStruct(line, fields_struct)
+		}
+	}
+	for _, column := range columns {
+		definition, ok := fields_struct[QuoteName(column)]
+		if !ok {
+			return fmt.Errorf("column %v not found in table %v", column, table_name)
+		}
+		entry.Columns = append(entry.Columns, BackupColumn{column, definition})
+	}
+
+	entry.PrimaryKey, err = GetPrimaryKeyColumns(this.dbAdaptor, table_name)
+	if err != nil {
+		return err
+	}
+
+	scope := this.scope
+	if len(entry.PrimaryKey) == 0 && scope == BACKUP_SCOPE_COLUMNS {
+		LOG_WARN("table %v has no primary key, back up the full table instead of the dropped columns", table_name)
+		scope = BACKUP_SCOPE_FULL
+	}
+
+	if scope == BACKUP_SCOPE_FULL {
+		entry.DataColumns, err = GetTableColumns(this.dbAdaptor, table_name)
+		if err != nil {
+			return err
+		}
+	} else {
+		entry.DataColumns = append(entry.DataColumns, entry.PrimaryKey...)
+		entry.DataColumns = append(entry.DataColumns, columns...)
+	}
+
+	return this.Dump(entry)
+}
+
+//导出数据并更新manifest
+func (this *BackupManager) Dump(entry *BackupEntry) error {
+	var err error
+
+	if this.run_dir == "" {
+		this.run_dir = filepath.Join(this.dir, time.Now().Format("20060102150405"))
+		err = os.MkdirAll(this.run_dir, os.ModePerm)
+		if err != nil {
+			LOG_ERROR("create backup dir %v error: %v", this.run_dir, err)
+			return err
+		}
+		this.manifest = &BackupManifest{
+			Database: GetConfigString("mysql_dest.dbname", ""),
+			Created:  time.Now().Format("2006-01-02 15:04:05"),
+		}
+	}
+
+	entry.Format = this.format
+	entry.Time = time.Now().Format("2006-01-02 15:04:05")
+	entry.File = fmt.Sprintf("%03d_%v_%v.%v", len(this.manifest.Entries)+1, entry.Table, entry.Kind, this.format)
+
+	var quoted_columns []string
+	for _, column := range entry.DataColumns {
+		quoted_columns = append(quoted_columns, QuoteName(column))
+	}
+
+	rows, err := this.dbAdaptor.Query(fmt.Sprintf("SELECT %v FROM %v", strings.Join(quoted_columns, ", "), QuoteName(entry.Table)))
+	if err != nil {
+		LOG_ERROR("query data of table %v for backup error: %v", entry.Table, err)
+		return err
+	}
+	defer rows.Close()
+
+	column_types, err := rows.ColumnTypes()
+	if err != nil {
+		return err
+	}
+	for i, column_type := range column_types {
+		if IsBinaryColumnType(column_type.DatabaseTypeName()) {
+			entry.BinaryColumns = append(entry.BinaryColumns, entry.DataColumns[i])
+		}
+	}
+
+	filename := filepath.Join(this.run_dir, entry.File)
+	f, err := os.Create(filename)
+	if err != nil {
+		LOG_ERROR("create %v file error: %v", filename, err)
+		return err
+	}
+	defer f.Close()
+
+	writer := NewBackupWriter(f, entry)
+	values := make([]sql.RawBytes, len(entry.DataColumns))
+	pointers := make([]interface{}, len(entry.DataColumns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	for rows.Next() {
+		err = rows.Scan(pointers...)
+		if err != nil {
+			LOG_ERROR("scan data of table %v for backup error: %v", entry.Table, err)
+			return err
+		}
+		err = writer.Write(values)
+		if err != nil {
+			LOG_ERROR("write backup file %v error: %v", filename, err)
+			return err
+		}
+		entry.Rows++
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	this.manifest.Entries = append(this.manifest.Entries, entry)
+	err = SaveBackupManifest(this.run_dir, this.manifest)
+	if err != nil {
+		return err
+	}
+
+	LOG_INFO("backup %v of table %v (%v rows) to %v", entry.Kind, entry.Table, entry.Rows, filename)
+
+	return nil
+}
+
+//按字符串导出会破坏非UTF-8的字节，这些类型的字段按十六进制导出
+func IsBinaryColumnType(type_name string) bool {
+	switch strings.ToUpper(type_name) {
+	case "BINARY", "VARBINARY", "TINYBLOB", "BLOB", "MEDIUMBLOB", "LONGBLOB", "BIT", "GEOMETRY":
+		return true
+	}
+	return false
+}
+
+//备份文件的写入：sql格式每行一条INSERT语句，csv格式第一行是字段名，NULL写成\N
+type BackupWriter struct {
+	entry      *BackupEntry
+	binary     []bool
+	buf        *bufio.Writer
+	csv_writer *csv.Writer
+}
+
+func NewBackupWriter(w io.Writer, entry *BackupEntry) *BackupWriter {
+	writer := &BackupWriter{
+		entry:  entry,
+		binary: entry.BinaryFlags(),
+	}
+	if entry.Format == BACKUP_FORMAT_CSV {
+		writer.csv_writer = csv.NewWriter(w)
+		writer.csv_writer.Write(entry.DataColumns)
+	} else {
+		writer.buf = bufio.NewWriter(w)
+	}
+	return writer
+}
+
+func (this *BackupWriter) Write(values []sql.RawBytes) error {
+	if this.csv_writer != nil {
+		record := make([]string, len(values))
+		for i, value := range values {
+			if value == nil {
+				record[i] = CSV_NULL
+			} else if this.binary[i] {
+				record[i] = hex.EncodeToString(value)
+			} else {
+				record[i] = EscapeCsvValue(string(value))
+			}
+		}
+		return this.csv_writer.Write(record)
+	}
+
+	var literals []string
+	for i, value := range values {
+		if value == nil {
+			literals = append(literals, "NULL")
+		} else if this.binary[i] {
+			literals = append(literals, HexSqlValue(value))
+		} else {
+			literals = append(literals, QuoteSqlValue(string(value)))
+		}
+	}
+	_, err := fmt.Fprintf(this.buf, "%v\n", MakeRestoreInsertSql(this.entry, strings.Join(literals, ", ")))
+	return err
+}
+
+func (this *BackupWriter) Flush() error {
+	if this.csv_writer != nil {
+		this.csv_writer.Flush()
+		return this.csv_writer.Error()
+	}
+	return this.buf.Flush()
+}
+
+//恢复用的INSERT语句，字段备份对已存在的行只更新被删除的字段
+func MakeRestoreInsertSql(entry *BackupEntry, values string) string {
+	var quoted_columns []string
+	for _, column := range entry.DataColumns {
+		quoted_columns = append(quoted_columns, QuoteName(column))
+	}
+
+	insert_sql := fmt.Sprintf("INSERT INTO %v (%v) VALUES (%v)", QuoteName(entry.Table), strings.Join(quoted_columns, ", "), values)
+	if entry.Kind == BACKUP_KIND_COLUMNS {
+		var updates []string
+		for _, column := range entry.Columns {
+			updates = append(updates, fmt.Sprintf("%v = VALUES(%v)", QuoteName(column.Name), QuoteName(column.Name)))
+		}
+		insert_sql = fmt.Sprintf("%v ON DUPLICATE KEY UPDATE %v", insert_sql, strings.Join(updates, ", "))
+	}
+
+	return insert_sql + ";"
+}
+
+func QuoteSqlValue(value string) string {
+	replacer := strings.NewReplacer("\\", "\\\\", "'", "\\'", "\n", "\\n", "\r", "\\r", "\x00", "\\0", "\x1a", "\\Z")
+	return "'" + replacer.Replace(value) + "'"
+}
+
+//二进制值写成十六进制字面量，不受连接字符集影响
+func HexSqlValue(value []byte) string {
+	return "X'" + hex.EncodeToString(value) + "'"
+}
+
+//csv中\N表示NULL，以反斜杠开头的值再加一个反斜杠，字面的\N写成\\N，和NULL区分开
+func EscapeCsvValue(value string) string {
+	if strings.HasPrefix(value, "\\") {
+		return "\\" + value
+	}
+	return value
+}
+
+//EscapeCsvValue的逆过程，第二个返回值为false表示NULL
+func UnescapeCsvValue(value string) (string, bool) {
+	if value == CSV_NULL {
+		return "", false
+	}
+	return strings.TrimPrefix(value, "\\"), true
+}
+
+//每个数据字段是否是二进制字段
+func (this *BackupEntry) BinaryFlags() []bool {
+	flags := make([]bool, len(this.DataColumns))
+	for i, column := range this.DataColumns {
+		flags[i] = StringInSlice(column, this.BinaryColumns)
+	}
+	return flags
+}
+
+func ShowCreateTable(dbAdaptor *MysqlDBAdaptor, table_name string) (string, error) {
+	row, err := dbAdaptor.QueryRow(fmt.Sprintf("%v %v", SHOW_CREATE_TABLE_PREFIX_SQL, QuoteName(table_name)))
+	if err != nil {
+		return "", err
+	}
+
+	var name, create_table_sql string
+	err = row.Scan(&name, &create_table_sql)
+	if err != nil {
+		LOG_ERROR("show create table %v error: %v", table_name, err)
+		return "", err
+	}
+
+	return create_table_sql, nil
+}
+
+func SaveBackupManifest(run_dir string, manifest *BackupManifest) error {
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(run_dir, BACKUP_MANIFEST_FILE), content, 0666)
+}
+
+func LoadBackupManifest(run_dir string) (*BackupManifest, error) {
+	content, err := ioutil.ReadFile(filepath.Join(run_dir, BACKUP_MANIFEST_FILE))
+	if err != nil {
+		LOG_ERROR("read backup manifest in %v error: %v", run_dir, err)
+		return nil, err
+	}
+
+	manifest := &BackupManifest{}
+	err = json.Unmarshal(content, manifest)
+	if err != nil {
+		LOG_ERROR("parse backup manifest in %v error: %v", run_dir, err)
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+//按manifest倒序恢复：重建被删除的表或字段，再导入备份的数据
+func RunRestore(run_dir string) error {
+	if run_dir == "" {
+		return fmt.Errorf("backup dir not specified")
+	}
+
+	manifest, err := LoadBackupManifest(run_dir)
+	if err != nil {
+		return err
+	}
+
+	g_destMysqlAdaptor, err = OpenMysqlDBAdaptor("mysql_dest", false)
+	if err != nil {
+		return err
+	}
+	defer g_destMysqlAdaptor.Release()
+
+	run_lock, err := AcquireRunLock(g_destMysqlAdaptor, "restore")
+	if err != nil {
+		LOG_ERROR("lock destination fail: %v", err)
+		return err
+	}
+	defer run_lock.Release()
+
+	for i := len(manifest.Entries) - 1; i >= 0; i-- {
+		err = RestoreEntry(g_destMysqlAdaptor, run_dir, manifest.Entries[i])
+		if err != nil {
+			LOG_ERROR("restore %v of table %v error: %v", manifest.Entries[i].Kind, manifest.Entries[i].Table, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func RestoreEntry(dbAdaptor *MysqlDBAdaptor, run_dir string, entry *BackupEntry) error {
+	table_exists, err := TableExists(dbAdaptor, entry.Table)
+	if err != nil {
+		return err
+	}
+
+	switch entry.Kind {
+	case BACKUP_KIND_TABLE:
+		if table_exists {
+			LOG_WARN("table %v already exists, skip restoring it", entry.Table)
+			return nil
+		}
+		err = dbAdaptor.Exec(entry.CreateTable)
+		if err != nil {
+			return err
+		}
+	case BACKUP_KIND_COLUMNS:
+		if !table_exists {
+			return fmt.Errorf("table %v not exists", entry.Table)
+		}
+		existing_columns, err := GetTableColumns(dbAdaptor, entry.Table)
+		if err != nil {
+			return err
+		}
+		for _, column := range entry.Columns {
+			if StringInSlice(column.Name, existing_columns) {
+				continue
+			}
+			err = dbAdaptor.Exec(fmt.Sprintf("ALTER TABLE %v ADD %v %v", QuoteName(entry.Table), QuoteName(column.Name), column.Definition))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	filename := filepath.Join(run_dir, entry.File)
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var count int64
+	if entry.Format == BACKUP_FORMAT_CSV {
+		count, err = RestoreCsvFile(dbAdaptor, f, entry)
+	} else {
+		count, err = RestoreSqlFile(dbAdaptor, f)
+	}
+	if err != nil {
+		return err
+	}
+
+	LOG_INFO("restored %v of table %v, %v rows", entry.Kind, entry.Table, count)
+
+	return nil
+}
+
+//sql格式的备份每行一条语句
+func RestoreSqlFile(dbAdaptor *MysqlDBAdaptor, r io.Reader) (int64, error) {
+	var count int64
+
+	buf := bufio.NewReader(r)
+	for {
+		line, err := buf.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line != "" {
+			exec_err := dbAdaptor.Exec(strings.TrimSuffix(line, ";"))
+			if exec_err != nil {
+				return count, exec_err
+			}
+			count++
+		}
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return count, err
+		}
+	}
+
+	return count, nil
+}
+
+func RestoreCsvFile(dbAdaptor *MysqlDBAdaptor, r io.Reader, entry *BackupEntry) (int64, error) {
+	var count int64
+
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return 0, err
+	}
+	if len(header) != len(entry.DataColumns) {
+		return 0, fmt.Errorf("csv header does not match the manifest")
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(header)), ", ")
+	insert_sql := strings.TrimSuffix(MakeRestoreInsertSql(entry, placeholders), ";")
+	binary := entry.BinaryFlags()
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+
+		args, err := DecodeCsvRecord(record, binary)
+		if err != nil {
+			return count, err
+		}
+
+		err = dbAdaptor.ExecFormat(insert_sql, args...)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+//把csv中的一行还原成插入的参数，二进制字段还原成[]byte
+func DecodeCsvRecord(record []string, binary []bool) ([]interface{}, error) {
+	args := make([]interface{}, len(record))
+	for i, value := range record {
+		value, ok := UnescapeCsvValue(value)
+		if !ok {
+			args[i] = nil
+			continue
+		}
+		if !binary[i] {
+			args[i] = value
+			continue
+		}
+		data, err := hex.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex value of binary column %v: %v", i+1, err)
+		}
+		args[i] = data
+	}
+	return args, nil
+}
+
+func StringInSlice(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
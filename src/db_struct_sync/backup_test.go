@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestQuoteSqlValue(t *testing.T) {
+	cases := []struct {
+		value  string
+		expect string
+	}{
+		{"abc", "'abc'"},
+		{"it's", "'it\\'s'"},
+		{"a\\b", "'a\\\\b'"},
+		{"line1\nline2\r", "'line1\\nline2\\r'"},
+		{"\x00\x1a", "'\\0\\Z'"},
+	}
+
+	for _, c := range cases {
+		if got := QuoteSqlValue(c.value); got != c.expect {
+			t.Errorf("QuoteSqlValue(%q) = %v, want %v", c.value, got, c.expect)
+		}
+	}
+}
+
+func TestBackupWriterSql(t *testing.T) {
+	entry := &BackupEntry{
+		Kind:          BACKUP_KIND_TABLE,
+		Table:         "t",
+		Format:        BACKUP_FORMAT_SQL,
+		DataColumns:   []string{"id", "name", "data"},
+		BinaryColumns: []string{"data"},
+	}
+
+	cases := []struct {
+		values []sql.RawBytes
+		expect string
+	}{
+		{[]sql.RawBytes{sql.RawBytes("1"), sql.RawBytes("a'b"), sql.RawBytes{0xff, 0x00, '\''}},
+			"INSERT INTO `t` (`id`, `name`, `data`) VALUES ('1', 'a\\'b', X'ff0027');\n"},
+		{[]sql.RawBytes{sql.RawBytes("2"), nil, sql.RawBytes{}},
+			"INSERT INTO `t` (`id`, `name`, `data`) VALUES ('2', NULL, X'');\n"},
+	}
+
+	for _, c := range cases {
+		var buf bytes.Buffer
+		writer := NewBackupWriter(&buf, entry)
+		if err := writer.Write(c.values); err != nil {
+			t.Fatal(err)
+		}
+		writer.Flush()
+		if buf.String() != c.expect {
+			t.Errorf("Write(%q) = %q, want %q", c.values, buf.String(), c.expect)
+		}
+	}
+}
+
+func TestBackupWriterCsvRoundTrip(t *testing.T) {
+	entry := &BackupEntry{
+		Kind:          BACKUP_KIND_TABLE,
+		Table:         "t",
+		Format:        BACKUP_FORMAT_CSV,
+		DataColumns:   []string{"id", "note", "data"},
+		BinaryColumns: []string{"data"},
+	}
+
+	rows := [][]sql.RawBytes{
+		{sql.RawBytes("1"), nil, nil},
+		{sql.RawBytes("2"), sql.RawBytes("\\N"), sql.RawBytes{0xff, 0xfe}},
+		{sql.RawBytes("3"), sql.RawBytes("\\\\N"), sql.RawBytes("\\N")},
+		{sql.RawBytes("4"), sql.RawBytes("a,\"b\"\nc"), sql.RawBytes{}},
+	}
+	expect := [][]interface{}{
+		{"1", nil, nil},
+		{"2", "\\N", []byte{0xff, 0xfe}},
+		{"3", "\\\\N", []byte("\\N")},
+		{"4", "a,\"b\"\nc", []byte{}},
+	}
+
+	var buf bytes.Buffer
+	writer := NewBackupWriter(&buf, entry)
+	for _, row := range rows {
+		if err := writer.Write(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := csv.NewReader(strings.NewReader(buf.String()))
+	records, err := reader.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(records[0], entry.DataColumns) {
+		t.Errorf("header = %v, want %v", records[0], entry.DataColumns)
+	}
+
+	for i, record := range records[1:] {
+		args, err := DecodeCsvRecord(record, entry.BinaryFlags())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(args, expect[i]) {
+			t.Errorf("row %v decoded to %#v, want %#v", i+1, args, expect[i])
+		}
+	}
+}
+
+func TestIsBinaryColumnType(t *testing.T) {
+	cases := map[string]bool{
+		"VARBINARY": true,
+		"blob":      true,
+		"LONGBLOB":  true,
+		"BIT":       true,
+		"VARCHAR":   false,
+		"TEXT":      false,
+		"INT":       false,
+	}
+
+	for type_name, binary := range cases {
+		if got := IsBinaryColumnType(type_name); got != binary {
+			t.Errorf("IsBinaryColumnType(%v) = %v, want %v", type_name, got, binary)
+		}
+	}
+}
+
+func TestGetDroppedColumns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	users := NewTableChanges("users")
+	users.Add(CHANGE_DROP_FIELD, "`old`", "", "int(11)")
+	users.Add(CHANGE_MODIFY_FIELD, "`note`", "varchar(64) COMMENT 'DROP legacy after release'", "varchar(32)")
+	users.Add(CHANGE_DROP_INDEX, "`idx_old`", "", "(`old`)")
+	users.Add(CHANGE_DROP_FIELD, "`tmp`", "", "int(11)")
+	orders := NewTableChanges("orders")
+	orders.Add(CHANGE_ADD_FIELD, "`drop`", "int(11) DEFAULT NULL", "")
+	orders.Add(CHANGE_DROP_INDEX, "`PRIMARY`", "", "(`id`)")
+
+	dropped := GetDroppedColumns([]*TableChanges{users, orders})
+	expect := map[string][]string{"users": {"old", "tmp"}}
+	if !reflect.DeepEqual(dropped, expect) {
+		t.Errorf("GetDroppedColumns = %v, want %v", dropped, expect)
+	}
+
+	err = WriteDroppedColumns(dir, dropped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := ReadDroppedColumns(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, expect) {
+		t.Errorf("ReadDroppedColumns = %v, want %v", loaded, expect)
+	}
+
+	//语句中注释、默认值里的DROP不会触发备份，备份只按记录的字段进行
+	manager := &BackupManager{dropped_columns: loaded, backed_up: make(map[string]bool)}
+	for _, statement := range []string{
+		"ALTER TABLE `orders` ADD `drop` int(11) DEFAULT NULL COMMENT 'DROP `id`'",
+		"ALTER TABLE `orders` MODIFY `status` varchar(16) DEFAULT 'DROP'",
+	} {
+		if err := manager.BeforeStatement(statement); err != nil {
+			t.Errorf("BeforeStatement(%q) error: %v", statement, err)
+		}
+	}
+
+	//已经备份过的表不再重复备份
+	manager.backed_up["users"] = true
+	if err := manager.BeforeStatement("ALTER TABLE `users` DROP `old`"); err != nil {
+		t.Errorf("BeforeStatement after backup error: %v", err)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	BASELINE_FORMAT_VERSION int    = 1
+	BASELINE_REPORT_FILE    string = "BASELINE_REPORT.txt"
+	BASELINE_DATE_LAYOUT    string = "2006-01-02"
+)
+
+//基线中一条可以接受的差异，如生产库上额外的报表索引、测试库上更短的字段
+//change: 变更类型，如 DROP INDEX、MODIFY COLUMN
+//table/object: 表名和字段名或索引名，glob模式或以re:开头的正则表达式，object为空表示任意
+//src/dest: 可选，源库和目标库中的定义必须和它相同才算匹配，定义变了差异会重新出现
+//expires: 可选，过期日期(2006-01-02)，过期之后不再忽略
+type BaselineEntry struct {
+	Change  string `json:"change"`
+	Table   string `json:"table"`
+	Object  string `json:"object,omitempty"`
+	Src     string `json:"src,omitempty"`
+	Dest    string `json:"dest,omitempty"`
+	Reason  string `json:"reason"`
+	Expires string `json:"expires,omitempty"`
+
+	matched int
+}
+
+type Baseline struct {
+	Version int              `json:"version"`
+	Entries []*BaselineEntry `json:"entries"`
+}
+
+func LoadBaseline(filename string) (*Baseline, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		LOG_ERROR("read baseline %v error: %v", filename, err)
+		return nil, err
+	}
+
+	baseline := &Baseline{}
+	err = json.Unmarshal(content, baseline)
+	if err != nil {
+		LOG_ERROR("parse baseline %v error: %v", filename, err)
+		return nil, err
+	}
+
+	if baseline.Version != BASELINE_FORMAT_VERSION {
+		return nil, fmt.Errorf("unsupported baseline version %v in %v", baseline.Version, filename)
+	}
+
+	for i, entry := range baseline.Entries {
+		if !IsChangeTypeName(entry.Change) || entry.Table == "" {
+			return nil, fmt.Errorf("invalid baseline entry %v in %v: change and table are required", i+1, filename)
+		}
+		if err := ValidatePatterns([]string{entry.Table, entry.Object}); err != nil {
+			return nil, fmt.Errorf("baseline entry %v in %v: %v", i+1, filename, err)
+		}
+		if entry.Expires != "" {
+			if _, err := time.Parse(BASELINE_DATE_LAYOUT, entry.Expires); err != nil {
+				return nil, fmt.Errorf("invalid expires %v of baseline entry %v in %v", entry.Expires, i+1, filename)
+			}
+		}
+		if entry.Reason == "" {
+			LOG_WARN("baseline entry %v has no reason", entry)
+		}
+	}
+
+	return baseline, nil
+}
+
+func IsChangeTypeName(name string) bool {
+	for _, type_name := range g_changeTypeNames {
+		if type_name == strings.ToUpper(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *BaselineEntry) IsExpired(now time.Time) bool {
+	if this.Expires == "" {
+		return false
+	}
+	expires, err := time.Parse(BASELINE_DATE_LAYOUT, this.Expires)
+	if err != nil {
+		return false
+	}
+	return !now.Before(expires.AddDate(0, 0, 1))
+}
+
+func (this *BaselineEntry) Match(change *SchemaChange) bool {
+	if strings.ToUpper(this.Change) != g_changeTypeNames[change.change_type] {
+		return false
+	}
+	if !MatchPattern(this.Table, change.table_name) {
+		return false
+	}
+	if this.Object != "" && !MatchPattern(this.Object, strings.Trim(change.object_name, "`")) {
+		return false
+	}
+	if this.Src != "" && strings.TrimSpace(this.Src) != strings.TrimSpace(change.src_attr) {
+		return false
+	}
+	if this.Dest != "" && strings.TrimSpace(this.Dest) != strings.TrimSpace(change.dest_attr) {
+		return false
+	}
+	return true
+}
+
+func (this *BaselineEntry) String() string {
+	s := fmt.Sprintf("%v %v", strings.ToUpper(this.Change), this.Table)
+	if this.Object != "" {
+		s += "." + this.Object
+	}
+	if this.Expires != "" {
+		s += fmt.Sprintf(" (expires %v)", this.Expires)
+	}
+	return s
+}
+
+//基线的处理结果
+type BaselineResult struct {
+	suppressed []*SchemaChange
+	stale      []*BaselineEntry
+	expired    []*BaselineEntry
+}
+
+//去掉和基线中未过期条目匹配的变更，同时找出已经过期和不再匹配任何变更的条目
+func (this *Baseline) Filter(table_changes_list []*TableChanges) ([]*TableChanges, *BaselineResult) {
+	result := &BaselineResult{}
+	now := time.Now()
+
+	var active []*BaselineEntry
+	for _, entry := range this.Entries {
+		if entry.IsExpired(now) {
+			result.expired = append(result.expired, entry)
+		} else {
+			active = append(active, entry)
+		}
+	}
+
+	var kept_list []*TableChanges
+	for _, table_changes := range table_changes_list {
+		kept := NewTableChanges(table_changes.table_name)
+		for _, change := range table_changes.changes {
+			var matched *BaselineEntry
+			for _, entry := range active {
+				if entry.Match(change) {
+					matched = entry
+					break
+				}
+			}
+			if matched != nil {
+				matched.matched++
+				result.suppressed = append(result.suppressed, change)
+			} else {
+				kept.changes = append(kept.changes, change)
+			}
+		}
+		if !kept.IsEmpty() {
+			kept_list = append(kept_list, kept)
+		}
+	}
+
+	//有过滤条件时变更不完整，条目匹配不到变更可能只是因为对象被过滤掉了，
+	//条目中的表名是模式，无法判断它和过滤条件是否有交集，所以不报告不再匹配的条目
+	if !g_objectFilter.IsEmpty() {
+		LOG_DEBUG("object filter (%v) is active, skip reporting stale baseline entries", g_objectFilter)
+		return kept_list, result
+	}
+
+	for _, entry := range active {
+		if entry.matched == 0 {
+			result.stale = append(result.stale, entry)
+		}
+	}
+
+	return kept_list, result
+}
+
+func (this *BaselineResult) IsEmpty() bool {
+	return len(this.suppressed) == 0 && len(this.stale) == 0 && len(this.expired) == 0
+}
+
+func WriteBaselineReport(data_dir string, baseline_file string, result *BaselineResult) (string, error) {
+	filename := filepath.Join(data_dir, BASELINE_REPORT_FILE)
+
+	f, err := os.Create(filename)
+	if err != nil {
+		LOG_ERROR("create %v file error: %v", filename, err)
+		return "", err
+	}
+	defer f.Close()
+
+	fmt.Fprintf(f, "基线文件: %v\n\n", baseline_file)
+
+	if len(result.suppressed) > 0 {
+		fmt.Fprintf(f, "以下变更和基线匹配，没有写入sql文件:\n")
+		for _, change := range result.suppressed {
+			fmt.Fprintf(f, "  %v\n", change)
+		}
+		fmt.Fprintf(f, "\n")
+	}
+
+	if len(result.stale) > 0 {
+		fmt.Fprintf(f, "以下基线条目不再匹配任何变更，可以从基线中删除:\n")
+		for _, entry := range result.stale {
+			fmt.Fprintf(f, "  %v: %v\n", entry, entry.Reason)
+		}
+		fmt.Fprintf(f, "\n")
+	}
+
+	if len(result.expired) > 0 {
+		fmt.Fprintf(f, "以下基线条目已经过期，匹配的变更重新写入sql文件:\n")
+		for _, entry := range result.expired {
+			fmt.Fprintf(f, "  %v: %v\n", entry, entry.Reason)
+		}
+		fmt.Fprintf(f, "\n")
+	}
+
+	return filename, nil
+}
+
+//按baseline.file过滤可以接受的差异，没有配置时原样返回
+func ApplyBaseline(data_dir string, table_changes_list []*TableChanges) ([]*TableChanges, error) {
+	baseline_file := GetConfigString("baseline.file", "")
+	if baseline_file == "" {
+		return table_changes_list, nil
+	}
+
+	baseline, err := LoadBaseline(baseline_file)
+	if err != nil {
+		return nil, err
+	}
+
+	table_changes_list, result := baseline.Filter(table_changes_list)
+	if result.IsEmpty() {
+		return table_changes_list, nil
+	}
+
+	report_file, err := WriteBaselineReport(data_dir, baseline_file, result)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.suppressed) > 0 {
+		LOG_INFO("%v个变更和基线%v匹配，已忽略", len(result.suppressed), baseline_file)
+	}
+	for _, entry := range result.expired {
+		LOG_WARN("baseline entry expired: %v", entry)
+	}
+	for _, entry := range result.stale {
+		LOG_WARN("baseline entry no longer matches any change: %v", entry)
+	}
+	if len(result.stale) > 0 || len(result.expired) > 0 {
+		LOG_WARN("%v个基线条目过期或不再匹配，详见%v", len(result.stale)+len(result.expired), report_file)
+		if GetConfigBool("baseline.fail_on_stale", false) {
+			return nil, fmt.Errorf("stale baseline entries")
+		}
+	}
+
+	return table_changes_list, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBaselineEntryIsExpired(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		expires string
+		expired bool
+	}{
+		{"", false},
+		{"2024-06-16", false},
+		{"2024-06-15", false},
+		{"2024-06-14", true},
+		{"2023-01-01", true},
+		{"not a date", false},
+	}
+
+	for _, c := range cases {
+		entry := &BaselineEntry{Expires: c.expires}
+		if got := entry.IsExpired(now); got != c.expired {
+			t.Errorf("IsExpired(%q) = %v, want %v", c.expires, got, c.expired)
+		}
+	}
+}
+
+func TestBaselineFilter(t *testing.T) {
+	defer func(filter *ObjectFilter) { g_objectFilter = filter }(g_objectFilter)
+
+	make_changes := func() []*TableChanges {
+		orders := NewTableChanges("orders")
+		orders.Add(CHANGE_DROP_INDEX, "`idx_report_day`", "", "KEY `idx_report_day` (`day`)")
+		orders.Add(CHANGE_ADD_FIELD, "`note`", "varchar(32)", "")
+		users := NewTableChanges("users")
+		users.Add(CHANGE_MODIFY_FIELD, "`name`", "varchar(64)", "varchar(32)")
+		return []*TableChanges{orders, users}
+	}
+
+	make_baseline := func() *Baseline {
+		return &Baseline{
+			Version: BASELINE_FORMAT_VERSION,
+			Entries: []*BaselineEntry{
+				{Change: "drop index", Table: "orders", Object: "idx_report_*", Reason: "report"},
+				{Change: "MODIFY COLUMN", Table: "users", Object: "name", Src: "varchar(64)", Reason: "longer in test"},
+				{Change: "DROP INDEX", Table: "archive_*", Reason: "removed table"},
+				{Change: "ADD COLUMN", Table: "orders", Object: "note", Reason: "expired", Expires: "2000-01-01"},
+			},
+		}
+	}
+
+	cases := []struct {
+		name       string
+		filter     *ObjectFilter
+		kept       int
+		suppressed int
+		stale      int
+		expired    int
+	}{
+		{"no filter", nil, 1, 2, 1, 1},
+		{"filter active", &ObjectFilter{Tables: []string{"orders", "users"}}, 1, 2, 0, 1},
+		{"empty filter", &ObjectFilter{}, 1, 2, 1, 1},
+	}
+
+	for _, c := range cases {
+		g_objectFilter = c.filter
+		kept_list, result := make_baseline().Filter(make_changes())
+
+		kept := 0
+		for _, table_changes := range kept_list {
+			kept += len(table_changes.changes)
+		}
+		if kept != c.kept || len(result.suppressed) != c.suppressed || len(result.stale) != c.stale || len(result.expired) != c.expired {
+			t.Errorf("%v: kept %v suppressed %v stale %v expired %v, want %v %v %v %v", c.name,
+				kept, len(result.suppressed), len(result.stale), len(result.expired),
+				c.kept, c.suppressed, c.stale, c.expired)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	RISK_SAFE int = iota
+	RISK_RISKY
+	RISK_DESTRUCTIVE
+)
+
+const (
+	POLICY_REPORT_FILE string = "POLICY_VIOLATIONS.txt"
+)
+
+var g_allowDestructive bool
+
+var g_riskNames = map[int]string{
+	RISK_SAFE:        "safe",
+	RISK_RISKY:       "risky",
+	RISK_DESTRUCTIVE: "destructive",
+}
+
+var g_changeTypeNames = map[int]string{
+	CHANGE_CREATE_TABLE: "CREATE TABLE",
+	CHANGE_DROP_TABLE:   "DROP TABLE",
+	CHANGE_ADD_FIELD:    "ADD COLUMN",
+	CHANGE_DROP_FIELD:   "DROP COLUMN",
+	CHANGE_MODIFY_FIELD: "MODIFY COLUMN",
+	CHANGE_ADD_INDEX:    "ADD INDEX",
+	CHANGE_DROP_INDEX:   "DROP INDEX",
+	CHANGE_MODIFY_INDEX: "MODIFY INDEX",
+}
+
+//变更的风险等级：
+//safe: 新建表、添加字段、添加普通索引
+//risky: 修改字段、修改索引、添加唯一索引、删除索引，可能失败或影响查询，但不会丢数据
+//destructive: 删除表、删除字段，会丢数据
+func (this *SchemaChange) Risk() int {
+	switch this.change_type {
+	case CHANGE_CREATE_TABLE, CHANGE_ADD_FIELD:
+		return RISK_SAFE
+	case CHANGE_ADD_INDEX:
+		key_kind, _ := SplitKeyAttr(this.src_attr)
+		if key_kind == "UNIQUE" {
+			return RISK_RISKY
+		}
+		return RISK_SAFE
+	case CHANGE_MODIFY_FIELD, CHANGE_MODIFY_INDEX, CHANGE_DROP_INDEX:
+		return RISK_RISKY
+	case CHANGE_DROP_TABLE, CHANGE_DROP_FIELD:
+		return RISK_DESTRUCTIVE
+	}
+	return RISK_RISKY
+}
+
+func (this *SchemaChange) IsDrop() bool {
+	switch this.change_type {
+	case CHANGE_DROP_TABLE, CHANGE_DROP_FIELD, CHANGE_DROP_INDEX:
+		return true
+	}
+	return false
+}
+
+func (this *SchemaChange) String() string {
+	if this.change_type == CHANGE_CREATE_TABLE || this.change_type == CHANGE_DROP_TABLE {
+		return fmt.Sprintf("%v %v", g_changeTypeNames[this.change_type], this.table_name)
+	}
+	return fmt.Sprintf("%v %v.%v", g_changeTypeNames[this.change_type], this.table_name, this.object_name)
+}
+
+//一组变更中最高的风险等级
+func MaxRisk(changes []*SchemaChange) int {
+	risk := RISK_SAFE
+	for _, change := range changes {
+		if change.Risk() > risk {
+			risk = change.Risk()
+		}
+	}
+	return risk
+}
+
+func RiskAnnotation(changes []*SchemaChange) []string {
+	var items []string
+	for _, change := range changes {
+		if change.Risk() != RISK_SAFE {
+			items = append(items, fmt.Sprintf("%v(%v)", g_changeTypeNames[change.change_type], g_riskNames[change.Risk()]))
+		}
+	}
+
+	line := fmt.Sprintf("-- risk: %v", g_riskNames[MaxRisk(changes)])
+	if len(items) > 0 {
+		line = fmt.Sprintf("%v, %v", line, strings.Join(items, ", "))
+	}
+	return []string{line}
+}
+
+//变更策略，违反策略的变更会终止sql文件的生成
+type ChangePolicy struct {
+	allow_drop                   bool
+	drop_tables                  []string
+	require_flag_for_destructive bool
+	allow_destructive            bool
+}
+
+var g_changePolicy *ChangePolicy
+
+//策略配置写错时不能退回默认值(policy.allow_drop写错会变成允许删除)，直接返回错误
+func NewChangePolicy(allow_destructive bool) (*ChangePolicy, error) {
+	allow_drop, err := ParseConfigBool("policy.allow_drop", true)
+	if err != nil {
+		return nil, err
+	}
+
+	require_flag_for_destructive, err := ParseConfigBool("policy.require_flag_for_destructive", false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ChangePolicy{
+		allow_drop:                   allow_drop,
+		drop_tables:                  GetConfigList("policy.drop_tables"),
+		require_flag_for_destructive: require_flag_for_destructive,
+		allow_destructive:            allow_destructive,
+	}, nil
+}
+
+type PolicyViolation struct {
+	change *SchemaChange
+	reason string
+}
+
+func (this *ChangePolicy) Check(table_changes_list []*TableChanges) []*PolicyViolation {
+	var violations []*PolicyViolation
+
+	for _, table_changes := range table_changes_list {
+		for _, change := range table_changes.changes {
+			reason := this.CheckChange(change)
+			if reason != "" {
+				violations = append(violations, &PolicyViolation{change, reason})
+			}
+		}
+	}
+
+	return violations
+}
+
+func (this *ChangePolicy) CheckChange(change *SchemaChange) string {
+	if change.IsDrop() {
+		if !this.allow_drop {
+			return "drops are forbidden by policy.allow_drop"
+		}
+		if len(this.drop_tables) > 0 && !MatchAnyPattern(this.drop_tables, change.table_name) {
+			return fmt.Sprintf("table %v does not match policy.drop_tables", change.table_name)
+		}
+	}
+
+	if change.Risk() == RISK_DESTRUCTIVE && this.require_flag_for_destructive && !this.allow_destructive {
+		return "destructive change requires the --allow-destructive flag"
+	}
+
+	return ""
+}
+
+//把违反策略的变更写到data_dir下的报告文件中，并返回报告路径
+func WritePolicyReport(data_dir string, violations []*PolicyViolation) (string, error) {
+	filename := filepath.Join(data_dir, POLICY_REPORT_FILE)
+
+	f, err := os.Create(filename)
+	if err != nil {
+		LOG_ERROR("create %v file error: %v", filename, err)
+		return "", err
+	}
+	defer f.Close()
+
+	fmt.Fprintf(f, "以下变更违反了变更策略，没有生成sql文件:\n\n")
+	for _, violation := range violations {
+		fmt.Fprintf(f, "[%v] %v: %v\n", g_riskNames[violation.change.Risk()], violation.change, violation.reason)
+	}
+
+	return filename, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSchemaChangeRisk(t *testing.T) {
+	cases := []struct {
+		change *SchemaChange
+		risk   int
+	}{
+		{&SchemaChange{change_type: CHANGE_CREATE_TABLE}, RISK_SAFE},
+		{&SchemaChange{change_type: CHANGE_ADD_FIELD}, RISK_SAFE},
+		{&SchemaChange{change_type: CHANGE_ADD_INDEX, src_attr: "(`a`)"}, RISK_SAFE},
+		{&SchemaChange{change_type: CHANGE_ADD_INDEX, src_attr: "UNIQUE (`a`)"}, RISK_RISKY},
+		{&SchemaChange{change_type: CHANGE_MODIFY_FIELD}, RISK_RISKY},
+		{&SchemaChange{change_type: CHANGE_MODIFY_INDEX}, RISK_RISKY},
+		{&SchemaChange{change_type: CHANGE_DROP_INDEX}, RISK_RISKY},
+		{&SchemaChange{change_type: CHANGE_DROP_FIELD}, RISK_DESTRUCTIVE},
+		{&SchemaChange{change_type: CHANGE_DROP_TABLE}, RISK_DESTRUCTIVE},
+	}
+
+	for _, c := range cases {
+		if got := c.change.Risk(); got != c.risk {
+			t.Errorf("Risk(%v %q) = %v, want %v", g_changeTypeNames[c.change.change_type], c.change.src_attr, g_riskNames[got], g_riskNames[c.risk])
+		}
+	}
+}
+
+func TestChangePolicyCheckChange(t *testing.T) {
+	drop_table := &SchemaChange{change_type: CHANGE_DROP_TABLE, table_name: "orders"}
+	drop_tmp_field := &SchemaChange{change_type: CHANGE_DROP_FIELD, table_name: "tmp_orders", object_name: "`a`"}
+	drop_index := &SchemaChange{change_type: CHANGE_DROP_INDEX, table_name: "orders", object_name: "`idx_a`"}
+	add_field := &SchemaChange{change_type: CHANGE_ADD_FIELD, table_name: "orders", object_name: "`b`"}
+
+	cases := []struct {
+		name     string
+		policy   *ChangePolicy
+		change   *SchemaChange
+		violated bool
+	}{
+		{"default allows drop", &ChangePolicy{allow_drop: true}, drop_table, false},
+		{"drop forbidden", &ChangePolicy{}, drop_index, true},
+		{"add allowed when drop forbidden", &ChangePolicy{}, add_field, false},
+		{"drop outside drop_tables", &ChangePolicy{allow_drop: true, drop_tables: []string{"tmp_*"}}, drop_table, true},
+		{"drop inside drop_tables", &ChangePolicy{allow_drop: true, drop_tables: []string{"tmp_*"}}, drop_tmp_field, false},
+		{"destructive without flag", &ChangePolicy{allow_drop: true, require_flag_for_destructive: true}, drop_table, true},
+		{"destructive with flag", &ChangePolicy{allow_drop: true, require_flag_for_destructive: true, allow_destructive: true}, drop_table, false},
+		{"risky does not need flag", &ChangePolicy{allow_drop: true, require_flag_for_destructive: true}, drop_index, false},
+	}
+
+	for _, c := range cases {
+		reason := c.policy.CheckChange(c.change)
+		if (reason != "") != c.violated {
+			t.Errorf("%v: CheckChange(%v) = %q, want violated %v", c.name, c.change, reason, c.violated)
+		}
+	}
+}
+
+func TestNewChangePolicy(t *testing.T) {
+	cases := []struct {
+		config     string
+		ok         bool
+		allow_drop bool
+	}{
+		{"", true, true},
+		{"policy.allow_drop = false\n", true, false},
+		{"policy.allow_drop = no\n", true, false},
+		{"policy.allow_drop = flase\n", false, false},
+		{"policy.require_flag_for_destructive = ture\n", false, false},
+	}
+
+	for _, c := range cases {
+		restore := SetTestConfig(t, c.config)
+		policy, err := NewChangePolicy(false)
+		restore()
+		if (err == nil) != c.ok {
+			t.Errorf("NewChangePolicy(%q) error = %v, want ok=%v", c.config, err, c.ok)
+			continue
+		}
+		if err == nil && policy.allow_drop != c.allow_drop {
+			t.Errorf("NewChangePolicy(%q).allow_drop = %v, want %v", c.config, policy.allow_drop, c.allow_drop)
+		}
+	}
+}
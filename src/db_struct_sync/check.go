@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+//check命令的退出码
+const (
+	CHECK_EXIT_NO_DRIFT    int = 0
+	CHECK_EXIT_DRIFT       int = 1
+	CHECK_EXIT_DESTRUCTIVE int = 2
+	CHECK_EXIT_ERROR       int = 3
+
+	CHECK_TMP_DIR string = "check_tmp"
+)
+
+//只对比源库和目标库的结构，不生成sql文件也不执行，用于CI检查结构漂移
+//返回退出码：0没有差异，1有差异，2有destructive差异，3出错
+func RunCheck(data_dir string) int {
+	table_changes_list, err := CheckDrift(data_dir)
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		return CHECK_EXIT_ERROR
+	}
+
+	if len(table_changes_list) == 0 {
+		fmt.Printf("no drift\n")
+		return CHECK_EXIT_NO_DRIFT
+	}
+
+	risks := make(map[int]int)
+	count := 0
+	for _, table_changes := range table_changes_list {
+		for _, change := range table_changes.changes {
+			risks[change.Risk()]++
+			count++
+		}
+	}
+
+	fmt.Printf("drift: %v changes in %v tables (safe %v, risky %v, destructive %v)\n", count, len(table_changes_list),
+		risks[RISK_SAFE], risks[RISK_RISKY], risks[RISK_DESTRUCTIVE])
+	for _, table_changes := range table_changes_list {
+		for _, change := range table_changes.changes {
+			fmt.Printf("  [%v] %v\n", g_riskNames[change.Risk()], change)
+		}
+	}
+
+	return DriftExitCode(table_changes_list)
+}
+
+//按差异中最高的风险等级返回退出码
+func DriftExitCode(table_changes_list []*TableChanges) int {
+	exit_code := CHECK_EXIT_NO_DRIFT
+	for _, table_changes := range table_changes_list {
+		if table_changes.IsEmpty() {
+			continue
+		}
+		if MaxRisk(table_changes.changes) == RISK_DESTRUCTIVE {
+			return CHECK_EXIT_DESTRUCTIVE
+		}
+		exit_code = CHECK_EXIT_DRIFT
+	}
+	return exit_code
+}
+
+//拉取两个库的表结构到data_dir/check_tmp下并对比，报告也写在这里，不影响sync和plan生成的文件
+func CheckDrift(data_dir string) ([]*TableChanges, error) {
+	var err error
+
+	g_srcMysqlAdaptor, err = OpenMysqlDBAdaptor("mysql_src", true)
+	if err != nil {
+		return nil, err
+	}
+	defer g_srcMysqlAdaptor.Release()
+
+	g_destMysqlAdaptor, err = OpenMysqlDBAdaptor("mysql_dest", true)
+	if err != nil {
+		return nil, err
+	}
+	defer g_destMysqlAdaptor.Release()
+
+	_, _, err = CheckDBIdentity(g_srcMysqlAdaptor, g_destMysqlAdaptor)
+	if err != nil {
+		LOG_ERROR("check database identity fail: %v", err)
+		return nil, err
+	}
+
+	check_dir := filepath.Join(data_dir, CHECK_TMP_DIR)
+	src_tmp_dir := filepath.Join(check_dir, "src")
+	dest_tmp_dir := filepath.Join(check_dir, "dest")
+
+	err = PullDBStructToDir(src_tmp_dir, g_srcMysqlAdaptor)
+	if err != nil {
+		return nil, err
+	}
+
+	err = PullDBStructToDir(dest_tmp_dir, g_destMysqlAdaptor)
+	if err != nil {
+		return nil, err
+	}
+
+	return DiffCheckSnapshots(check_dir, src_tmp_dir, dest_tmp_dir)
+}
+
+//检查的是全部漂移，不按phase.default筛选，否则expand阶段会隐藏destructive的差异
+//报告也写到check_dir下，不能覆盖plan/sync生成的报告
+func DiffCheckSnapshots(check_dir string, src_tmp_dir string, dest_tmp_dir string) ([]*TableChanges, error) {
+	_, _, table_changes_list, err := CompareSnapshots(check_dir, src_tmp_dir, dest_tmp_dir, PHASE_ALL)
+	if err != nil {
+		return nil, err
+	}
+
+	return table_changes_list, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDriftExitCode(t *testing.T) {
+	make_changes := func(table_name string, change_types ...int) *TableChanges {
+		table_changes := NewTableChanges(table_name)
+		for _, change_type := range change_types {
+			table_changes.Add(change_type, "`c`", "int(11)", "")
+		}
+		return table_changes
+	}
+
+	cases := []struct {
+		name      string
+		changes   []*TableChanges
+		exit_code int
+	}{
+		{"no drift", nil, CHECK_EXIT_NO_DRIFT},
+		{"empty table changes", []*TableChanges{make_changes("t")}, CHECK_EXIT_NO_DRIFT},
+		{"safe drift", []*TableChanges{make_changes("t", CHANGE_ADD_FIELD)}, CHECK_EXIT_DRIFT},
+		{"risky drift", []*TableChanges{make_changes("t", CHANGE_MODIFY_FIELD, CHANGE_DROP_INDEX)}, CHECK_EXIT_DRIFT},
+		{"destructive drift", []*TableChanges{make_changes("a", CHANGE_ADD_FIELD), make_changes("b", CHANGE_DROP_FIELD)}, CHECK_EXIT_DESTRUCTIVE},
+		{"dropped table", []*TableChanges{make_changes("t", CHANGE_DROP_TABLE)}, CHECK_EXIT_DESTRUCTIVE},
+	}
+
+	for _, c := range cases {
+		if got := DriftExitCode(c.changes); got != c.exit_code {
+			t.Errorf("%v: DriftExitCode = %v, want %v", c.name, got, c.exit_code)
+		}
+	}
+}
+
+func TestDiffCheckSnapshots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(phase string) { g_phase = phase }(g_phase)
+	defer func(filter *ObjectFilter) { g_objectFilter = filter }(g_objectFilter)
+	g_objectFilter = nil
+
+	src_dir := filepath.Join(dir, "src")
+	dest_dir := filepath.Join(dir, "dest")
+	WriteTestSchema(t, src_dir, map[string]string{
+		"users": "CREATE TABLE `users` (\n  `id` int(11) NOT NULL,\n  `email` varchar(64) DEFAULT NULL,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB;\n",
+	})
+	WriteTestSchema(t, dest_dir, map[string]string{
+		"users": "CREATE TABLE `users` (\n  `id` int(11) NOT NULL,\n  `legacy` int(11) DEFAULT NULL,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB;\n",
+	})
+
+	//无论phase.default是什么，删除字段都要报告为destructive漂移
+	for _, phase := range []string{PHASE_ALL, PHASE_EXPAND, PHASE_CONTRACT} {
+		g_phase = phase
+		table_changes_list, err := DiffCheckSnapshots(dir, src_dir, dest_dir)
+		if err != nil {
+			t.Fatalf("phase %v: DiffCheckSnapshots error: %v", phase, err)
+		}
+		if got := DriftExitCode(table_changes_list); got != CHECK_EXIT_DESTRUCTIVE {
+			t.Errorf("phase %v: DriftExitCode = %v, want %v", phase, got, CHECK_EXIT_DESTRUCTIVE)
+		}
+		if len(table_changes_list) != 1 || len(table_changes_list[0].changes) != 2 {
+			t.Errorf("phase %v: DiffCheckSnapshots = %v, want add and drop of users", phase, table_changes_list)
+		}
+	}
+}
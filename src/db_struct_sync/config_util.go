@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+func GetConfigString(key string, default_value string) string {
+	value, ok := g_config.Get(key)
+	if !ok {
+		return default_value
+	}
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return default_value
+	}
+	return value
+}
+
+func GetConfigBool(key string, default_value bool) bool {
+	value, err := ParseConfigBool(key, default_value)
+	if err != nil {
+		LOG_WARN("%v, use default value %v", err, default_value)
+		return default_value
+	}
+	return value
+}
+
+//和GetConfigBool相同，但非法值返回错误，用于写错时不能退回默认值的安全相关配置
+func ParseConfigBool(key string, default_value bool) (bool, error) {
+	value := GetConfigString(key, "")
+	if value == "" {
+		return default_value, nil
+	}
+
+	switch strings.ToLower(value) {
+	case "true", "yes", "on", "1":
+		return true, nil
+	case "false", "no", "off", "0":
+		return false, nil
+	}
+
+	return default_value, fmt.Errorf("config %v has invalid bool value[%v]", key, value)
+}
+
+func GetConfigInt(key string, default_value int64) int64 {
+	value := GetConfigString(key, "")
+	if value == "" {
+		return default_value
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		LOG_WARN("config %v has invalid int value[%v], use default value %v", key, value, default_value)
+		return default_value
+	}
+	return n
+}
+
+//读取以逗号分隔的配置项
+func GetConfigList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(GetConfigString(key, ""), ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+//--yes: 不提示直接执行，用于自动化
+var g_assumeYes bool
+
+//--approve-file: 文件内容为计划的校验和时才执行，用于CI等审批后执行的场景
+var g_approveFile string
+
+//执行计划的摘要
+type PlanSummary struct {
+	files       int
+	statements  int
+	risks       map[string]int
+	destructive []string
+}
+
+func SummarizePlan(plan *Plan) *PlanSummary {
+	summary := &PlanSummary{
+		files:      len(plan.Files),
+		statements: plan.StatementCount(),
+		risks:      make(map[string]int),
+	}
+
+	//风险等级来自sql文件中每条语句前的 -- risk: 注释
+	for _, plan_file := range plan.Files {
+		for _, line := range strings.Split(plan_file.Content, "\n") {
+			line = strings.TrimSpace(line)
+			if !strings.HasPrefix(line, "-- risk: ") {
+				continue
+			}
+			risk := strings.TrimPrefix(line, "-- risk: ")
+			if idx := strings.Index(risk, ","); idx != -1 {
+				risk = risk[:idx]
+			}
+			summary.risks[risk]++
+			if risk == g_riskNames[RISK_DESTRUCTIVE] {
+				summary.destructive = append(summary.destructive, plan_file.Name)
+			}
+		}
+	}
+
+	return summary
+}
+
+func (this *PlanSummary) Print(dest *DBIdentity, plan *Plan) {
+	fmt.Printf("\n")
+	fmt.Printf("destination: %v\n", dest.Fingerprint())
+	fmt.Printf("plan checksum: %v\n", plan.Checksum)
+	if plan.Filter != nil {
+		fmt.Printf("filter: %v\n", plan.Filter)
+	}
+	if plan.Phase == PHASE_EXPAND && len(plan.Contract) > 0 {
+		fmt.Printf("phase: expand, %v contract changes deferred\n", len(plan.Contract))
+	} else if plan.Phase != "" {
+		fmt.Printf("phase: %v\n", plan.Phase)
+	}
+	fmt.Printf("%v sql files, %v statements (safe %v, risky %v, destructive %v)\n", this.files, this.statements,
+		this.risks[g_riskNames[RISK_SAFE]], this.risks[g_riskNames[RISK_RISKY]], this.risks[g_riskNames[RISK_DESTRUCTIVE]])
+	for _, plan_file := range plan.Files {
+		fmt.Printf("  %v: %v statements\n", plan_file.Name, len(plan_file.Statements))
+	}
+	if len(this.destructive) > 0 {
+		fmt.Printf("destructive changes in: %v\n", strings.Join(this.destructive, ", "))
+	}
+	if len(plan.Commands) > 0 {
+		fmt.Printf("%v online schema change commands are not executed automatically\n", len(plan.Commands))
+	}
+	fmt.Printf("\n")
+}
+
+//确认是否执行计划：
+//1. --yes直接执行
+//2. --approve-file的内容必须是计划的校验和
+//3. 否则在终端上提示，有destructive变更或confirm.require_dbname时需要输入目标库名，否则输入yes
+func ConfirmApply(plan *Plan, dest *DBIdentity) (bool, error) {
+	summary := SummarizePlan(plan)
+
+	if summary.statements == 0 {
+		LOG_INFO("nothing to apply")
+		return true, nil
+	}
+
+	if g_assumeYes {
+		LOG_INFO("plan %v approved by --yes", plan.Checksum)
+		return true, nil
+	}
+
+	if g_approveFile != "" {
+		content, err := ioutil.ReadFile(g_approveFile)
+		if err != nil {
+			LOG_ERROR("read approve file %v error: %v", g_approveFile, err)
+			return false, err
+		}
+		fields := strings.Fields(string(content))
+		if len(fields) == 0 || fields[0] != plan.Checksum {
+			LOG_ERROR("approve file %v does not match plan checksum %v", g_approveFile, plan.Checksum)
+			return false, nil
+		}
+		LOG_INFO("plan %v approved by %v", plan.Checksum, g_approveFile)
+		return true, nil
+	}
+
+	if !IsTerminal(os.Stdin) {
+		return false, fmt.Errorf("stdin is not a terminal, use --yes or --approve-file to confirm")
+	}
+
+	summary.Print(dest, plan)
+
+	expected := "yes"
+	if len(summary.destructive) > 0 || GetConfigBool("confirm.require_dbname", false) {
+		expected = dest.dbname
+		fmt.Printf("请 *务必* 人工检查生成的sql文件，确认执行请输入目标库名(%v): ", dest.dbname)
+	} else {
+		fmt.Printf("请 *务必* 人工检查生成的sql文件，确认执行请输入yes: ")
+	}
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && strings.TrimSpace(answer) == "" {
+		return false, nil
+	}
+
+	return strings.TrimSpace(answer) == expected, nil
+}
+
+func IsTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
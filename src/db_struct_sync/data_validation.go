@@ -0,0 +1,474 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	VALIDATION_REPORT_FILE string = "VALIDATION_REPORT.txt"
+)
+
+//变更前用目标库的现有数据检查变更是否会失败或截断数据
+type ValidationIssue struct {
+	change      *SchemaChange
+	description string
+	count       int64
+	samples     []string
+}
+
+func (this *ValidationIssue) String() string {
+	return fmt.Sprintf("%v.%v: %v, %v rows", this.change.table_name, this.change.object_name, this.description, this.count)
+}
+
+//检查条件：where是违反新定义的数据
+type ValidationCheck struct {
+	description string
+	where       string
+	args        []interface{}
+}
+
+type DataValidator struct {
+	dbAdaptor   *MysqlDBAdaptor
+	sample_rows int64
+}
+
+func NewDataValidator(dbAdaptor *MysqlDBAdaptor) *DataValidator {
+	return &DataValidator{
+		dbAdaptor:   dbAdaptor,
+		sample_rows: GetConfigInt("validate.sample_rows", 5),
+	}
+}
+
+//检查所有有风险的变更，发现的问题同时记录到对应的变更上
+func (this *DataValidator) Validate(table_changes_list []*TableChanges) ([]*ValidationIssue, error) {
+	var issues []*ValidationIssue
+
+	for _, table_changes := range table_changes_list {
+		for _, change := range table_changes.changes {
+			change_issues, err := this.ValidateChange(change)
+			if err != nil {
+				return nil, err
+			}
+			change.issues = append(change.issues, change_issues...)
+			issues = append(issues, change_issues...)
+		}
+	}
+
+	return issues, nil
+}
+
+func (this *DataValidator) ValidateChange(change *SchemaChange) ([]*ValidationIssue, error) {
+	var issues []*ValidationIssue
+
+	switch change.change_type {
+	case CHANGE_MODIFY_FIELD:
+		for _, check := range FieldChecks(change.object_name, change.src_attr, change.dest_attr) {
+			issue, err := this.RunCheck(change, check)
+			if err != nil {
+				return nil, err
+			}
+			if issue != nil {
+				issues = append(issues, issue)
+			}
+		}
+	case CHANGE_ADD_INDEX, CHANGE_MODIFY_INDEX:
+		issue, err := this.CheckUniqueKey(change)
+		if err != nil {
+			return nil, err
+		}
+		if issue != nil {
+			issues = append(issues, issue)
+		}
+	}
+
+	return issues, nil
+}
+
+func (this *DataValidator) RunCheck(change *SchemaChange, check *ValidationCheck) (*ValidationIssue, error) {
+	table := QuoteName(change.table_name)
+
+	row, err := this.dbAdaptor.QueryRowFormat(fmt.Sprintf("SELECT COUNT(*) FROM %v WHERE %v", table, check.where), check.args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var count int64
+	err = row.Scan(&count)
+	if err != nil {
+		LOG_ERROR("validate %v.%v [%v] error: %v", change.table_name, change.object_name, check.description, err)
+		return nil, err
+	}
+	if count == 0 {
+		return nil, nil
+	}
+
+	issue := &ValidationIssue{
+		change:      change,
+		description: check.description,
+		count:       count,
+	}
+
+	//样本行：主键 + 违反新定义的字段
+	columns, err := GetPrimaryKeyColumns(this.dbAdaptor, change.table_name)
+	if err != nil {
+		return nil, err
+	}
+	var select_columns []string
+	for _, column := range columns {
+		select_columns = append(select_columns, QuoteName(column))
+	}
+	select_columns = append(select_columns, change.object_name)
+
+	sample_sql := fmt.Sprintf("SELECT %v FROM %v WHERE %v LIMIT %v", strings.Join(select_columns, ", "), table, check.where, this.sample_rows)
+	issue.samples, err = this.QuerySamples(sample_sql, check.args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return issue, nil
+}
+
+//新增唯一索引或把索引改成唯一索引时，检查现有数据中是否有重复值
+func (this *DataValidator) CheckUniqueKey(change *SchemaChange) (*ValidationIssue, error) {
+	key_kind, key_columns := SplitKeyAttr(change.src_attr)
+	if key_kind != "UNIQUE" {
+		return nil, nil
+	}
+
+	columns := ParseKeyColumns(key_columns)
+	if len(columns) == 0 {
+		return nil, nil
+	}
+
+	//含NULL的行不受唯一索引限制
+	var not_null []string
+	for _, column := range columns {
+		not_null = append(not_null, fmt.Sprintf("%v IS NOT NULL", column))
+	}
+	column_list := strings.Join(columns, ", ")
+	group_sql := fmt.Sprintf("SELECT %v, COUNT(*) AS dup_count FROM %v WHERE %v GROUP BY %v HAVING COUNT(*) > 1",
+		column_list, QuoteName(change.table_name), strings.Join(not_null, " AND "), column_list)
+
+	row, err := this.dbAdaptor.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM (%v) AS dup", group_sql))
+	if err != nil {
+		return nil, err
+	}
+
+	var count int64
+	err = row.Scan(&count)
+	if err != nil {
+		LOG_ERROR("validate unique key %v.%v error: %v", change.table_name, change.object_name, err)
+		return nil, err
+	}
+	if count == 0 {
+		return nil, nil
+	}
+
+	issue := &ValidationIssue{
+		change:      change,
+		description: fmt.Sprintf("duplicate values for new unique key %v", key_columns),
+		count:       count,
+	}
+
+	issue.samples, err = this.QuerySamples(fmt.Sprintf("%v LIMIT %v", group_sql, this.sample_rows))
+	if err != nil {
+		return nil, err
+	}
+
+	return issue, nil
+}
+
+func (this *DataValidator) QuerySamples(query string, args ...interface{}) ([]string, error) {
+	rows, err := this.dbAdaptor.QueryFormat(query, args...)
+	if err != nil {
+		LOG_ERROR("query samples [%v] error: %v", query, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []string
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+
+		err = rows.Scan(pointers...)
+		if err != nil {
+			return nil, err
+		}
+
+		var items []string
+		for i, value := range values {
+			if value.Valid {
+				//目标库中的数据会写进sql文件的注释，引号转义换行等字符，避免被当成语句执行
+				items = append(items, fmt.Sprintf("%v=%v", columns[i], strconv.Quote(value.String)))
+			} else {
+				items = append(items, fmt.Sprintf("%v=NULL", columns[i]))
+			}
+		}
+		samples = append(samples, strings.Join(items, ", "))
+	}
+
+	return samples, rows.Err()
+}
+
+var g_lengthTypeRegExp = regexp.MustCompile(`^(var)?(char|binary)\((\d+)\)$`)
+var g_intTypeRegExp = regexp.MustCompile(`^(tinyint|smallint|mediumint|int|integer|bigint)(\(\d+\))?( unsigned)?`)
+var g_decimalTypeRegExp = regexp.MustCompile(`^(decimal|numeric)\((\d+)(,(\d+))?\)( unsigned)?`)
+var g_enumTypeRegExp = regexp.MustCompile(`^enum\((.*)\)$`)
+
+//整数类型的取值范围
+var g_intRanges = map[string][2]string{
+	"tinyint":            {"-128", "127"},
+	"tinyint unsigned":   {"0", "255"},
+	"smallint":           {"-32768", "32767"},
+	"smallint unsigned":  {"0", "65535"},
+	"mediumint":          {"-8388608", "8388607"},
+	"mediumint unsigned": {"0", "16777215"},
+	"int":                {"-2147483648", "2147483647"},
+	"int unsigned":       {"0", "4294967295"},
+	"bigint":             {"-9223372036854775808", "9223372036854775807"},
+	"bigint unsigned":    {"0", "18446744073709551615"},
+}
+
+//修改字段定义时需要做的检查，src_attr是新定义，dest_attr是目标库中的现有定义
+func FieldChecks(field_name string, src_attr string, dest_attr string) []*ValidationCheck {
+	var checks []*ValidationCheck
+
+	new_type, new_rest := SplitFieldTypeWithSign(src_attr)
+	old_type, old_rest := SplitFieldTypeWithSign(dest_attr)
+
+	//NULL收紧为NOT NULL
+	if IsNotNull(new_rest) && !IsNotNull(old_rest) {
+		checks = append(checks, &ValidationCheck{
+			description: "NULL values for new NOT NULL column",
+			where:       fmt.Sprintf("%v IS NULL", field_name),
+		})
+	}
+
+	//类型只是放宽(如int改为bigint)，原有的值都能放下，不需要扫描全表
+	if IsTypeWidening(new_type, old_type) {
+		return checks
+	}
+
+	//字符串长度变短
+	if match := g_lengthTypeRegExp.FindStringSubmatch(new_type); match != nil {
+		length_func := "CHAR_LENGTH"
+		if match[2] == "binary" {
+			length_func = "LENGTH"
+		}
+		checks = append(checks, &ValidationCheck{
+			description: fmt.Sprintf("values longer than new type %v", new_type),
+			where:       fmt.Sprintf("%v(%v) > ?", length_func, field_name),
+			args:        []interface{}{match[3]},
+		})
+		return checks
+	}
+
+	//整数范围变小
+	if match := g_intTypeRegExp.FindStringSubmatch(new_type); match != nil {
+		int_type := NormalizeIntType(match[1]) + match[3]
+		int_range := g_intRanges[int_type]
+		checks = append(checks, &ValidationCheck{
+			description: fmt.Sprintf("values out of range of new type %v", new_type),
+			where:       fmt.Sprintf("(%v < %v OR %v > %v)", field_name, int_range[0], field_name, int_range[1]),
+		})
+		return checks
+	}
+
+	//定点数范围变小
+	if match := g_decimalTypeRegExp.FindStringSubmatch(new_type); match != nil {
+		precision, _ := strconv.Atoi(match[2])
+		scale, _ := strconv.Atoi(match[4])
+		max_value := DecimalMaxValue(precision, scale)
+		where := fmt.Sprintf("ABS(%v) > %v", field_name, max_value)
+		if match[5] != "" {
+			where = fmt.Sprintf("(%v < 0 OR %v > %v)", field_name, field_name, max_value)
+		}
+		checks = append(checks, &ValidationCheck{
+			description: fmt.Sprintf("values out of range of new type %v", new_type),
+			where:       where,
+		})
+		return checks
+	}
+
+	//ENUM删除了仍在使用的值
+	new_match := g_enumTypeRegExp.FindStringSubmatch(new_type)
+	old_match := g_enumTypeRegExp.FindStringSubmatch(old_type)
+	if new_match != nil && old_match != nil {
+		new_values := make(map[string]bool)
+		for _, value := range ParseEnumValues(new_match[1]) {
+			new_values[value] = true
+		}
+
+		var placeholders []string
+		var removed []interface{}
+		for _, value := range ParseEnumValues(old_match[1]) {
+			if !new_values[value] {
+				placeholders = append(placeholders, "?")
+				removed = append(removed, value)
+			}
+		}
+
+		if len(removed) > 0 {
+			checks = append(checks, &ValidationCheck{
+				description: fmt.Sprintf("rows using removed enum values %v", removed),
+				where:       fmt.Sprintf("BINARY %v IN (%v)", field_name, strings.Join(placeholders, ",")),
+				args:        removed,
+			})
+		}
+	}
+
+	return checks
+}
+
+//类型带上unsigned，如"int(10) unsigned NOT NULL" => "int(10) unsigned", "NOT NULL"
+func SplitFieldTypeWithSign(field_attr string) (string, string) {
+	field_type, rest := SplitFieldType(field_attr)
+	if strings.HasPrefix(strings.ToLower(rest), "unsigned") {
+		field_type += " unsigned"
+		rest = strings.TrimSpace(rest[len("unsigned"):])
+	}
+	return field_type, rest
+}
+
+func NormalizeIntType(int_type string) string {
+	if int_type == "integer" {
+		return "int"
+	}
+	return int_type
+}
+
+func AtoiOrZero(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+func IsNotNull(field_rest string) bool {
+	return strings.Contains(strings.ToUpper(field_rest), "NOT NULL")
+}
+
+//decimal(p,s)能表示的最大值，如decimal(5,2) => 999.99
+func DecimalMaxValue(precision, scale int) string {
+	max_value := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(precision)), nil)
+	max_value.Sub(max_value, big.NewInt(1))
+
+	digits := max_value.String()
+	switch {
+	case scale <= 0:
+		return digits
+	case scale >= len(digits):
+		return "0." + strings.Repeat("9", scale)
+	}
+	return digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+}
+
+//"'a','b','it''s'" => [a b it's]
+func ParseEnumValues(enum_list string) []string {
+	var values []string
+	var current []rune
+	in_quote := false
+
+	runes := []rune(enum_list)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case c == '\'' && in_quote && i+1 < len(runes) && runes[i+1] == '\'':
+			current = append(current, '\'')
+			i++
+		case c == '\'':
+			in_quote = !in_quote
+			if !in_quote {
+				values = append(values, string(current))
+				current = current[:0]
+			}
+		case in_quote:
+			current = append(current, c)
+		}
+	}
+
+	return values
+}
+
+//"(`a`,`b`(10))" => [`a` LEFT(`b`,10)]
+func ParseKeyColumns(key_columns string) []string {
+	start := strings.Index(key_columns, "(")
+	end := strings.LastIndex(key_columns, ")")
+	if start == -1 || end <= start {
+		return nil
+	}
+
+	var columns []string
+	for _, item := range strings.Split(key_columns[start+1:end], ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		//前缀索引
+		idx := strings.Index(item, "(")
+		if idx != -1 {
+			prefix_length := strings.TrimSuffix(item[idx+1:], ")")
+			item = fmt.Sprintf("LEFT(%v,%v)", item[:idx], prefix_length)
+		}
+		columns = append(columns, item)
+	}
+
+	return columns
+}
+
+//写在sql语句前面的注释
+func ValidationAnnotation(changes []*SchemaChange) []string {
+	var lines []string
+	for _, change := range changes {
+		for _, issue := range change.issues {
+			lines = append(lines, SqlCommentLine(fmt.Sprintf("VALIDATION FAILED: %v", issue)))
+			for _, sample := range issue.samples {
+				lines = append(lines, SqlCommentLine(fmt.Sprintf("  sample: %v", sample)))
+			}
+		}
+	}
+	return lines
+}
+
+//生成一行sql注释，内容中的换行替换成空格，保证整行都在注释中
+func SqlCommentLine(text string) string {
+	return "-- " + strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(text)
+}
+
+//把检查结果写到data_dir下的报告文件中，并返回报告路径
+func WriteValidationReport(data_dir string, issues []*ValidationIssue) (string, error) {
+	filename := filepath.Join(data_dir, VALIDATION_REPORT_FILE)
+
+	f, err := os.Create(filename)
+	if err != nil {
+		LOG_ERROR("create %v file error: %v", filename, err)
+		return "", err
+	}
+	defer f.Close()
+
+	fmt.Fprintf(f, "以下变更与目标库的现有数据不兼容，执行时可能失败或截断数据:\n\n")
+	for _, issue := range issues {
+		fmt.Fprintf(f, "%v\n", issue)
+		for _, sample := range issue.samples {
+			fmt.Fprintf(f, "  sample: %v\n", sample)
+		}
+		fmt.Fprintf(f, "\n")
+	}
+
+	return filename, nil
+}
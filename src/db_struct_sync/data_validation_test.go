@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidationAnnotationStaysInComments(t *testing.T) {
+	change := &SchemaChange{change_type: CHANGE_MODIFY_FIELD, table_name: "t", object_name: "`name`"}
+	change.issues = []*ValidationIssue{{
+		change:      change,
+		description: "values longer than new type varchar(10)",
+		count:       1,
+		samples:     []string{"id=\"1\", name=\"x\\n;DROP TABLE users;\"", "raw\r\nDROP TABLE users;"},
+	}}
+
+	lines := ValidationAnnotation([]*SchemaChange{change})
+	content := strings.Join(lines, "\n") + "\nALTER TABLE t MODIFY `name` varchar(10);\n"
+
+	statements, err := ParseSqlStatements(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statements) != 1 || !strings.HasPrefix(statements[0], "ALTER TABLE t") {
+		t.Fatalf("sample values leaked into statements: %q", statements)
+	}
+}
+
+func TestFieldChecks(t *testing.T) {
+	cases := []struct {
+		name         string
+		src_attr     string
+		dest_attr    string
+		descriptions []string
+	}{
+		{"same type", "int(11)", "int(11)", nil},
+		{"int widening", "bigint(20)", "int(11)", nil},
+		{"display width only", "int(10)", "int(11)", nil},
+		{"decimal widening", "decimal(12,2)", "decimal(10,2)", nil},
+		{"varchar widening", "varchar(64)", "varchar(32)", nil},
+		{"enum adds values", "enum('a','b','c')", "enum('a','b')", nil},
+		{"widening and not null", "bigint(20) NOT NULL", "int(11)", []string{"NULL values for new NOT NULL column"}},
+		{"varchar narrowing", "varchar(16)", "varchar(32)", []string{"values longer than new type varchar(16)"}},
+		{"int narrowing", "smallint(6)", "int(11)", []string{"values out of range of new type smallint(6)"}},
+		{"decimal narrowing", "decimal(8,2)", "decimal(10,2)", []string{"values out of range of new type decimal(8,2)"}},
+	}
+
+	for _, c := range cases {
+		var descriptions []string
+		for _, check := range FieldChecks("`f`", c.src_attr, c.dest_attr) {
+			descriptions = append(descriptions, check.description)
+		}
+		if strings.Join(descriptions, "|") != strings.Join(c.descriptions, "|") {
+			t.Errorf("%v: FieldChecks(%q, %q) = %q, want %q", c.name, c.src_attr, c.dest_attr, descriptions, c.descriptions)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+//数据库实例和库的身份信息，用来防止源库和目标库配反或配成同一个库
+type DBIdentity struct {
+	role        string
+	hostname    string
+	port        string
+	server_uuid string
+	dbname      string
+}
+
+func QueryDBIdentity(dbAdaptor *MysqlDBAdaptor, role string) (*DBIdentity, error) {
+	identity := &DBIdentity{
+		role: role,
+	}
+
+	row, err := dbAdaptor.QueryRow("SELECT @@hostname, @@port, IFNULL(DATABASE(), '')")
+	if err != nil {
+		return nil, err
+	}
+	err = row.Scan(&identity.hostname, &identity.port, &identity.dbname)
+	if err != nil {
+		LOG_ERROR("query identity of %v error: %v", role, err)
+		return nil, err
+	}
+
+	//MariaDB和5.6之前的MySQL没有server_uuid
+	row, err = dbAdaptor.QueryRow("SELECT @@server_uuid")
+	if err != nil {
+		return nil, err
+	}
+	var server_uuid sql.NullString
+	if row.Scan(&server_uuid) == nil && server_uuid.Valid {
+		identity.server_uuid = server_uuid.String
+	}
+
+	return identity, nil
+}
+
+//指纹格式为 hostname:port:dbname:server_uuid
+func (this *DBIdentity) Fingerprint() string {
+	return fmt.Sprintf("%v:%v:%v:%v", this.hostname, this.port, this.dbname, this.server_uuid)
+}
+
+func (this *DBIdentity) String() string {
+	return fmt.Sprintf("%v(%v)", this.role, this.Fingerprint())
+}
+
+func (this *DBIdentity) IsSameServer(other *DBIdentity) bool {
+	if this.server_uuid != "" && other.server_uuid != "" {
+		return this.server_uuid == other.server_uuid
+	}
+	return this.hostname == other.hostname && this.port == other.port
+}
+
+//配置的模式可以匹配完整的指纹，也可以只匹配hostname或server_uuid
+func (this *DBIdentity) Match(patterns []string) bool {
+	for _, pattern := range patterns {
+		if MatchPattern(pattern, this.Fingerprint()) || MatchPattern(pattern, this.hostname) ||
+			(this.server_uuid != "" && MatchPattern(pattern, this.server_uuid)) {
+			return true
+		}
+	}
+	return false
+}
+
+//检查源库和目标库的身份：
+//1. 不能是同一个实例上的同一个库
+//2. 同一个实例上的不同库需要identity.allow_same_server
+//3. 配置了identity.src_allow/identity.dest_allow时必须匹配
+//4. 匹配identity.never_src的库(如生产库)只能作为目标库
+func CheckDBIdentity(srcAdaptor *MysqlDBAdaptor, destAdaptor *MysqlDBAdaptor) (*DBIdentity, *DBIdentity, error) {
+	src, err := QueryDBIdentity(srcAdaptor, "mysql_src")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dest, err := QueryDBIdentity(destAdaptor, "mysql_dest")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	LOG_INFO("source: %v, destination: %v", src.Fingerprint(), dest.Fingerprint())
+
+	if src.IsSameServer(dest) {
+		if src.dbname == dest.dbname {
+			return nil, nil, fmt.Errorf("%v and %v are the same database", src, dest)
+		}
+		if !GetConfigBool("identity.allow_same_server", true) {
+			return nil, nil, fmt.Errorf("%v and %v are on the same server, set identity.allow_same_server to allow it", src, dest)
+		}
+		LOG_WARN("%v and %v are on the same server", src, dest)
+	}
+
+	src_allow := GetConfigList("identity.src_allow")
+	if len(src_allow) > 0 && !src.Match(src_allow) {
+		return nil, nil, fmt.Errorf("%v does not match identity.src_allow", src)
+	}
+
+	dest_allow := GetConfigList("identity.dest_allow")
+	if len(dest_allow) > 0 && !dest.Match(dest_allow) {
+		return nil, nil, fmt.Errorf("%v does not match identity.dest_allow", dest)
+	}
+
+	if src.Match(GetConfigList("identity.never_src")) {
+		return nil, nil, fmt.Errorf("%v matches identity.never_src and can only be a destination, are mysql_src and mysql_dest swapped?", src)
+	}
+
+	return src, dest, nil
+}
@@ -9,12 +9,9 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
-	"os/signal"
 	"path/filepath"
 	"regexp"
 	"strings"
-	"sync"
-	"syscall"
 )
 
 const (
@@ -26,10 +23,24 @@ var g_logger *log4jzl.Log4jzl
 var g_config jzlconfig.JZLConfig
 var g_srcMysqlAdaptor *MysqlDBAdaptor
 var g_destMysqlAdaptor *MysqlDBAdaptor
-var g_waitgroup *sync.WaitGroup
+
+//不在stdout上输出连接等信息
+var g_quiet bool
 
 func Usage() {
-	fmt.Fprintln(os.Stderr, "Usage of ", os.Args[0], " [--config path_to_config_file]")
+	fmt.Fprintln(os.Stderr, "Usage of ", os.Args[0], " [--config path_to_config_file] [sync|plan [plan_file]|review plan_file|approve plan_file|keygen|apply plan_file|cleanup|restore backup_dir|purge|status|snapshot dir [mysql_src|mysql_dest]|check]")
+	fmt.Fprintln(os.Stderr, "  sync     build the sql files and apply them after confirmation (default)")
+	fmt.Fprintln(os.Stderr, "  plan     build the sql files and save them as a portable plan file without applying")
+	fmt.Fprintln(os.Stderr, "  review   review a plan file table by table, enable or disable statements and save the plan")
+	fmt.Fprintln(os.Stderr, "  approve  record an approval of a plan file by the current system user")
+	fmt.Fprintln(os.Stderr, "  keygen   create the approval signing key of the current system user and print its public key")
+	fmt.Fprintln(os.Stderr, "  apply    apply a plan file built by the plan command to the destination")
+	fmt.Fprintln(os.Stderr, "  cleanup  drop the shadow tables and triggers left by aborted shadow migrations")
+	fmt.Fprintln(os.Stderr, "  restore  recreate the dropped tables and columns from a backup dir and reload their data")
+	fmt.Fprintln(os.Stderr, "  purge    permanently drop the soft-dropped tables older than drop.retention_days")
+	fmt.Fprintln(os.Stderr, "  status   show who holds the lock on the destination database and the pending contract changes")
+	fmt.Fprintln(os.Stderr, "  snapshot save the schema of mysql_src (default) or mysql_dest to an empty dir as the base of a three-way merge")
+	fmt.Fprintln(os.Stderr, "  check    diff without writing sql files, exit code 0: no drift, 1: drift, 2: destructive drift, 3: error")
 	flag.PrintDefaults()
 	fmt.Fprintln(os.Stderr)
 	os.Exit(0)
@@ -42,120 +53,322 @@ func main() {
 	var configFile string
 	flag.Usage = Usage
 	flag.StringVar(&configFile, "config", "db_struct_sync.conf", "specified config filename")
+	flag.BoolVar(&g_allowMassDrop, "allow-mass-drop", false, "allow dropping more destination tables than the guard thresholds, or syncing from an empty source")
+	flag.BoolVar(&g_allowDestructive, "allow-destructive", false, "allow destructive changes (DROP TABLE/DROP COLUMN) when policy.require_flag_for_destructive is set")
+	flag.BoolVar(&g_assumeYes, "yes", false, "apply without the interactive confirmation")
+	flag.StringVar(&g_approveFile, "approve-file", "", "apply only if this file contains the checksum of the plan")
+	flag.BoolVar(&g_review, "review", false, "review the generated sql files interactively before confirmation (sync and plan), one statement per change")
+	flag.StringVar(&g_filterTables, "tables", "", "only sync the tables matching these comma separated patterns, overrides filter.tables")
+	flag.StringVar(&g_filterExcludeTables, "exclude-tables", "", "skip the tables matching these comma separated patterns, overrides filter.exclude_tables")
+	flag.StringVar(&g_filterObjectTypes, "object-types", "", "only sync these object types: table,column,index, overrides filter.object_types")
+	flag.StringVar(&g_filterChangeTypes, "change-types", "", "only sync these change types: add,drop,modify, overrides filter.change_types")
+	flag.StringVar(&g_phase, "phase", "", "only build and apply one phase: expand, contract or all, overrides phase.default")
+	flag.StringVar(&g_mergeBase, "base", "", "base snapshot dir of a three-way merge, overrides merge.base_dir")
 	flag.Parse()
 
-	fmt.Println("config file: ", configFile)
+	//check命令的stdout只输出摘要，出错时退出码为3
+	command := flag.Arg(0)
+	exit_code := 1
+	if command == "check" {
+		g_quiet = true
+		exit_code = CHECK_EXIT_ERROR
+	}
+
+	if !g_quiet {
+		fmt.Println("config file: ", configFile)
+	}
 
 	//read config file
 	err = g_config.Read(configFile)
 	if err != nil {
-		fmt.Println("Read config file fail: %v", err)
-		return
+		fmt.Printf("Read config file fail: %v\n", err)
+		os.Exit(exit_code)
 	}
 
 	//init logger
 	g_logger, err = log4jzl.New("db_struct_sync")
 	if err != nil {
-		fmt.Println("Open log file fail: %v", err)
-		return
+		fmt.Printf("Open log file fail: %v\n", err)
+		os.Exit(exit_code)
 	}
 
 	//init log level object
 	g_logLevel, err = NewLogLevel()
 	if err != nil {
 		LOG_ERROR("创建NewLogLevel对象失败，失败原因: %v", err)
-		return
+		os.Exit(exit_code)
 	}
 
-	//init source mysql db adaptor
-	var host, port, user, pass, dbname, charset string
-	host, _ = g_config.Get("mysql_src.host")
-	port, _ = g_config.Get("mysql_src.port")
-	user, _ = g_config.Get("mysql_src.username")
-	pass, _ = g_config.Get("mysql_src.password")
-	dbname, _ = g_config.Get("mysql_src.dbname")
-	charset, _ = g_config.Get("mysql_src.charset")
-
-	fmt.Printf("Source Mysql: %v:%v\n", host, dbname)
+	//配置中的表名和字段名模式必须全部合法
+	err = ValidateConfigPatterns()
+	if err != nil {
+		LOG_ERROR("%v", err)
+		os.Exit(exit_code)
+	}
 
-	g_srcMysqlAdaptor, err = NewMysqlDBAdaptor(host, port, user, pass, dbname, charset)
+	//init online ddl policy
+	g_onlineDDLPolicy, err = NewOnlineDDLPolicy()
 	if err != nil {
-		LOG_ERROR("create MysqlDBAdaptor object fail.", err)
-		return
+		LOG_ERROR("创建OnlineDDLPolicy对象失败，失败原因: %v", err)
+		os.Exit(exit_code)
 	}
-	defer g_srcMysqlAdaptor.Release()
 
-	//init destination mysql db adaptor
-	host, _ = g_config.Get("mysql_dest.host")
-	port, _ = g_config.Get("mysql_dest.port")
-	user, _ = g_config.Get("mysql_dest.username")
-	pass, _ = g_config.Get("mysql_dest.password")
-	dbname, _ = g_config.Get("mysql_dest.dbname")
-	charset, _ = g_config.Get("mysql_dest.charset")
+	//init object filter
+	g_objectFilter, err = NewObjectFilter()
+	if err != nil {
+		LOG_ERROR("创建ObjectFilter对象失败，失败原因: %v", err)
+		os.Exit(exit_code)
+	}
 
-	fmt.Printf("Destination Mysql: %v:%v\n", host, dbname)
+	//init change policy
+	g_changePolicy, err = NewChangePolicy(g_allowDestructive)
+	if err != nil {
+		LOG_ERROR("创建ChangePolicy对象失败，失败原因: %v", err)
+		os.Exit(exit_code)
+	}
 
-	g_destMysqlAdaptor, err = NewMysqlDBAdaptor(host, port, user, pass, dbname, charset)
+	//init phase
+	g_phase, err = GetPhase()
 	if err != nil {
-		LOG_ERROR("create MysqlDBAdaptor object fail.", err)
-		return
+		LOG_ERROR("%v", err)
+		os.Exit(exit_code)
 	}
-	defer g_destMysqlAdaptor.Release()
 
 	//get data dir contains sql files
 	data_dir, _ := g_config.Get("data.dir")
 	if data_dir == "" {
 		LOG_ERROR("data dir not set")
-		return
+		os.Exit(exit_code)
+	}
+
+	switch command {
+	case "", "sync":
+		err = RunSync(data_dir)
+	case "cleanup":
+		err = RunCleanup(data_dir)
+	case "plan":
+		err = RunPlan(data_dir, flag.Arg(1))
+	case "apply":
+		err = RunApply(data_dir, flag.Arg(1))
+	case "review":
+		err = RunReview(flag.Arg(1))
+	case "approve":
+		err = RunApprove(flag.Arg(1))
+	case "keygen":
+		err = RunKeygen()
+	case "restore":
+		err = RunRestore(flag.Arg(1))
+	case "purge":
+		err = RunPurge()
+	case "status":
+		err = RunStatus()
+	case "snapshot":
+		err = RunSnapshot(flag.Arg(1), flag.Arg(2))
+	case "check":
+		os.Exit(RunCheck(data_dir))
+	default:
+		fmt.Fprintln(os.Stderr, "unknown command: ", command)
+		Usage()
+	}
+	if err != nil {
+		os.Exit(exit_code)
+	}
+
+	LOG_INFO("success! ^_^")
+}
+
+//根据配置文件中的section(mysql_src或mysql_dest)创建数据库连接，源库使用只读连接
+func OpenMysqlDBAdaptor(section string, read_only bool) (*MysqlDBAdaptor, error) {
+	var host, port, user, pass, dbname, charset string
+	host, _ = g_config.Get(section + ".host")
+	port, _ = g_config.Get(section + ".port")
+	user, _ = g_config.Get(section + ".username")
+	pass, _ = g_config.Get(section + ".password")
+	dbname, _ = g_config.Get(section + ".dbname")
+	charset, _ = g_config.Get(section + ".charset")
+
+	if !g_quiet {
+		fmt.Printf("%v: %v:%v\n", section, host, dbname)
+	}
+
+	var dbAdaptor *MysqlDBAdaptor
+	var err error
+	if read_only {
+		dbAdaptor, err = NewReadOnlyMysqlDBAdaptor(host, port, user, pass, dbname, charset)
+	} else {
+		dbAdaptor, err = NewMysqlDBAdaptor(host, port, user, pass, dbname, charset)
+	}
+	if err != nil {
+		LOG_ERROR("create MysqlDBAdaptor object for %v fail: %v", section, err)
+		return nil, err
+	}
+
+	return dbAdaptor, nil
+}
+
+//生成sql文件，人工确认后在目标库上执行
+func RunSync(data_dir string) error {
+	var err error
+
+	//init source mysql db adaptor
+	g_srcMysqlAdaptor, err = OpenMysqlDBAdaptor("mysql_src", true)
+	if err != nil {
+		return err
+	}
+	defer g_srcMysqlAdaptor.Release()
+
+	//init destination mysql db adaptor
+	g_destMysqlAdaptor, err = OpenMysqlDBAdaptor("mysql_dest", false)
+	if err != nil {
+		return err
+	}
+	defer g_destMysqlAdaptor.Release()
+
+	//make sure source and destination are not swapped or the same database
+	src, dest, err := CheckDBIdentity(g_srcMysqlAdaptor, g_destMysqlAdaptor)
+	if err != nil {
+		LOG_ERROR("check database identity fail: %v", err)
+		return err
+	}
+
+	//整个生成和执行过程都持有目标库上的锁
+	run_lock, err := AcquireRunLock(g_destMysqlAdaptor, "sync")
+	if err != nil {
+		LOG_ERROR("lock destination fail: %v", err)
+		return err
+	}
+	defer run_lock.Release()
+
+	//需要多人审批时只能用plan/approve/apply
+	if GetConfigInt("approval.required", 0) > 0 {
+		LOG_ERROR("approval.required is set, use the plan, approve and apply commands instead of sync")
+		return fmt.Errorf("approval required")
 	}
 
 	//First Step: building the sql files automatically
 	err = BuildSqlFiles(data_dir)
 	if err != nil {
-		return
+		return err
+	}
+
+	var plan *Plan
+	for {
+		if g_review {
+			accepted, err := ReviewSqlFiles(data_dir)
+			if err != nil {
+				return err
+			}
+			if !accepted {
+				LOG_INFO("program terminated!")
+				return fmt.Errorf("not approved")
+			}
+		}
+
+		var approved bool
+		plan, approved, err = ConfirmSqlFiles(data_dir, src, dest)
+		if err != nil {
+			return err
+		}
+		if !approved {
+			LOG_INFO("program terminated!")
+			return fmt.Errorf("not approved")
+		}
+
+		//确认之前可能过了很久，目标库的表结构可能已经被修改
+		if !GetConfigBool("fingerprint.enable", true) {
+			break
+		}
+		matched, err := CheckPlanFingerprint(data_dir)
+		if err != nil {
+			return err
+		}
+		if matched {
+			break
+		}
+		if GetConfigString("fingerprint.on_mismatch", FINGERPRINT_ON_MISMATCH_ABORT) != FINGERPRINT_ON_MISMATCH_REGENERATE {
+			LOG_ERROR("目标库的表结构在生成sql文件之后被修改，已终止，请重新执行")
+			return fmt.Errorf("destination schema changed after the plan was built")
+		}
+
+		//重新生成sql文件，需要再次人工确认
+		LOG_WARN("目标库的表结构在生成sql文件之后被修改，重新生成sql文件")
+		err = BuildSqlFiles(data_dir)
+		if err != nil {
+			return err
+		}
 	}
 
+	//确认之后sql文件不能再被修改
+	err = ApplySqlFiles(data_dir, plan.StatementsHash())
+	if err != nil {
+		return err
+	}
+
+	return RecordPhase(g_destMysqlAdaptor, plan)
+}
+
+//备份、预检，然后执行data_dir下的sql文件
+//statements_hash为确认或审批时语句的哈希，执行前sql文件中的语句和它不一致时终止
+func ApplySqlFiles(data_dir string, statements_hash string) error {
+	var err error
+
+	//执行删除表或删除字段的语句前先备份受影响的数据
+	if GetConfigBool("backup.enable", true) {
+		g_backupManager, err = NewBackupManager(data_dir, g_destMysqlAdaptor)
+		if err != nil {
+			LOG_ERROR("创建BackupManager对象失败，失败原因: %v", err)
+			return err
+		}
+	}
+
+	//检查权限、只读状态、元数据锁和磁盘空间，任何一项不通过都不执行
+	if GetConfigBool("preflight.enable", true) {
+		err = RunPreflight(data_dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	plan_files, err := LoadPlanFiles(data_dir, ".sql")
+	if err != nil {
+		return err
+	}
+	if StatementsHash(plan_files) != statements_hash {
+		LOG_ERROR("%v目录下的sql文件在确认之后被修改，已终止", data_dir)
+		return fmt.Errorf("sql files changed after approval")
+	}
+
+	//Second Step: travel to handle the sql file
+	return TravelSqlFiles(data_dir)
+}
+
+//提示人工检查生成的sql文件，等待确认
+func ConfirmSqlFiles(data_dir string, src *DBIdentity, dest *DBIdentity) (*Plan, bool, error) {
 	LOG_INFO("=====================================================================")
 	LOG_INFO("第一阶段完成!!!")
 	LOG_INFO("请 *务必* 人工检查%v目录下生成的sql文件!!!", data_dir)
 	LOG_INFO("在未确认的情况的继续执行，可能会对数据库造成灾难性的后果!!!")
-	LOG_INFO("取消并终止程序请按Ctrl+C，继续请按Ctrl+\\")
 	LOG_INFO("=====================================================================")
 
-	//wait here to confirm manually
-	g_waitgroup = &sync.WaitGroup{}
-	g_waitgroup.Add(1)
-	go func() {
-		c := make(chan os.Signal)
-		//拦截指定的系统信号
-		signal.Notify(c, syscall.SIGINT, syscall.SIGQUIT)
-		for {
-			select {
-			case s := <-c:
-				switch s {
-				case syscall.SIGINT:
-					LOG_INFO("program terminated!")
-					os.Exit(1)
-				case syscall.SIGQUIT:
-					g_waitgroup.Done()
-				}
-			}
-		}
-	}()
-	g_waitgroup.Wait()
-
-	//Second Step: travel to handle the sql file
-	err = TravelSqlFiles(data_dir)
+	plan, err := LoadPlanFromDir(data_dir)
 	if err != nil {
-		return
+		return nil, false, err
 	}
+	plan.Source.Identity = src.Fingerprint()
+	plan.Destination.Identity = dest.Fingerprint()
+	plan.Checksum = plan.ComputeChecksum()
 
-	LOG_INFO("success! ^_^")
+	approved, err := ConfirmApply(plan, dest)
+	return plan, approved, err
 }
 
 func BuildSqlFiles(data_dir string) error {
 	var err error
 
+	if !g_objectFilter.IsEmpty() {
+		LOG_INFO("object filter: %v", g_objectFilter)
+	}
+
 	//get src db struct
 	err = PullDBStruct(data_dir, true, g_srcMysqlAdaptor)
 	if err != nil {
@@ -168,6 +381,12 @@ func BuildSqlFiles(data_dir string) error {
 		return err
 	}
 
+	//记录目标库表结构的指纹，执行前用来确认目标库没有被修改
+	err = SavePlanFingerprint(data_dir)
+	if err != nil {
+		return err
+	}
+
 	//compare the src and dest mysql struct to build sql files
 	err = DiffDBStruct(data_dir)
 	if err != nil {
@@ -179,38 +398,134 @@ func BuildSqlFiles(data_dir string) error {
 
 //根据src和dest数据库的结构差异生成增量sql文件
 func DiffDBStruct(data_dir string) error {
-	var err error
-
 	src_tmp_dir := filepath.Join(data_dir, "src_mysql_tmp")
 	dest_tmp_dir := filepath.Join(data_dir, "dest_mysql_tmp")
 
-	src_db_struct, err := EnumFilesInDir(src_tmp_dir, ".sql")
+	src_db_struct, dest_db_struct, table_changes_list, err := CompareSnapshots(data_dir, src_tmp_dir, dest_tmp_dir, g_phase)
 	if err != nil {
 		return err
 	}
 
-	dest_db_struct, err := EnumFilesInDir(dest_tmp_dir, ".sql")
+	//涉及受保护的表和字段的变更不写入sql文件，交给人工处理
+	table_changes_list, excluded := NewProtectedObjects().Filter(table_changes_list)
+	if len(excluded) > 0 {
+		report_file, err := WriteManualHandlingReport(data_dir, src_tmp_dir, excluded)
+		if err != nil {
+			return err
+		}
+		LOG_WARN("%v个变更涉及受保护的表或字段，需要人工处理，详见%v", len(excluded), report_file)
+	}
+
+	//源库为空或表数量异常少时终止
+	err = NewSourceGuard(g_allowMassDrop).Check(len(src_db_struct), len(dest_db_struct), table_changes_list)
 	if err != nil {
+		LOG_ERROR("source guard: %v", err)
 		return err
 	}
 
+	//检查变更策略，有违反策略的变更时不生成sql文件
+	violations := g_changePolicy.Check(table_changes_list)
+	if len(violations) > 0 {
+		report_file, err := WritePolicyReport(data_dir, violations)
+		if err != nil {
+			return err
+		}
+		for _, violation := range violations {
+			LOG_ERROR("policy violation: %v: %v", violation.change, violation.reason)
+		}
+		LOG_ERROR("%v个变更违反了变更策略，详见%v", len(violations), report_file)
+		return fmt.Errorf("policy violation")
+	}
+
+	//用目标库的现有数据检查有风险的变更
+	if GetConfigBool("validate.enable", true) {
+		issues, err := NewDataValidator(g_destMysqlAdaptor).Validate(table_changes_list)
+		if err != nil {
+			return err
+		}
+		if len(issues) > 0 {
+			report_file, err := WriteValidationReport(data_dir, issues)
+			if err != nil {
+				return err
+			}
+			LOG_WARN("%v个变更与目标库的现有数据不兼容，详见%v", len(issues), report_file)
+			if GetConfigBool("validate.abort_on_failure", false) {
+				return fmt.Errorf("data validation failed")
+			}
+		}
+	}
+
+	dest_table_stats, err := QueryTableStats(g_destMysqlAdaptor)
+	if err != nil {
+		return err
+	}
+
+	dest_version, err := QueryServerVersion(g_destMysqlAdaptor)
+	if err != nil {
+		return err
+	}
+
+	estimator := NewPlanEstimator(dest_version, dest_table_stats)
+
+	return MakeSqlFiles(data_dir, src_tmp_dir, table_changes_list, estimator)
+}
+
+//对比两个表结构快照目录，返回经过三路合并、基线、过滤条件和阶段(phase)筛选之后的变更
+//合并冲突、基线和contract变更的报告写入report_dir
+func CompareSnapshots(report_dir string, src_tmp_dir string, dest_tmp_dir string, phase string) (map[string]map[string]map[string]string, map[string]map[string]map[string]string, []*TableChanges, error) {
+	src_db_struct, err := EnumFilesInDir(src_tmp_dir, ".sql")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	dest_db_struct, err := EnumFilesInDir(dest_tmp_dir, ".sql")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	table_changes_list := CompareDBStruct(src_db_struct, dest_db_struct)
+
+	//有基准快照时只同步源库相对于基准的修改，保留目标库自己的修改
+	table_changes_list, err = ApplyMergeBase(report_dir, src_db_struct, dest_db_struct, table_changes_list)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	//去掉基线中记录的可以接受的差异
+	table_changes_list, err = ApplyBaseline(report_dir, table_changes_list)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	//只保留过滤条件选中的变更
+	table_changes_list, skipped := g_objectFilter.Filter(table_changes_list)
+	if skipped > 0 {
+		LOG_INFO("%v个变更被过滤条件(%v)忽略", skipped, g_objectFilter)
+	}
+
+	//零停机发布时只保留当前阶段的变更
+	table_changes_list, err = SelectPhase(report_dir, phase, table_changes_list)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return src_db_struct, dest_db_struct, table_changes_list, nil
+}
+
+//对比src和dest数据库的结构，按表返回全部结构变更
+func CompareDBStruct(src_db_struct, dest_db_struct map[string]map[string]map[string]string) []*TableChanges {
+	var table_changes_list []*TableChanges
+
 	//场景1
 	//条件：src_sqlfile_list中有的文件在dest_sqlfile_list中没有
 	//推论：说明增加了新表
 	//操作：直接把该sql文件放到data_dir目录下
 	for src_table_name, src_table_struct := range src_db_struct {
+		table_changes := NewTableChanges(src_table_name)
+
 		dest_table_struct, table_found := dest_db_struct[src_table_name]
 		if !table_found {
-			//move the create table sql file in src_tmp_dir to data_dir
-			src_file := filepath.Join(src_tmp_dir, src_table_name)
-			src_file = fmt.Sprintf("%v.sql", src_file)
-			dest_file := filepath.Join(data_dir, src_table_name)
-			dest_file = fmt.Sprintf("%v.sql", dest_file)
-
-			_, err = CopyFile(src_file, dest_file)
-			if err != nil {
-				return err
-			}
+			table_changes.Add(CHANGE_CREATE_TABLE, src_table_name, "", "")
 		} else {
 			src_fields_struct := src_table_struct["fields"]
 			src_keys_struct := src_table_struct["keys"]
@@ -220,24 +535,18 @@ func DiffDBStruct(data_dir string) error {
 			//场景3
 			//条件：文件在src_sqlfile_list和dest_sqlfile_list中都有，对比字段：某一字段在src_sqlfile中有但是在dest_sqlfile中没有
 			//推论：说明该表增加了该字段
-			//操作：在对应的sql文件中追加一条sql语句：添加字段
+			//操作：添加字段
 			for src_field_name, src_field_attr := range src_fields_struct {
 				dest_field_attr, field_found := dest_fields_struct[src_field_name]
 				if !field_found {
-					err = MakeAddFieldSql(data_dir, src_table_name, src_field_name, src_field_attr)
-					if err != nil {
-						return err
-					}
+					table_changes.Add(CHANGE_ADD_FIELD, src_field_name, src_field_attr, "")
 				} else {
 					//场景5
 					//条件：文件在src_sqlfile_list和dest_sqlfile_list中都有，对比字段：某一字段在src_sqlfile和dest_sqlfile中都存在，但字段类型不同
 					//推论：说明该字段被修改了
-					//操作：在对应的sql文件中追加一条sql语句：修改字段类型
+					//操作：修改字段类型
 					if src_field_attr != dest_field_attr {
-						err = MakeModifyFieldSql(data_dir, src_table_name, src_field_name, src_field_attr)
-						if err != nil {
-							return err
-						}
+						table_changes.Add(CHANGE_MODIFY_FIELD, src_field_name, src_field_attr, dest_field_attr)
 					}
 				}
 			}
@@ -245,38 +554,29 @@ func DiffDBStruct(data_dir string) error {
 			//场景4
 			//条件：文件在src_sqlfile_list和dest_sqlfile_list中都有，对比字段：某一字段在dest_sqlfile中有但是在src_sqlfile中没有
 			//推论：说明该表删除了该字段
-			//操作：在对应的sql文件中追加一条sql语句：删除字段
-			for dest_field_name, _ := range dest_fields_struct {
+			//操作：删除字段
+			for dest_field_name, dest_field_attr := range dest_fields_struct {
 				_, field_found := src_fields_struct[dest_field_name]
 				if !field_found {
-					err = MakeRemoveFieldSql(data_dir, src_table_name, dest_field_name)
-					if err != nil {
-						return err
-					}
+					table_changes.Add(CHANGE_DROP_FIELD, dest_field_name, "", dest_field_attr)
 				}
 			}
 
 			//场景5
 			//条件：文件在src_sqlfile_list和dest_sqlfile_list中都有，对比索引：某一索引在src_sqlfile中有但是在dest_sqlfile中没有
 			//推论：说明该表增加了该索引
-			//操作：在对应的sql文件中追加一条sql语句：添加索引
+			//操作：添加索引
 			for src_key_name, src_key_attr := range src_keys_struct {
 				dest_key_attr, key_found := dest_keys_struct[src_key_name]
 				if !key_found {
-					err = MakeAddIndexSql(data_dir, src_table_name, src_key_name, src_key_attr)
-					if err != nil {
-						return err
-					}
+					table_changes.Add(CHANGE_ADD_INDEX, src_key_name, src_key_attr, "")
 				} else {
 					//场景7
 					//条件：文件在src_sqlfile_list和dest_sqlfile_list中都有，对比索引：某一索引在src_sqlfile和dest_sqlfile中都存在，但索引类型不同
 					//推论：说明该索引被修改了
-					//操作：在对应的sql文件中追加一条sql语句：修改索引
+					//操作：修改索引
 					if src_key_attr != dest_key_attr {
-						err = MakeModifyIndexSql(data_dir, src_table_name, src_key_name, src_key_attr)
-						if err != nil {
-							return err
-						}
+						table_changes.Add(CHANGE_MODIFY_INDEX, src_key_name, src_key_attr, dest_key_attr)
 					}
 				}
 			}
@@ -284,17 +584,18 @@ func DiffDBStruct(data_dir string) error {
 			//场景6
 			//条件：文件在src_sqlfile_list和dest_sqlfile_list中都有，对比索引：某一索引在dest_sqlfile中有但是在src_sqlfile中没有
 			//推论：说明该表删除了该索引
-			//操作：在对应的sql文件中追加一条sql语句：删除索引
-			for dest_key_name, _ := range dest_keys_struct {
+			//操作：删除索引
+			for dest_key_name, dest_key_attr := range dest_keys_struct {
 				_, key_found := src_keys_struct[dest_key_name]
 				if !key_found {
-					err = MakeRemoveIndexSql(data_dir, src_table_name, dest_key_name)
-					if err != nil {
-						return err
-					}
+					table_changes.Add(CHANGE_DROP_INDEX, dest_key_name, "", dest_key_attr)
 				}
 			}
 		}
+
+		if !table_changes.IsEmpty() {
+			table_changes_list = append(table_changes_list, table_changes)
+		}
 	}
 
 	//场景2
@@ -304,13 +605,105 @@ func DiffDBStruct(data_dir string) error {
 	for dest_table_name, _ := range dest_db_struct {
 		_, table_found := src_db_struct[dest_table_name]
 		if !table_found {
-			err = MakeDropTableSql(data_dir, dest_table_name)
+			table_changes := NewTableChanges(dest_table_name)
+			table_changes.Add(CHANGE_DROP_TABLE, dest_table_name, "", "")
+			table_changes_list = append(table_changes_list, table_changes)
+		}
+	}
+
+	return SortTableChanges(table_changes_list)
+}
+
+//把结构变更写入data_dir目录下以表命名的sql文件
+//每条语句前面注释上表的大小、预测的算法和预计耗时
+func MakeSqlFiles(data_dir string, src_tmp_dir string, table_changes_list []*TableChanges, estimator *PlanEstimator) error {
+	var err error
+
+	combine := GetConfigBool("alter.combine", true)
+	//逐条检查时每个变更单独生成一条语句，才能分别选择是否执行
+	if g_review {
+		combine = false
+	}
+
+	osc_builder, err := NewOSCCommandBuilder(estimator.dest_table_stats)
+	if err != nil {
+		LOG_ERROR("创建OSCCommandBuilder对象失败，失败原因: %v", err)
+		return err
+	}
+
+	//清掉上一次生成但没有执行的文件，避免执行到过期的sql
+	err = RemoveGeneratedFiles(data_dir)
+	if err != nil {
+		return err
+	}
+
+	rollback_writer, err := NewRollbackWriter(data_dir)
+	if err != nil {
+		return err
+	}
+
+	//执行时按这里记录的字段备份，不从语句中解析
+	err = WriteDroppedColumns(data_dir, GetDroppedColumns(table_changes_list))
+	if err != nil {
+		return err
+	}
+
+	var estimates []*StatementEstimate
+
+	for _, table_changes := range table_changes_list {
+		err = rollback_writer.Write(table_changes, combine)
+		if err != nil {
+			return err
+		}
+
+		if table_changes.HasChange(CHANGE_CREATE_TABLE) {
+			//move the create table sql file in src_tmp_dir to data_dir
+			src_file := filepath.Join(src_tmp_dir, table_changes.table_name)
+			src_file = fmt.Sprintf("%v.sql", src_file)
+			dest_file := filepath.Join(data_dir, table_changes.table_name)
+			dest_file = fmt.Sprintf("%v.sql", dest_file)
+
+			_, err = CopyFile(src_file, dest_file)
 			if err != nil {
 				return err
 			}
+			continue
+		}
+
+		//大表改用外部的在线变更工具
+		if !table_changes.HasChange(CHANGE_DROP_TABLE) && osc_builder.IsHeavy(table_changes.table_name) {
+			err = osc_builder.CreateCommandFile(data_dir, table_changes.table_name, ClauseStrings(table_changes.AlterClauses()))
+			if err != nil {
+				return err
+			}
+			LOG_INFO("table %v is too large, %v command written to %v%v", table_changes.table_name, osc_builder.tool, table_changes.table_name, OSC_FILE_SUFFIX)
+			continue
+		}
+
+		statements := table_changes.Statements(combine)
+		if len(statements) == 0 {
+			continue
+		}
+
+		var lines []string
+		for _, statement := range statements {
+			lines = append(lines, RiskAnnotation(statement.changes)...)
+			lines = append(lines, estimator.Annotation(table_changes.table_name, statement.changes)...)
+			lines = append(lines, ValidationAnnotation(statement.changes)...)
+			lines = append(lines, g_onlineDDLPolicy.Decorate(statement.sql))
+
+			prediction, duration := estimator.Estimate(table_changes.table_name, statement.changes)
+			estimates = append(estimates, &StatementEstimate{table_changes.table_name, prediction.algorithm, duration})
+		}
+
+		err = CreateSqlFile(data_dir, table_changes.table_name, strings.Join(lines, "\n"))
+		if err != nil {
+			return err
 		}
 	}
 
+	LogEstimateSummary(estimates)
+
 	return nil
 }
 
@@ -423,7 +816,7 @@ func ParseTableStruct(sql_file string, table_struct map[string]map[string]string
 			continue
 		}
 
-		if strings.HasPrefix(line, "KEY") {
+		if IsKeyLine(line) {
 			//key handle
 			err = ParseKeyStruct(line, table_struct["keys"])
 		} else {
@@ -452,17 +845,41 @@ func ParseFieldStruct(line string, fields_struct map[string]string) error {
 	return nil
 }
 
+//索引的类型作为前缀保存在索引定义中：
+//KEY `k` (`a`,`b`)        => "(`a`,`b`)"
+//UNIQUE KEY `uk` (`a`)    => "UNIQUE (`a`)"
 func ParseKeyStruct(line string, keys_struct map[string]string) error {
-	items := strings.Split(line, " ")
-	if len(items) != 3 {
+	line = strings.TrimSuffix(line, ",")
+
+	idx := strings.Index(line, "KEY ")
+	if idx == -1 {
 		return fmt.Errorf("invalid key struct")
 	}
+	key_kind := strings.TrimSpace(line[:idx])
 
-	keys_struct[items[1]] = strings.TrimSuffix(items[2], ",")
+	items := strings.SplitN(strings.TrimSpace(line[idx+len("KEY "):]), " ", 2)
+	if len(items) != 2 {
+		return fmt.Errorf("invalid key struct")
+	}
+
+	key_attr := items[1]
+	if key_kind != "" {
+		key_attr = key_kind + " " + key_attr
+	}
+	keys_struct[items[0]] = key_attr
 
 	return nil
 }
 
+func IsKeyLine(line string) bool {
+	for _, prefix := range []string{"KEY ", "UNIQUE KEY ", "FULLTEXT KEY ", "SPATIAL KEY "} {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 func PullDBStruct(data_dir string, is_src bool, dbAdaptor *MysqlDBAdaptor) error {
 	var tmp_dir string
 	if is_src {
@@ -470,37 +887,36 @@ func PullDBStruct(data_dir string, is_src bool, dbAdaptor *MysqlDBAdaptor) error
 	} else {
 		tmp_dir = filepath.Join(data_dir, "dest_mysql_tmp")
 	}
-	if !IsDirExists(tmp_dir) {
-		err := os.MkdirAll(tmp_dir, os.ModePerm)
-		if err != nil {
-			return err
-		}
-	}
+	return PullDBStructToDir(tmp_dir, dbAdaptor)
+}
 
-	//get the db table list
-	rows, err := dbAdaptor.Query(SHOW_TABLES_SQL)
+//把数据库中每个表的建表语句保存到tmp_dir下的<表名>.sql
+func PullDBStructToDir(tmp_dir string, dbAdaptor *MysqlDBAdaptor) error {
+	//清掉上次拉取的表结构，否则源库为空时仍会读到旧文件
+	err := os.RemoveAll(tmp_dir)
 	if err != nil {
-		LOG_ERROR("get tables list error: %v", err)
+		LOG_ERROR("remove %v error: %v", tmp_dir, err)
 		return err
 	}
-
-	var table_list []string
-	for rows.Next() {
-		var table_name string
-		err = rows.Scan(&table_name)
-		if err != nil {
-			LOG_ERROR("scan table name error: %v", err)
-			return err
-		}
-		table_list = append(table_list, table_name)
+	err = os.MkdirAll(tmp_dir, os.ModePerm)
+	if err != nil {
+		return err
 	}
 
-	rows.Close()
+	//get the db table list
+	table_list, err := GetTableList(dbAdaptor)
+	if err != nil {
+		return err
+	}
 
 	//get the create table info
 	for _, table := range table_list {
+		if !g_objectFilter.IncludeTable(table) {
+			continue
+		}
+
 		queryStr := fmt.Sprintf("%v %v", SHOW_CREATE_TABLE_PREFIX_SQL, table)
-		rows, err = dbAdaptor.Query(queryStr)
+		rows, err := dbAdaptor.Query(queryStr)
 		if err != nil {
 			LOG_ERROR("query create table info for %v error: %v", table, err)
 			return err
@@ -545,26 +961,61 @@ func PullDBStruct(data_dir string, is_src bool, dbAdaptor *MysqlDBAdaptor) error
 	return nil
 }
 
-func TravelSqlFiles(data_dir string) error {
-	files, err := ioutil.ReadDir(data_dir)
+//返回数据库中的表，忽略工具自己创建的影子表等
+func GetTableList(dbAdaptor *MysqlDBAdaptor) ([]string, error) {
+	rows, err := dbAdaptor.Query(SHOW_TABLES_SQL)
 	if err != nil {
-		LOG_ERROR("get sql file under data dir error: %v", err)
-		return err
+		LOG_ERROR("get tables list error: %v", err)
+		return nil, err
 	}
+	defer rows.Close()
 
-	for _, file := range files {
-		if file.IsDir() {
-			continue
+	var table_list []string
+	for rows.Next() {
+		var table_name string
+		err = rows.Scan(&table_name)
+		if err != nil {
+			LOG_ERROR("scan table name error: %v", err)
+			return nil, err
 		}
-
-		if !strings.HasSuffix(file.Name(), ".sql") {
+		if IsToolObject(table_name) || IsTrashTable(table_name) {
 			continue
 		}
+		table_list = append(table_list, table_name)
+	}
 
-		sql_file := filepath.Join(data_dir, file.Name())
+	return table_list, nil
+}
+
+func TravelSqlFiles(data_dir string) error {
+	sql_files, err := ListSqlFiles(data_dir)
+	if err != nil {
+		return err
+	}
+
+	var rejections []*OnlineDDLRejectedError
+	var failed_files []string
+
+	for i, sql_file := range sql_files {
+		//锁丢失后剩下的文件都不执行
+		err = g_runLock.Check()
+		if err != nil {
+			LOG_ERROR("stop at %v, %v remaining sql files not executed: %v", sql_file, len(sql_files)-i, err)
+			return err
+		}
 
 		err = ExecSqlFile(sql_file)
 		if err != nil {
+			if rejected, ok := err.(*OnlineDDLRejectedError); ok {
+				rejections = append(rejections, rejected)
+				//on_reject为stop时在第一次被拒绝处停止，后面的文件都不执行
+				if g_onlineDDLPolicy.StopOnReject() {
+					LOG_ERROR("stop at %v, %v remaining sql files not executed", sql_file, len(sql_files)-i-1)
+					break
+				}
+			} else {
+				failed_files = append(failed_files, sql_file)
+			}
 			continue
 		}
 
@@ -573,59 +1024,149 @@ func TravelSqlFiles(data_dir string) error {
 		os.Rename(sql_file, new_sql_file)
 	}
 
+	//在线变更被拒绝的表不做任何修改，列出来交给人工选择其他变更方式
+	if len(rejections) > 0 {
+		report_file, err := WriteOnlineDDLReport(data_dir, rejections)
+		if err != nil {
+			return err
+		}
+		LOG_ERROR("%v个sql文件的在线变更被服务器拒绝，详见%v", len(rejections), report_file)
+	}
+
+	//执行失败的文件没有改名为.PASS，修复后可以重新执行
+	for _, sql_file := range failed_files {
+		LOG_ERROR("exec %v failed", sql_file)
+	}
+
+	if len(failed_files) > 0 {
+		return fmt.Errorf("%v sql files failed", len(failed_files))
+	}
+	if len(rejections) > 0 {
+		return fmt.Errorf("online ddl rejected")
+	}
+
 	return nil
 }
 
 func ExecSqlFile(sql_file string) error {
+	sqls, err := ReadSqlStatements(sql_file)
+	if err != nil {
+		return err
+	}
+
+	for _, sql := range sqls {
+		//锁丢失后其他进程可能正在修改目标库
+		err = g_runLock.Check()
+		if err != nil {
+			LOG_ERROR("exec [%v] aborted: %v", sql, err)
+			return err
+		}
+
+		err = g_backupManager.BeforeStatement(sql)
+		if err != nil {
+			LOG_ERROR("backup before [%v] error: %v", sql, err)
+			return err
+		}
+
+		err = ExecOnlineStatement(sql_file, sql)
+		if err != nil {
+			LOG_ERROR("exec [%v] error: %v", sql, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+//读取sql文件中的语句，忽略空行和注释行
+func ReadSqlStatements(sql_file string) ([]string, error) {
 	//read the sql file content
 	f, err := os.Open(sql_file)
 	if err != nil {
 		LOG_ERROR("open sql file[%v] fail: %v", sql_file, err)
-		return err
+		return nil, err
 	}
+	defer f.Close()
+
+	return ParseSqlStatements(f)
+}
 
+func ParseSqlStatements(r io.Reader) ([]string, error) {
 	var content string
-	buf := bufio.NewReader(f)
+	buf := bufio.NewReader(r)
 	for {
 		line, err := buf.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
+		if err != nil && err != io.EOF {
+			return nil, err
 		}
+		eof := err == io.EOF
 
 		line = strings.TrimSpace(line)
 
-		//omit empty line
-		if line == "" {
-			continue
+		//omit empty line and comment line
+		if line != "" && !strings.HasPrefix(line, "--") {
+			content += line + " "
 		}
 
-		//omit comment line
-		if strings.HasPrefix(line, "--") {
-			continue
+		if eof {
+			break
 		}
-
-		content += line
 	}
 
-	sqls := strings.Split(content, ";")
-	for _, sql := range sqls {
+	var sqls []string
+	for _, sql := range strings.Split(content, ";") {
+		sql = strings.TrimSpace(sql)
 		if sql == "" {
 			continue
 		}
+		sqls = append(sqls, sql)
+	}
 
-		err = g_destMysqlAdaptor.Exec(sql)
-		if err != nil {
-			LOG_ERROR("exec [%v] error: %v", sql, err)
-			return err
+	return sqls, nil
+}
+
+func RemoveGeneratedFiles(data_dir string) error {
+	files, err := ioutil.ReadDir(data_dir)
+	if err != nil {
+		LOG_ERROR("ReadDir %v error: %v", data_dir, err)
+		return err
+	}
+
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(file.Name(), ".sql") || strings.HasSuffix(file.Name(), OSC_FILE_SUFFIX) {
+			err = os.Remove(filepath.Join(data_dir, file.Name()))
+			if err != nil {
+				LOG_ERROR("remove %v error: %v", file.Name(), err)
+				return err
+			}
 		}
 	}
 
 	return nil
 }
 
+//data_dir下待执行的sql文件，按文件名排序
+func ListSqlFiles(data_dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(data_dir)
+	if err != nil {
+		LOG_ERROR("get sql file under data dir error: %v", err)
+		return nil, err
+	}
+
+	var sql_files []string
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".sql") {
+			continue
+		}
+		sql_files = append(sql_files, filepath.Join(data_dir, file.Name()))
+	}
+
+	return sql_files, nil
+}
+
 func IsDirExists(path string) bool {
 	fi, err := os.Stat(path)
 	if err != nil {
@@ -652,57 +1193,6 @@ func CopyFile(src, dest string) (w int64, err error) {
 	return io.Copy(destFile, srcFile)
 }
 
-func MakeDropTableSql(data_dir string, table_name string) error {
-
-	drop_table_sql := fmt.Sprintf("DROP TABLE %v;", table_name)
-
-	return CreateSqlFile(data_dir, table_name, drop_table_sql)
-}
-
-func MakeAddFieldSql(data_dir string, table_name string, field_name string, field_attr string) error {
-
-	add_field_sql := fmt.Sprintf("ALTER TABLE %v ADD %v %v;", table_name, field_name, field_attr)
-
-	return AppendSqlFile(data_dir, table_name, add_field_sql)
-}
-
-func MakeRemoveFieldSql(data_dir string, table_name string, field_name string) error {
-
-	drop_field_sql := fmt.Sprintf("ALTER TABLE %v DROP %v;", table_name, field_name)
-
-	return AppendSqlFile(data_dir, table_name, drop_field_sql)
-}
-
-func MakeModifyFieldSql(data_dir string, table_name string, field_name string, field_attr string) error {
-	modify_field_sql := fmt.Sprintf("ALTER TABLE %v MODIFY %v %v;", table_name, field_name, field_attr)
-
-	return AppendSqlFile(data_dir, table_name, modify_field_sql)
-}
-
-func MakeAddIndexSql(data_dir string, table_name string, key_name string, key_attr string) error {
-	add_index_sql := fmt.Sprintf("ALTER TABLE %v ADD INDEX %v %v;", table_name, key_name, key_attr)
-
-	return AppendSqlFile(data_dir, table_name, add_index_sql)
-}
-
-func MakeRemoveIndexSql(data_dir string, table_name string, key_name string) error {
-	drop_index_sql := fmt.Sprintf("ALTER TABLE %v DROP INDEX %v;", table_name, key_name)
-
-	return AppendSqlFile(data_dir, table_name, drop_index_sql)
-}
-
-func MakeModifyIndexSql(data_dir string, table_name string, key_name string, key_attr string) error {
-	err := MakeRemoveIndexSql(data_dir, table_name, key_name)
-	if err != nil {
-		return err
-	}
-	err = MakeAddIndexSql(data_dir, table_name, key_name, key_attr)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
 func CreateSqlFile(data_dir string, table_name string, sql_stat string) error {
 	filename := filepath.Join(data_dir, table_name)
 	filename = fmt.Sprintf("%v.sql", filename)
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	//测试中不输出日志
+	g_logLevel = &LogLevel{}
+	os.Exit(m.Run())
+}
+
+//用给定的配置内容替换全局配置，测试结束时调用返回的函数恢复为空配置
+func SetTestConfig(t *testing.T, content string) func() {
+	f, err := ioutil.TempFile("", "db_struct_sync_*.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString(content)
+	f.Close()
+
+	err = g_config.Read(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		ioutil.WriteFile(f.Name(), nil, 0666)
+		g_config.Read(f.Name())
+		os.Remove(f.Name())
+	}
+}
+
+func TestParseSqlStatements(t *testing.T) {
+	content := "-- comment\n\nALTER TABLE t\n  ADD `a` int,\n  ADD `b` int;\nDROP TABLE `x`;\nCREATE TABLE `y` (`id` int)"
+	statements, err := ParseSqlStatements(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"ALTER TABLE t ADD `a` int, ADD `b` int", "DROP TABLE `x`", "CREATE TABLE `y` (`id` int)"}
+	if len(statements) != len(expected) {
+		t.Fatalf("got %q, want %q", statements, expected)
+	}
+	for i := range expected {
+		if statements[i] != expected[i] {
+			t.Errorf("statement %v = %q, want %q", i, statements[i], expected[i])
+		}
+	}
+}
+
+func TestParseKeyStruct(t *testing.T) {
+	cases := []struct {
+		line     string
+		is_key   bool
+		key_name string
+		key_attr string
+	}{
+		{"KEY `idx_a` (`a`),", true, "`idx_a`", "(`a`)"},
+		{"UNIQUE KEY `uk_ab` (`a`,`b`),", true, "`uk_ab`", "UNIQUE (`a`,`b`)"},
+		{"FULLTEXT KEY `ft_body` (`body`)", true, "`ft_body`", "FULLTEXT (`body`)"},
+		{"SPATIAL KEY `sp_pos` (`pos`)", true, "`sp_pos`", "SPATIAL (`pos`)"},
+		{"PRIMARY KEY (`id`),", false, "", ""},
+		{"`key` int(11) NOT NULL,", false, "", ""},
+	}
+
+	for _, c := range cases {
+		if got := IsKeyLine(c.line); got != c.is_key {
+			t.Errorf("IsKeyLine(%q) = %v, want %v", c.line, got, c.is_key)
+		}
+		if !c.is_key {
+			continue
+		}
+
+		keys_struct := make(map[string]string)
+		if err := ParseKeyStruct(c.line, keys_struct); err != nil {
+			t.Errorf("ParseKeyStruct(%q) error: %v", c.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(keys_struct, map[string]string{c.key_name: c.key_attr}) {
+			t.Errorf("ParseKeyStruct(%q) = %v, want %v: %v", c.line, keys_struct, c.key_name, c.key_attr)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	PLAN_FINGERPRINT_FILE string = "PLAN_FINGERPRINT"
+	DEST_CHECK_TMP_DIR    string = "dest_mysql_check"
+
+	FINGERPRINT_ON_MISMATCH_ABORT      string = "abort"
+	FINGERPRINT_ON_MISMATCH_REGENERATE string = "regenerate"
+)
+
+//表结构快照的指纹：按表名排序后对每个建表语句做sha256
+func SchemaFingerprint(tmp_dir string) (string, error) {
+	files, err := ioutil.ReadDir(tmp_dir)
+	if err != nil {
+		LOG_ERROR("ReadDir %v error: %v", tmp_dir, err)
+		return "", err
+	}
+
+	var names []string
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), ".sql") {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+
+	hash := sha256.New()
+	for _, name := range names {
+		content, err := ioutil.ReadFile(filepath.Join(tmp_dir, name))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "%v\n%v\n", name, content)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+//生成sql文件时记录目标库表结构的指纹
+func SavePlanFingerprint(data_dir string) error {
+	fingerprint, err := SchemaFingerprint(filepath.Join(data_dir, "dest_mysql_tmp"))
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(filepath.Join(data_dir, PLAN_FINGERPRINT_FILE), []byte(fingerprint+"\n"), 0666)
+	if err != nil {
+		LOG_ERROR("write plan fingerprint error: %v", err)
+		return err
+	}
+
+	LOG_INFO("destination schema fingerprint: %v", fingerprint)
+
+	return nil
+}
+
+//重新拉取目标库的表结构，和生成sql文件时的指纹对比，不一致时输出期间发生的变化
+func CheckPlanFingerprint(data_dir string) (bool, error) {
+	content, err := ioutil.ReadFile(filepath.Join(data_dir, PLAN_FINGERPRINT_FILE))
+	if err != nil {
+		LOG_ERROR("read plan fingerprint error: %v", err)
+		return false, err
+	}
+	planned := strings.TrimSpace(string(content))
+
+	check_dir := filepath.Join(data_dir, DEST_CHECK_TMP_DIR)
+	err = PullDBStructToDir(check_dir, g_destMysqlAdaptor)
+	if err != nil {
+		return false, err
+	}
+
+	current, err := SchemaFingerprint(check_dir)
+	if err != nil {
+		return false, err
+	}
+
+	if current == planned {
+		LOG_INFO("destination schema unchanged since the plan was built")
+		return true, nil
+	}
+
+	LOG_WARN("destination schema changed since the plan was built, fingerprint %v => %v", planned, current)
+
+	delta, err := DiffSchemaSnapshots(filepath.Join(data_dir, "dest_mysql_tmp"), check_dir)
+	if err != nil {
+		return false, err
+	}
+	for _, table_changes := range delta {
+		for _, change := range table_changes.changes {
+			LOG_WARN("  %v", change)
+		}
+	}
+
+	return false, nil
+}
+
+//从old_dir到new_dir的表结构变化
+func DiffSchemaSnapshots(old_dir string, new_dir string) ([]*TableChanges, error) {
+	old_struct, err := EnumFilesInDir(old_dir, ".sql")
+	if err != nil {
+		return nil, err
+	}
+
+	new_struct, err := EnumFilesInDir(new_dir, ".sql")
+	if err != nil {
+		return nil, err
+	}
+
+	return CompareDBStruct(new_struct, old_struct), nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func WriteTestSchema(t *testing.T, dir string, tables map[string]string) {
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for table_name, create_table_sql := range tables {
+		err = ioutil.WriteFile(filepath.Join(dir, table_name+".sql"), []byte(create_table_sql), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSchemaFingerprint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fingerprint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	users := "CREATE TABLE `users` (\n  `id` int(11) NOT NULL,\n  `name` varchar(32) DEFAULT NULL,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB;\n"
+	orders := "CREATE TABLE `orders` (\n  `id` int(11) NOT NULL,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB;\n"
+
+	old_dir := filepath.Join(dir, "old")
+	WriteTestSchema(t, old_dir, map[string]string{"users": users, "orders": orders})
+	ioutil.WriteFile(filepath.Join(old_dir, "notes.txt"), []byte("ignored"), 0666)
+
+	same_dir := filepath.Join(dir, "same")
+	WriteTestSchema(t, same_dir, map[string]string{"orders": orders, "users": users})
+
+	new_dir := filepath.Join(dir, "new")
+	WriteTestSchema(t, new_dir, map[string]string{
+		"users":  "CREATE TABLE `users` (\n  `id` int(11) NOT NULL,\n  `name` varchar(64) DEFAULT NULL,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB;\n",
+		"orders": orders,
+	})
+
+	old_fingerprint, err := SchemaFingerprint(old_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	same_fingerprint, _ := SchemaFingerprint(same_dir)
+	new_fingerprint, _ := SchemaFingerprint(new_dir)
+
+	if old_fingerprint != same_fingerprint {
+		t.Errorf("same schema has different fingerprints %v and %v", old_fingerprint, same_fingerprint)
+	}
+	if old_fingerprint == new_fingerprint {
+		t.Errorf("changed schema has the same fingerprint %v", old_fingerprint)
+	}
+
+	delta, err := DiffSchemaSnapshots(old_dir, new_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delta) != 1 || len(delta[0].changes) != 1 || delta[0].changes[0].String() != "MODIFY COLUMN users.`name`" {
+		t.Errorf("unexpected delta %v", delta)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+const (
+	MERGE_CONFLICTS_FILE string = "MERGE_CONFLICTS.txt"
+
+	//快照目录中记录快照来源和过滤条件的文件，不是.sql文件，对比和指纹都会忽略它
+	SNAPSHOT_INFO_FILE string = "snapshot.json"
+
+	MERGE_ON_CONFLICT_ABORT string = "abort"
+	MERGE_ON_CONFLICT_SKIP  string = "skip"
+)
+
+//--base: 三路合并的基准快照目录，覆盖merge.base_dir
+var g_mergeBase string
+
+//三路合并中的冲突：源库和目标库都相对于基准修改了同一个对象，并且改得不一样
+type MergeConflict struct {
+	change    *SchemaChange
+	base_attr string
+	src_attr  string
+	dest_attr string
+}
+
+//快照的来源，过滤条件只记录影响拉取哪些表的部分
+type SnapshotInfo struct {
+	Section     string        `json:"section"`
+	Fingerprint string        `json:"fingerprint"`
+	Created     string        `json:"created"`
+	Filter      *ObjectFilter `json:"filter,omitempty"`
+}
+
+func SaveSnapshotInfo(snapshot_dir string, info *SnapshotInfo) error {
+	content, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(snapshot_dir, SNAPSHOT_INFO_FILE), content, 0666)
+}
+
+//没有记录文件时返回nil
+func LoadSnapshotInfo(snapshot_dir string) (*SnapshotInfo, error) {
+	content, err := ioutil.ReadFile(filepath.Join(snapshot_dir, SNAPSHOT_INFO_FILE))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	info := &SnapshotInfo{}
+	err = json.Unmarshal(content, info)
+	if err != nil {
+		LOG_ERROR("parse %v in %v error: %v", SNAPSHOT_INFO_FILE, snapshot_dir, err)
+		return nil, err
+	}
+	return info, nil
+}
+
+//基准快照中缺少的表会被当成源库和目标库都新建的表，所以快照的表过滤条件必须和本次相同，完整的快照总是可以使用
+func CheckSnapshotFilter(snapshot_filter *ObjectFilter, filter *ObjectFilter) error {
+	snapshot_tables := snapshot_filter.TableFilter()
+	if snapshot_tables.IsEmpty() {
+		return nil
+	}
+	if snapshot_tables.String() != filter.TableFilter().String() {
+		return fmt.Errorf("base snapshot only contains the tables of filter %v, but the current filter is %v", snapshot_tables, filter.TableFilter())
+	}
+	return nil
+}
+
+func GetMergeBaseDir() string {
+	if g_mergeBase != "" {
+		return g_mergeBase
+	}
+	return GetConfigString("merge.base_dir", "")
+}
+
+//对象在一个库结构中的定义，表级变更比较整个表，字段和索引比较各自的定义，不存在时为空
+func ObjectState(db_struct map[string]map[string]map[string]string, change *SchemaChange) (map[string]map[string]string, string, bool) {
+	table_struct, ok := db_struct[change.table_name]
+	if !ok {
+		return nil, "", false
+	}
+
+	switch change.change_type {
+	case CHANGE_CREATE_TABLE, CHANGE_DROP_TABLE:
+		return table_struct, "", true
+	case CHANGE_ADD_FIELD, CHANGE_DROP_FIELD, CHANGE_MODIFY_FIELD:
+		attr, ok := table_struct["fields"][change.object_name]
+		return nil, attr, ok
+	}
+	attr, ok := table_struct["keys"][change.object_name]
+	return nil, attr, ok
+}
+
+//对象从base到other是否被修改过
+func ObjectChanged(base_struct, other_struct map[string]map[string]map[string]string, change *SchemaChange) bool {
+	base_table, base_attr, base_found := ObjectState(base_struct, change)
+	other_table, other_attr, other_found := ObjectState(other_struct, change)
+
+	if base_found != other_found {
+		return true
+	}
+	if change.change_type == CHANGE_CREATE_TABLE || change.change_type == CHANGE_DROP_TABLE {
+		return !reflect.DeepEqual(base_table, other_table)
+	}
+	return base_attr != other_attr
+}
+
+//三路合并：源库到目标库的变更中，只保留源库相对于基准修改过的对象
+//源库没有修改的对象保留目标库自己的修改；两边都修改了的对象是冲突
+func MergeThreeWay(base_struct, src_struct, dest_struct map[string]map[string]map[string]string, table_changes_list []*TableChanges) ([]*TableChanges, []*MergeConflict) {
+	var kept_list []*TableChanges
+	var conflicts []*MergeConflict
+
+	for _, table_changes := range table_changes_list {
+		kept := NewTableChanges(table_changes.table_name)
+		for _, change := range table_changes.changes {
+			if !ObjectChanged(base_struct, src_struct, change) {
+				continue
+			}
+			if ObjectChanged(base_struct, dest_struct, change) {
+				_, base_attr, _ := ObjectState(base_struct, change)
+				conflicts = append(conflicts, &MergeConflict{
+					change:    change,
+					base_attr: base_attr,
+					src_attr:  change.src_attr,
+					dest_attr: change.dest_attr,
+				})
+				continue
+			}
+			kept.changes = append(kept.changes, change)
+		}
+		if !kept.IsEmpty() {
+			kept_list = append(kept_list, kept)
+		}
+	}
+
+	return kept_list, conflicts
+}
+
+func WriteMergeConflictsReport(data_dir string, base_dir string, conflicts []*MergeConflict) (string, error) {
+	filename := filepath.Join(data_dir, MERGE_CONFLICTS_FILE)
+
+	f, err := os.Create(filename)
+	if err != nil {
+		LOG_ERROR("create %v file error: %v", filename, err)
+		return "", err
+	}
+	defer f.Close()
+
+	fmt.Fprintf(f, "基准快照: %v\n", base_dir)
+	fmt.Fprintf(f, "以下对象在源库和目标库中相对于基准都被修改了，而且修改不同，没有写入sql文件，需要人工处理:\n\n")
+	for _, conflict := range conflicts {
+		fmt.Fprintf(f, "%v\n", conflict.change)
+		if conflict.change.change_type == CHANGE_CREATE_TABLE || conflict.change.change_type == CHANGE_DROP_TABLE {
+			fmt.Fprintf(f, "  see %v\n\n", filepath.Join(base_dir, conflict.change.table_name+".sql"))
+			continue
+		}
+		fmt.Fprintf(f, "  base: %v\n", conflict.base_attr)
+		fmt.Fprintf(f, "  src:  %v\n", conflict.src_attr)
+		fmt.Fprintf(f, "  dest: %v\n\n", conflict.dest_attr)
+	}
+
+	return filename, nil
+}
+
+//配置了基准快照时按三路合并过滤变更，有冲突时按merge.on_conflict终止或跳过冲突的变更
+func ApplyMergeBase(data_dir string, src_struct, dest_struct map[string]map[string]map[string]string, table_changes_list []*TableChanges) ([]*TableChanges, error) {
+	base_dir := GetMergeBaseDir()
+	if base_dir == "" {
+		return table_changes_list, nil
+	}
+
+	if !IsDirExists(base_dir) {
+		LOG_ERROR("merge base %v does not exist, create it with the snapshot command", base_dir)
+		return nil, fmt.Errorf("merge base not found")
+	}
+
+	info, err := LoadSnapshotInfo(base_dir)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		LOG_WARN("merge base %v has no %v, can not check the filter it was taken with", base_dir, SNAPSHOT_INFO_FILE)
+	} else {
+		err = CheckSnapshotFilter(info.Filter, g_objectFilter)
+		if err != nil {
+			LOG_ERROR("merge base %v: %v", base_dir, err)
+			return nil, err
+		}
+	}
+
+	base_struct, err := EnumFilesInDir(base_dir, ".sql")
+	if err != nil {
+		return nil, err
+	}
+
+	LOG_INFO("three-way merge with base %v (%v tables)", base_dir, len(base_struct))
+
+	table_changes_list, conflicts := MergeThreeWay(base_struct, src_struct, dest_struct, table_changes_list)
+	if len(conflicts) == 0 {
+		return table_changes_list, nil
+	}
+
+	report_file, err := WriteMergeConflictsReport(data_dir, base_dir, conflicts)
+	if err != nil {
+		return nil, err
+	}
+	for _, conflict := range conflicts {
+		LOG_WARN("merge conflict: %v", conflict.change)
+	}
+
+	on_conflict := GetConfigString("merge.on_conflict", MERGE_ON_CONFLICT_ABORT)
+	if on_conflict == MERGE_ON_CONFLICT_SKIP {
+		LOG_WARN("%v个冲突的变更被跳过，需要人工处理，详见%v", len(conflicts), report_file)
+		return table_changes_list, nil
+	}
+
+	LOG_ERROR("%v个对象在源库和目标库中都被修改，详见%v", len(conflicts), report_file)
+	return nil, fmt.Errorf("merge conflicts")
+}
+
+//把数据库的表结构保存为快照，作为以后三路合并的基准，只包括过滤条件选中的表
+func RunSnapshot(snapshot_dir string, section string) error {
+	if snapshot_dir == "" {
+		return fmt.Errorf("snapshot dir not specified")
+	}
+	if section == "" {
+		section = "mysql_src"
+	}
+
+	//拉取表结构时会清空目录，不能覆盖已有的文件
+	if files, err := ioutil.ReadDir(snapshot_dir); err == nil && len(files) > 0 {
+		LOG_ERROR("snapshot dir %v is not empty", snapshot_dir)
+		return fmt.Errorf("snapshot dir not empty")
+	}
+
+	dbAdaptor, err := OpenMysqlDBAdaptor(section, true)
+	if err != nil {
+		return err
+	}
+	defer dbAdaptor.Release()
+
+	err = PullDBStructToDir(snapshot_dir, dbAdaptor)
+	if err != nil {
+		return err
+	}
+
+	fingerprint, err := SchemaFingerprint(snapshot_dir)
+	if err != nil {
+		return err
+	}
+
+	err = SaveSnapshotInfo(snapshot_dir, &SnapshotInfo{
+		Section:     section,
+		Fingerprint: fingerprint,
+		Created:     time.Now().Format("2006-01-02 15:04:05"),
+		Filter:      g_objectFilter.TableFilter(),
+	})
+	if err != nil {
+		LOG_ERROR("save %v in %v error: %v", SNAPSHOT_INFO_FILE, snapshot_dir, err)
+		return err
+	}
+
+	if g_objectFilter.TableFilter().IsEmpty() {
+		LOG_INFO("snapshot of %v saved to %v, fingerprint %v", section, snapshot_dir, fingerprint)
+	} else {
+		LOG_INFO("snapshot of %v with filter %v saved to %v, fingerprint %v", section, g_objectFilter.TableFilter(), snapshot_dir, fingerprint)
+	}
+
+	return nil
+}
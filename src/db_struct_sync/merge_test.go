@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+)
+
+type testStruct map[string]map[string]map[string]string
+
+func TestObjectChanged(t *testing.T) {
+	base := testStruct{
+		"orders": {
+			"fields": {"`id`": "int(11) NOT NULL", "`note`": "varchar(32)"},
+			"keys":   {"`idx_note`": "KEY (`note`)"},
+		},
+	}
+	other := testStruct{
+		"orders": {
+			"fields": {"`id`": "int(11) NOT NULL", "`note`": "varchar(64)", "`day`": "date"},
+			"keys":   {"`idx_note`": "KEY (`note`)"},
+		},
+		"users": {
+			"fields": {"`id`": "int(11)"},
+			"keys":   {},
+		},
+	}
+
+	cases := []struct {
+		name    string
+		change  *SchemaChange
+		changed bool
+	}{
+		{"same field", &SchemaChange{change_type: CHANGE_MODIFY_FIELD, table_name: "orders", object_name: "`id`"}, false},
+		{"modified field", &SchemaChange{change_type: CHANGE_MODIFY_FIELD, table_name: "orders", object_name: "`note`"}, true},
+		{"added field", &SchemaChange{change_type: CHANGE_ADD_FIELD, table_name: "orders", object_name: "`day`"}, true},
+		{"same index", &SchemaChange{change_type: CHANGE_DROP_INDEX, table_name: "orders", object_name: "`idx_note`"}, false},
+		{"missing index on both", &SchemaChange{change_type: CHANGE_ADD_INDEX, table_name: "orders", object_name: "`idx_day`"}, false},
+		{"added table", &SchemaChange{change_type: CHANGE_CREATE_TABLE, table_name: "users"}, true},
+		{"modified table", &SchemaChange{change_type: CHANGE_DROP_TABLE, table_name: "orders"}, true},
+		{"missing table on both", &SchemaChange{change_type: CHANGE_CREATE_TABLE, table_name: "logs"}, false},
+	}
+
+	for _, c := range cases {
+		if got := ObjectChanged(base, other, c.change); got != c.changed {
+			t.Errorf("%v: ObjectChanged = %v, want %v", c.name, got, c.changed)
+		}
+	}
+}
+
+func TestMergeThreeWay(t *testing.T) {
+	base := testStruct{
+		"t": {"fields": {"`a`": "int(11)", "`b`": "int(11)", "`c`": "int(11)"}, "keys": {}},
+	}
+	//源库修改了a和c，目标库修改了b和c
+	src := testStruct{
+		"t": {"fields": {"`a`": "bigint(20)", "`b`": "int(11)", "`c`": "varchar(10)"}, "keys": {}},
+	}
+	dest := testStruct{
+		"t": {"fields": {"`a`": "int(11)", "`b`": "varchar(20)", "`c`": "char(1)"}, "keys": {}},
+	}
+
+	changes := NewTableChanges("t")
+	changes.Add(CHANGE_MODIFY_FIELD, "`a`", "bigint(20)", "int(11)")
+	changes.Add(CHANGE_MODIFY_FIELD, "`b`", "int(11)", "varchar(20)")
+	changes.Add(CHANGE_MODIFY_FIELD, "`c`", "varchar(10)", "char(1)")
+
+	kept_list, conflicts := MergeThreeWay(base, src, dest, []*TableChanges{changes})
+
+	if len(kept_list) != 1 || len(kept_list[0].changes) != 1 || kept_list[0].changes[0].object_name != "`a`" {
+		t.Errorf("kept changes = %v, want only `a`", kept_list)
+	}
+	if len(conflicts) != 1 || conflicts[0].change.object_name != "`c`" || conflicts[0].base_attr != "int(11)" {
+		t.Errorf("conflicts = %v, want `c` with base int(11)", conflicts)
+	}
+}
+
+func TestCheckSnapshotFilter(t *testing.T) {
+	orders := &ObjectFilter{Tables: []string{"order_*"}}
+
+	cases := []struct {
+		name     string
+		snapshot *ObjectFilter
+		filter   *ObjectFilter
+		valid    bool
+	}{
+		{"full snapshot", nil, nil, true},
+		{"full snapshot with filter", nil, orders, true},
+		{"same tables", orders, &ObjectFilter{Tables: []string{"order_*"}, ObjectTypes: []string{"column"}}, true},
+		{"filtered snapshot without filter", orders, nil, false},
+		{"different tables", orders, &ObjectFilter{Tables: []string{"user_*"}}, false},
+		{"different excludes", orders, &ObjectFilter{Tables: []string{"order_*"}, ExcludeTables: []string{"order_log"}}, false},
+	}
+
+	for _, c := range cases {
+		err := CheckSnapshotFilter(c.snapshot, c.filter)
+		if (err == nil) != c.valid {
+			t.Errorf("%v: CheckSnapshotFilter error = %v, want valid %v", c.name, err, c.valid)
+		}
+	}
+}
@@ -1,20 +1,50 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
 )
 
 type MysqlDBAdaptor struct {
-	db *sql.DB
+	db        *sql.DB
+	read_only bool
 }
 
 func NewMysqlDBAdaptor(host, port, user, pass, dbname, charset string) (*MysqlDBAdaptor, error) {
-	dbAdaptor := &MysqlDBAdaptor{}
+	return OpenMysqlDB(fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=%s", user, pass, host, port, dbname, charset))
+}
 
+//只读连接：每个会话都设置成只读事务，Exec等写操作在本地直接拒绝
+func NewReadOnlyMysqlDBAdaptor(host, port, user, pass, dbname, charset string) (*MysqlDBAdaptor, error) {
 	conn_str := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=%s", user, pass, host, port, dbname, charset)
 
+	//MySQL 5.7.20之前和MariaDB的变量名是tx_read_only，之后是transaction_read_only
+	dbAdaptor, err := OpenMysqlDB(conn_str)
+	if err != nil {
+		return nil, err
+	}
+	read_only_var := "tx_read_only"
+	row := dbAdaptor.db.QueryRow("SELECT @@transaction_read_only")
+	var value int
+	if row.Scan(&value) == nil {
+		read_only_var = "transaction_read_only"
+	}
+	dbAdaptor.Release()
+
+	dbAdaptor, err = OpenMysqlDB(fmt.Sprintf("%s&%s=1", conn_str, read_only_var))
+	if err != nil {
+		return nil, err
+	}
+	dbAdaptor.read_only = true
+
+	return dbAdaptor, nil
+}
+
+func OpenMysqlDB(conn_str string) (*MysqlDBAdaptor, error) {
+	dbAdaptor := &MysqlDBAdaptor{}
+
 	var err error
 	dbAdaptor.db, err = sql.Open("mysql", conn_str)
 	if err != nil {
@@ -63,6 +93,9 @@ func (this *MysqlDBAdaptor) Exec(query string) error {
 	if this.db == nil {
 		return fmt.Errorf("database object invalid")
 	}
+	if this.read_only {
+		return fmt.Errorf("database object is read-only")
+	}
 
 	_, err := this.db.Exec(query)
 	if err != nil {
@@ -76,6 +109,9 @@ func (this *MysqlDBAdaptor) ExecFormat(query string, args ...interface{}) error
 	if this.db == nil {
 		return fmt.Errorf("database object invalid")
 	}
+	if this.read_only {
+		return fmt.Errorf("database object is read-only")
+	}
 
 	_, err := this.db.Exec(query, args...)
 	if err != nil {
@@ -107,10 +143,22 @@ func (this *MysqlDBAdaptor) QueryRowFormat(query string, args ...interface{}) (*
 
 }
 
+//独占一个连接，用于GET_LOCK等和会话绑定的操作，用完需要Close
+func (this *MysqlDBAdaptor) Conn() (*sql.Conn, error) {
+	if this.db == nil {
+		return nil, fmt.Errorf("database object invalid")
+	}
+
+	return this.db.Conn(context.Background())
+}
+
 func (this *MysqlDBAdaptor) BeginTransaction() (*sql.Tx, error) {
 	if this.db == nil {
 		return nil, fmt.Errorf("database object invalid")
 	}
+	if this.read_only {
+		return nil, fmt.Errorf("database object is read-only")
+	}
 
 	tx, err := this.db.Begin()
 	if err != nil {
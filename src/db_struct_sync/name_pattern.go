@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	REGEXP_PATTERN_PREFIX string = "re:"
+)
+
+var g_patternRegExps = make(map[string]*regexp.Regexp)
+
+//配置中使用模式的配置项，启动时全部检查，写错的模式会让保护或过滤静默失效
+var g_patternConfigKeys = []string{
+	"protect.tables",
+	"protect.columns",
+	"policy.drop_tables",
+	"identity.src_allow",
+	"identity.dest_allow",
+	"identity.never_src",
+	"filter.tables",
+	"filter.exclude_tables",
+}
+
+//匹配表名或字段名：
+//以re:开头的是正则表达式，如 re:^audit_log_\d+$
+//否则是glob模式，如 jzl_*、audit_log_??
+func MatchPattern(pattern string, name string) bool {
+	//启动时已经检查过配置中的模式，这里只会遇到代码中的错误
+	err := CompilePattern(pattern)
+	if err != nil {
+		LOG_WARN("invalid pattern %v: %v", pattern, err)
+		return false
+	}
+
+	if strings.HasPrefix(pattern, REGEXP_PATTERN_PREFIX) {
+		return g_patternRegExps[pattern].MatchString(name)
+	}
+
+	matched, _ := path.Match(pattern, name)
+	return matched
+}
+
+func MatchAnyPattern(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if MatchPattern(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+//检查模式是否合法，正则表达式编译后缓存
+func CompilePattern(pattern string) error {
+	if strings.HasPrefix(pattern, REGEXP_PATTERN_PREFIX) {
+		if _, ok := g_patternRegExps[pattern]; ok {
+			return nil
+		}
+		regExp, err := regexp.Compile(strings.TrimPrefix(pattern, REGEXP_PATTERN_PREFIX))
+		if err != nil {
+			return err
+		}
+		g_patternRegExps[pattern] = regExp
+		return nil
+	}
+
+	_, err := path.Match(pattern, "")
+	return err
+}
+
+func ValidatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if err := CompilePattern(pattern); err != nil {
+			return fmt.Errorf("invalid pattern %v: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+func ValidateConfigPatterns() error {
+	for _, key := range g_patternConfigKeys {
+		if err := ValidatePatterns(GetConfigList(key)); err != nil {
+			return fmt.Errorf("%v: %v", key, err)
+		}
+	}
+	return nil
+}
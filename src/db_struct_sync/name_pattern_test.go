@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchPattern(t *testing.T) {
+	cases := []struct {
+		pattern string
+		name    string
+		matched bool
+	}{
+		{"jzl_*", "jzl_user", true},
+		{"jzl_*", "user_jzl", false},
+		{"audit_log_??", "audit_log_01", true},
+		{"audit_log_??", "audit_log_001", false},
+		{"users.password", "users.password", true},
+		{"*.created_at", "orders.created_at", true},
+		{"re:^audit_log_\\d+$", "audit_log_2024", true},
+		{"re:^audit_log_\\d+$", "audit_log_x", false},
+		{"re:billing", "old_billing_2020", true},
+		{"[", "[", false},
+		{"re:(", "(", false},
+	}
+
+	for _, c := range cases {
+		if matched := MatchPattern(c.pattern, c.name); matched != c.matched {
+			t.Errorf("MatchPattern(%q, %q) = %v, want %v", c.pattern, c.name, matched, c.matched)
+		}
+	}
+}
+
+func TestValidatePatterns(t *testing.T) {
+	cases := []struct {
+		patterns []string
+		valid    bool
+	}{
+		{nil, true},
+		{[]string{"billing_*", "re:^audit_log", "users.password"}, true},
+		{[]string{"billing_*", "billing_[0-9"}, false},
+		{[]string{"re:^audit_(log"}, false},
+		{[]string{"a\\"}, false},
+	}
+
+	for _, c := range cases {
+		err := ValidatePatterns(c.patterns)
+		if (err == nil) != c.valid {
+			t.Errorf("ValidatePatterns(%q) error = %v, want valid=%v", c.patterns, err, c.valid)
+		}
+	}
+}
+
+func TestValidateConfigPatterns(t *testing.T) {
+	restore := SetTestConfig(t, "protect.tables = billing_*,re:^audit_(log\n")
+	err := ValidateConfigPatterns()
+	restore()
+	if err == nil || !strings.Contains(err.Error(), "protect.tables") {
+		t.Errorf("expected protect.tables error, got %v", err)
+	}
+
+	restore = SetTestConfig(t, "protect.tables = billing_*\nprotect.columns = users.password,*.created_at\n")
+	err = ValidateConfigPatterns()
+	restore()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
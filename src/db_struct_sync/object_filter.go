@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	FILTER_OBJECT_TABLE  string = "table"
+	FILTER_OBJECT_COLUMN string = "column"
+	FILTER_OBJECT_INDEX  string = "index"
+
+	FILTER_CHANGE_ADD    string = "add"
+	FILTER_CHANGE_DROP   string = "drop"
+	FILTER_CHANGE_MODIFY string = "modify"
+)
+
+//命令行上的过滤条件，不为空时覆盖配置文件中的同名配置
+var g_filterTables string
+var g_filterExcludeTables string
+var g_filterObjectTypes string
+var g_filterChangeTypes string
+
+var g_objectFilter *ObjectFilter
+
+//只同步一部分对象：
+//tables/exclude_tables: 表名的glob模式或以re:开头的正则表达式，tables为空表示全部表
+//object_types: table(建表和删表)、column、index，为空表示全部
+//change_types: add(建表、添加字段和索引)、drop、modify，为空表示全部
+//被过滤的表不会被拉取，也不会出现在任何变更中
+type ObjectFilter struct {
+	Tables        []string `json:"tables,omitempty"`
+	ExcludeTables []string `json:"exclude_tables,omitempty"`
+	ObjectTypes   []string `json:"object_types,omitempty"`
+	ChangeTypes   []string `json:"change_types,omitempty"`
+}
+
+func NewObjectFilter() (*ObjectFilter, error) {
+	filter := &ObjectFilter{
+		Tables:        GetFilterList(g_filterTables, "filter.tables"),
+		ExcludeTables: GetFilterList(g_filterExcludeTables, "filter.exclude_tables"),
+	}
+
+	for _, patterns := range [][]string{filter.Tables, filter.ExcludeTables} {
+		if err := ValidatePatterns(patterns); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, object_type := range GetFilterList(g_filterObjectTypes, "filter.object_types") {
+		object_type = strings.ToLower(object_type)
+		switch object_type {
+		case FILTER_OBJECT_TABLE, FILTER_OBJECT_COLUMN, FILTER_OBJECT_INDEX:
+		default:
+			return nil, fmt.Errorf("invalid filter.object_types: %v", object_type)
+		}
+		filter.ObjectTypes = append(filter.ObjectTypes, object_type)
+	}
+
+	for _, change_type := range GetFilterList(g_filterChangeTypes, "filter.change_types") {
+		change_type = strings.ToLower(change_type)
+		switch change_type {
+		case FILTER_CHANGE_ADD, FILTER_CHANGE_DROP, FILTER_CHANGE_MODIFY:
+		default:
+			return nil, fmt.Errorf("invalid filter.change_types: %v", change_type)
+		}
+		filter.ChangeTypes = append(filter.ChangeTypes, change_type)
+	}
+
+	return filter, nil
+}
+
+//命令行参数优先，没有指定时读取配置
+func GetFilterList(flag_value string, key string) []string {
+	if flag_value == "" {
+		return GetConfigList(key)
+	}
+
+	var list []string
+	for _, item := range strings.Split(flag_value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func (this *ObjectFilter) IsEmpty() bool {
+	return this == nil || (len(this.Tables) == 0 && len(this.ExcludeTables) == 0 && len(this.ObjectTypes) == 0 && len(this.ChangeTypes) == 0)
+}
+
+//只保留表名的过滤条件，它们决定拉取哪些表，没有表名过滤条件时返回nil
+func (this *ObjectFilter) TableFilter() *ObjectFilter {
+	if this == nil || (len(this.Tables) == 0 && len(this.ExcludeTables) == 0) {
+		return nil
+	}
+	return &ObjectFilter{
+		Tables:        this.Tables,
+		ExcludeTables: this.ExcludeTables,
+	}
+}
+
+func (this *ObjectFilter) IncludeTable(table_name string) bool {
+	if this == nil {
+		return true
+	}
+	if len(this.Tables) > 0 && !MatchAnyPattern(this.Tables, table_name) {
+		return false
+	}
+	return !MatchAnyPattern(this.ExcludeTables, table_name)
+}
+
+func (this *ObjectFilter) IncludeChange(change *SchemaChange) bool {
+	if this == nil {
+		return true
+	}
+	if !this.IncludeTable(change.table_name) {
+		return false
+	}
+	if len(this.ObjectTypes) > 0 && !StringInSlice(ChangeObjectType(change), this.ObjectTypes) {
+		return false
+	}
+	if len(this.ChangeTypes) > 0 && !StringInSlice(ChangeKind(change), this.ChangeTypes) {
+		return false
+	}
+	return true
+}
+
+//去掉被过滤的变更，返回剩下的变更和被去掉的变更数量
+func (this *ObjectFilter) Filter(table_changes_list []*TableChanges) ([]*TableChanges, int) {
+	if this.IsEmpty() {
+		return table_changes_list, 0
+	}
+
+	var kept_list []*TableChanges
+	skipped := 0
+
+	for _, table_changes := range table_changes_list {
+		kept := NewTableChanges(table_changes.table_name)
+		for _, change := range table_changes.changes {
+			if this.IncludeChange(change) {
+				kept.changes = append(kept.changes, change)
+			} else {
+				skipped++
+			}
+		}
+		if !kept.IsEmpty() {
+			kept_list = append(kept_list, kept)
+		}
+	}
+
+	return kept_list, skipped
+}
+
+func (this *ObjectFilter) String() string {
+	if this.IsEmpty() {
+		return "none"
+	}
+
+	var items []string
+	if len(this.Tables) > 0 {
+		items = append(items, "tables="+strings.Join(this.Tables, ","))
+	}
+	if len(this.ExcludeTables) > 0 {
+		items = append(items, "exclude_tables="+strings.Join(this.ExcludeTables, ","))
+	}
+	if len(this.ObjectTypes) > 0 {
+		items = append(items, "object_types="+strings.Join(this.ObjectTypes, ","))
+	}
+	if len(this.ChangeTypes) > 0 {
+		items = append(items, "change_types="+strings.Join(this.ChangeTypes, ","))
+	}
+	return strings.Join(items, " ")
+}
+
+func ChangeObjectType(change *SchemaChange) string {
+	switch change.change_type {
+	case CHANGE_CREATE_TABLE, CHANGE_DROP_TABLE:
+		return FILTER_OBJECT_TABLE
+	case CHANGE_ADD_FIELD, CHANGE_DROP_FIELD, CHANGE_MODIFY_FIELD:
+		return FILTER_OBJECT_COLUMN
+	}
+	return FILTER_OBJECT_INDEX
+}
+
+func ChangeKind(change *SchemaChange) string {
+	switch change.change_type {
+	case CHANGE_CREATE_TABLE, CHANGE_ADD_FIELD, CHANGE_ADD_INDEX:
+		return FILTER_CHANGE_ADD
+	case CHANGE_DROP_TABLE, CHANGE_DROP_FIELD, CHANGE_DROP_INDEX:
+		return FILTER_CHANGE_DROP
+	}
+	return FILTER_CHANGE_MODIFY
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChangeObjectTypeAndKind(t *testing.T) {
+	cases := []struct {
+		change_type int
+		object_type string
+		kind        string
+	}{
+		{CHANGE_CREATE_TABLE, FILTER_OBJECT_TABLE, FILTER_CHANGE_ADD},
+		{CHANGE_DROP_TABLE, FILTER_OBJECT_TABLE, FILTER_CHANGE_DROP},
+		{CHANGE_ADD_FIELD, FILTER_OBJECT_COLUMN, FILTER_CHANGE_ADD},
+		{CHANGE_DROP_FIELD, FILTER_OBJECT_COLUMN, FILTER_CHANGE_DROP},
+		{CHANGE_MODIFY_FIELD, FILTER_OBJECT_COLUMN, FILTER_CHANGE_MODIFY},
+		{CHANGE_ADD_INDEX, FILTER_OBJECT_INDEX, FILTER_CHANGE_ADD},
+		{CHANGE_DROP_INDEX, FILTER_OBJECT_INDEX, FILTER_CHANGE_DROP},
+		{CHANGE_MODIFY_INDEX, FILTER_OBJECT_INDEX, FILTER_CHANGE_MODIFY},
+	}
+
+	for _, c := range cases {
+		change := &SchemaChange{change_type: c.change_type}
+		if got := ChangeObjectType(change); got != c.object_type {
+			t.Errorf("ChangeObjectType(%v) = %v, want %v", g_changeTypeNames[c.change_type], got, c.object_type)
+		}
+		if got := ChangeKind(change); got != c.kind {
+			t.Errorf("ChangeKind(%v) = %v, want %v", g_changeTypeNames[c.change_type], got, c.kind)
+		}
+	}
+}
+
+func TestObjectFilterIncludeChange(t *testing.T) {
+	add_field := &SchemaChange{change_type: CHANGE_ADD_FIELD, table_name: "orders", object_name: "`note`"}
+	drop_index := &SchemaChange{change_type: CHANGE_DROP_INDEX, table_name: "orders", object_name: "`idx_day`"}
+	create_tmp := &SchemaChange{change_type: CHANGE_CREATE_TABLE, table_name: "tmp_orders"}
+	modify_log := &SchemaChange{change_type: CHANGE_MODIFY_FIELD, table_name: "log_2024", object_name: "`msg`"}
+
+	cases := []struct {
+		name     string
+		filter   *ObjectFilter
+		change   *SchemaChange
+		included bool
+	}{
+		{"nil filter", nil, drop_index, true},
+		{"empty filter", &ObjectFilter{}, create_tmp, true},
+		{"table matched", &ObjectFilter{Tables: []string{"orders"}}, add_field, true},
+		{"table not matched", &ObjectFilter{Tables: []string{"users"}}, add_field, false},
+		{"glob table", &ObjectFilter{Tables: []string{"tmp_*"}}, create_tmp, true},
+		{"regexp table", &ObjectFilter{Tables: []string{"re:^log_[0-9]+$"}}, modify_log, true},
+		{"excluded table", &ObjectFilter{ExcludeTables: []string{"tmp_*"}}, create_tmp, false},
+		{"exclude wins over tables", &ObjectFilter{Tables: []string{"*"}, ExcludeTables: []string{"orders"}}, add_field, false},
+		{"object type matched", &ObjectFilter{ObjectTypes: []string{FILTER_OBJECT_COLUMN}}, add_field, true},
+		{"object type not matched", &ObjectFilter{ObjectTypes: []string{FILTER_OBJECT_COLUMN}}, drop_index, false},
+		{"change type matched", &ObjectFilter{ChangeTypes: []string{FILTER_CHANGE_ADD}}, create_tmp, true},
+		{"change type not matched", &ObjectFilter{ChangeTypes: []string{FILTER_CHANGE_ADD, FILTER_CHANGE_MODIFY}}, drop_index, false},
+		{"all conditions", &ObjectFilter{Tables: []string{"orders"}, ObjectTypes: []string{FILTER_OBJECT_INDEX}, ChangeTypes: []string{FILTER_CHANGE_DROP}}, drop_index, true},
+	}
+
+	for _, c := range cases {
+		if got := c.filter.IncludeChange(c.change); got != c.included {
+			t.Errorf("%v: IncludeChange(%v) = %v, want %v", c.name, c.change, got, c.included)
+		}
+	}
+}
+
+func TestNewObjectFilter(t *testing.T) {
+	defer func(tables, exclude_tables, object_types, change_types string) {
+		g_filterTables, g_filterExcludeTables, g_filterObjectTypes, g_filterChangeTypes = tables, exclude_tables, object_types, change_types
+	}(g_filterTables, g_filterExcludeTables, g_filterObjectTypes, g_filterChangeTypes)
+
+	cases := []struct {
+		name         string
+		config       string
+		object_types string
+		change_types string
+		ok           bool
+		expect       *ObjectFilter
+	}{
+		{"empty", "", "", "", true, &ObjectFilter{}},
+		{"config", "filter.tables = orders, tmp_*\nfilter.object_types = Column,INDEX\nfilter.change_types = add\n", "", "", true,
+			&ObjectFilter{Tables: []string{"orders", "tmp_*"}, ObjectTypes: []string{"column", "index"}, ChangeTypes: []string{"add"}}},
+		{"flag overrides config", "filter.object_types = table\n", "column", "", true, &ObjectFilter{ObjectTypes: []string{"column"}}},
+		{"invalid object type in config", "filter.object_types = view\n", "", "", false, nil},
+		{"invalid object type in flag", "", "column,trigger", "", false, nil},
+		{"invalid change type", "", "", "rename", false, nil},
+		{"invalid regexp", "filter.exclude_tables = re:(\n", "", "", false, nil},
+	}
+
+	for _, c := range cases {
+		restore := SetTestConfig(t, c.config)
+		g_filterTables, g_filterExcludeTables = "", ""
+		g_filterObjectTypes, g_filterChangeTypes = c.object_types, c.change_types
+		filter, err := NewObjectFilter()
+		restore()
+
+		if (err == nil) != c.ok {
+			t.Errorf("%v: NewObjectFilter error = %v, want ok=%v", c.name, err, c.ok)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(filter, c.expect) {
+			t.Errorf("%v: NewObjectFilter = %+v, want %+v", c.name, filter, c.expect)
+		}
+	}
+}
+
+func TestGetFilterList(t *testing.T) {
+	restore := SetTestConfig(t, "filter.tables = a, b ,,c\n")
+	defer restore()
+
+	cases := []struct {
+		name       string
+		flag_value string
+		key        string
+		expect     []string
+	}{
+		{"config when flag empty", "", "filter.tables", []string{"a", "b", "c"}},
+		{"flag over config", "x,y", "filter.tables", []string{"x", "y"}},
+		{"flag items trimmed", " x , ,y ", "filter.tables", []string{"x", "y"}},
+		{"flag without config", "x", "filter.exclude_tables", []string{"x"}},
+		{"neither", "", "filter.exclude_tables", nil},
+	}
+
+	for _, c := range cases {
+		if got := GetFilterList(c.flag_value, c.key); !reflect.DeepEqual(got, c.expect) {
+			t.Errorf("%v: GetFilterList(%q, %v) = %q, want %q", c.name, c.flag_value, c.key, got, c.expect)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	ONLINE_DDL_REPORT_FILE string = "ONLINE_DDL_REJECTED.txt"
+
+	ER_UNKNOWN_ALTER_ALGORITHM              uint16 = 1800
+	ER_UNKNOWN_ALTER_LOCK                   uint16 = 1801
+	ER_ALTER_OPERATION_NOT_SUPPORTED        uint16 = 1845
+	ER_ALTER_OPERATION_NOT_SUPPORTED_REASON uint16 = 1846
+)
+
+var g_onlineDDLPolicy *OnlineDDLPolicy
+
+var g_onlineClauseRegExp = regexp.MustCompile(`(?i),\s*ALGORITHM\s*=\s*(\w+)(\s*,\s*LOCK\s*=\s*\w+)?\s*$`)
+
+//在线变更策略：生成的ALTER TABLE语句追加ALGORITHM和LOCK子句，
+//服务器拒绝时依次尝试下一个允许的算法，全部被拒绝则停止或改用影子表迁移，绝不退化成锁表的重建
+type OnlineDDLPolicy struct {
+	algorithms []string
+	lock       string
+	on_reject  string
+}
+
+func NewOnlineDDLPolicy() (*OnlineDDLPolicy, error) {
+	policy := &OnlineDDLPolicy{}
+
+	for _, algorithm := range GetConfigList("alter.algorithm") {
+		algorithm = strings.ToUpper(algorithm)
+		switch algorithm {
+		case "INSTANT", "INPLACE":
+		case "COPY":
+			//COPY会在拷贝期间阻塞写入，正是在线变更策略要避免的，需要时改用alter.on_reject = shadow
+			return nil, fmt.Errorf("alter.algorithm COPY blocks writes, use alter.on_reject = shadow instead")
+		default:
+			return nil, fmt.Errorf("invalid alter.algorithm: %v", algorithm)
+		}
+		policy.algorithms = append(policy.algorithms, algorithm)
+	}
+
+	policy.lock = strings.ToUpper(GetConfigString("alter.lock", ""))
+	switch policy.lock {
+	case "", "DEFAULT", "NONE", "SHARED", "EXCLUSIVE":
+	default:
+		return nil, fmt.Errorf("invalid alter.lock: %v", policy.lock)
+	}
+
+	policy.on_reject = strings.ToLower(GetConfigString("alter.on_reject", "stop"))
+	switch policy.on_reject {
+	case "stop", "shadow":
+	default:
+		return nil, fmt.Errorf("invalid alter.on_reject: %v", policy.on_reject)
+	}
+
+	return policy, nil
+}
+
+func (this *OnlineDDLPolicy) IsEnabled() bool {
+	return this != nil && len(this.algorithms) > 0
+}
+
+func (this *OnlineDDLPolicy) StopOnReject() bool {
+	return this == nil || this.on_reject == "stop"
+}
+
+//给ALTER TABLE语句追加策略中第一个算法对应的子句
+func (this *OnlineDDLPolicy) Decorate(statement string) string {
+	if !this.IsEnabled() || !IsAlterTableSql(statement) {
+		return statement
+	}
+	return SetOnlineClause(statement, this.algorithms[0], this.lock)
+}
+
+//返回执行该语句时依次尝试的算法，语句中已写明的算法优先
+func (this *OnlineDDLPolicy) Candidates(statement string) []string {
+	var candidates []string
+
+	written := GetOnlineAlgorithm(statement)
+	if written != "" {
+		candidates = append(candidates, written)
+	}
+
+	if this.IsEnabled() {
+		for _, algorithm := range this.algorithms {
+			if algorithm != written {
+				candidates = append(candidates, algorithm)
+			}
+		}
+	}
+
+	return candidates
+}
+
+func IsAlterTableSql(statement string) bool {
+	return strings.HasPrefix(strings.ToUpper(strings.TrimSpace(statement)), "ALTER TABLE")
+}
+
+func GetOnlineAlgorithm(statement string) string {
+	match := g_onlineClauseRegExp.FindStringSubmatch(strings.TrimSuffix(strings.TrimSpace(statement), ";"))
+	if match == nil {
+		return ""
+	}
+	return strings.ToUpper(match[1])
+}
+
+func StripOnlineClause(statement string) string {
+	statement = strings.TrimSuffix(strings.TrimSpace(statement), ";")
+	return g_onlineClauseRegExp.ReplaceAllString(statement, "")
+}
+
+//ALGORITHM=INSTANT只允许LOCK=DEFAULT，所以INSTANT不追加LOCK子句
+func SetOnlineClause(statement string, algorithm string, lock string) string {
+	has_semicolon := strings.HasSuffix(strings.TrimSpace(statement), ";")
+	multi_line := strings.Contains(statement, "\n")
+
+	clause := fmt.Sprintf("ALGORITHM=%v", algorithm)
+	if lock != "" && algorithm != "INSTANT" {
+		clause = fmt.Sprintf("%v, LOCK=%v", clause, lock)
+	}
+
+	statement = StripOnlineClause(statement)
+	if multi_line {
+		statement = fmt.Sprintf("%v,\n  %v", statement, clause)
+	} else {
+		statement = fmt.Sprintf("%v, %v", statement, clause)
+	}
+	if has_semicolon {
+		statement += ";"
+	}
+
+	return statement
+}
+
+func IsOnlineDDLRejected(err error) bool {
+	mysql_err, ok := err.(*mysql.MySQLError)
+	if !ok {
+		return false
+	}
+
+	switch mysql_err.Number {
+	case ER_UNKNOWN_ALTER_ALGORITHM, ER_UNKNOWN_ALTER_LOCK,
+		ER_ALTER_OPERATION_NOT_SUPPORTED, ER_ALTER_OPERATION_NOT_SUPPORTED_REASON:
+		return true
+	}
+	return false
+}
+
+//在线变更被服务器拒绝的语句
+type OnlineDDLRejectedError struct {
+	sql_file  string
+	statement string
+	attempts  []string
+	reasons   []string
+}
+
+func (this *OnlineDDLRejectedError) Error() string {
+	return fmt.Sprintf("online ddl rejected by server, tried ALGORITHM=%v", strings.Join(this.attempts, "/"))
+}
+
+//按策略执行一条语句，ALTER TABLE被拒绝时依次尝试下一个允许的算法
+func ExecOnlineStatement(sql_file string, statement string) error {
+	candidates := g_onlineDDLPolicy.Candidates(statement)
+	if !IsAlterTableSql(statement) || len(candidates) == 0 {
+		return g_destMysqlAdaptor.Exec(statement)
+	}
+
+	lock := ""
+	if g_onlineDDLPolicy != nil {
+		lock = g_onlineDDLPolicy.lock
+	}
+
+	rejected := &OnlineDDLRejectedError{
+		sql_file:  sql_file,
+		statement: StripOnlineClause(statement),
+	}
+
+	for _, algorithm := range candidates {
+		online_statement := SetOnlineClause(statement, algorithm, lock)
+
+		err := g_destMysqlAdaptor.Exec(online_statement)
+		if err == nil {
+			if len(rejected.attempts) > 0 {
+				LOG_INFO("exec [%v] success after ALGORITHM=%v rejected", online_statement, strings.Join(rejected.attempts, "/"))
+			}
+			return nil
+		}
+		if !IsOnlineDDLRejected(err) {
+			return err
+		}
+
+		LOG_WARN("server rejected ALGORITHM=%v for [%v]: %v", algorithm, rejected.statement, err)
+		rejected.attempts = append(rejected.attempts, algorithm)
+		rejected.reasons = append(rejected.reasons, err.Error())
+	}
+
+	//不允许在线变更的表，按配置改用影子表迁移
+	if g_onlineDDLPolicy != nil && g_onlineDDLPolicy.on_reject == "shadow" {
+		migration, err := NewShadowMigration(filepath.Dir(sql_file), g_destMysqlAdaptor, statement)
+		if err != nil {
+			return err
+		}
+		return migration.Run()
+	}
+
+	return rejected
+}
+
+//把被拒绝的在线变更写到data_dir下的报告文件中，并返回报告路径
+func WriteOnlineDDLReport(data_dir string, rejections []*OnlineDDLRejectedError) (string, error) {
+	filename := filepath.Join(data_dir, ONLINE_DDL_REPORT_FILE)
+
+	f, err := os.Create(filename)
+	if err != nil {
+		LOG_ERROR("create %v file error: %v", filename, err)
+		return "", err
+	}
+	defer f.Close()
+
+	fmt.Fprintf(f, "以下变更无法按照在线策略执行，需要换用其他变更方式(如业务低峰期人工执行或影子表迁移):\n\n")
+	for _, rejected := range rejections {
+		fmt.Fprintf(f, "file: %v\n", rejected.sql_file)
+		fmt.Fprintf(f, "statement: %v\n", rejected.statement)
+		for i, algorithm := range rejected.attempts {
+			fmt.Fprintf(f, "  ALGORITHM=%v: %v\n", algorithm, rejected.reasons[i])
+		}
+		fmt.Fprintf(f, "\n")
+	}
+
+	return filename, nil
+}
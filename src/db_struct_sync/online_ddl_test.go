@@ -0,0 +1,87 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewOnlineDDLPolicy(t *testing.T) {
+	cases := []struct {
+		config     string
+		algorithms []string
+		lock       string
+		valid      bool
+	}{
+		{"", nil, "", true},
+		{"alter.algorithm = instant,inplace\nalter.lock = none\n", []string{"INSTANT", "INPLACE"}, "NONE", true},
+		{"alter.algorithm = INPLACE,COPY\n", nil, "", false},
+		{"alter.algorithm = COPY\n", nil, "", false},
+		{"alter.algorithm = FAST\n", nil, "", false},
+		{"alter.algorithm = INPLACE\nalter.lock = ROW\n", nil, "", false},
+		{"alter.algorithm = INPLACE\nalter.on_reject = ignore\n", nil, "", false},
+	}
+
+	for _, c := range cases {
+		restore := SetTestConfig(t, c.config)
+		policy, err := NewOnlineDDLPolicy()
+		restore()
+
+		if !c.valid {
+			if err == nil {
+				t.Errorf("NewOnlineDDLPolicy(%q) should fail", c.config)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("NewOnlineDDLPolicy(%q) error: %v", c.config, err)
+			continue
+		}
+		if !reflect.DeepEqual(policy.algorithms, c.algorithms) || policy.lock != c.lock {
+			t.Errorf("NewOnlineDDLPolicy(%q) = %v %v, want %v %v", c.config, policy.algorithms, policy.lock, c.algorithms, c.lock)
+		}
+	}
+}
+
+func TestSetOnlineClause(t *testing.T) {
+	cases := []struct {
+		statement string
+		algorithm string
+		lock      string
+		expect    string
+	}{
+		{"ALTER TABLE `t` ADD `a` int;", "INPLACE", "NONE", "ALTER TABLE `t` ADD `a` int, ALGORITHM=INPLACE, LOCK=NONE;"},
+		{"ALTER TABLE `t` ADD `a` int", "INPLACE", "", "ALTER TABLE `t` ADD `a` int, ALGORITHM=INPLACE"},
+		{"ALTER TABLE `t` ADD `a` int;", "INSTANT", "NONE", "ALTER TABLE `t` ADD `a` int, ALGORITHM=INSTANT;"},
+		{"ALTER TABLE `t` ADD `a` int, ALGORITHM=INSTANT;", "INPLACE", "SHARED", "ALTER TABLE `t` ADD `a` int, ALGORITHM=INPLACE, LOCK=SHARED;"},
+		{"ALTER TABLE `t`\n  ADD `a` int,\n  ALGORITHM=INPLACE, LOCK=NONE;", "INSTANT", "NONE", "ALTER TABLE `t`\n  ADD `a` int,\n  ALGORITHM=INSTANT;"},
+	}
+
+	for _, c := range cases {
+		if got := SetOnlineClause(c.statement, c.algorithm, c.lock); got != c.expect {
+			t.Errorf("SetOnlineClause(%q, %v, %v) = %q, want %q", c.statement, c.algorithm, c.lock, got, c.expect)
+		}
+	}
+}
+
+func TestStripOnlineClause(t *testing.T) {
+	cases := []struct {
+		statement string
+		stripped  string
+		algorithm string
+	}{
+		{"ALTER TABLE `t` ADD `a` int;", "ALTER TABLE `t` ADD `a` int", ""},
+		{"ALTER TABLE `t` ADD `a` int, ALGORITHM=INSTANT;", "ALTER TABLE `t` ADD `a` int", "INSTANT"},
+		{"ALTER TABLE `t` ADD `a` int, algorithm = inplace , lock = none;", "ALTER TABLE `t` ADD `a` int", "INPLACE"},
+		{"ALTER TABLE `t`\n  ADD `a` int,\n  ALGORITHM=INPLACE, LOCK=SHARED", "ALTER TABLE `t`\n  ADD `a` int", "INPLACE"},
+		{"ALTER TABLE `t` COMMENT 'ALGORITHM=COPY'", "ALTER TABLE `t` COMMENT 'ALGORITHM=COPY'", ""},
+	}
+
+	for _, c := range cases {
+		if got := StripOnlineClause(c.statement); got != c.stripped {
+			t.Errorf("StripOnlineClause(%q) = %q, want %q", c.statement, got, c.stripped)
+		}
+		if got := GetOnlineAlgorithm(c.statement); got != c.algorithm {
+			t.Errorf("GetOnlineAlgorithm(%q) = %q, want %q", c.statement, got, c.algorithm)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	OSC_TOOL_NONE   string = "none"
+	OSC_TOOL_PT_OSC string = "pt-osc"
+	OSC_TOOL_GH_OST string = "gh-ost"
+
+	OSC_FILE_SUFFIX string = ".osc.sh"
+)
+
+//大表的结构变更不直接生成ALTER TABLE，而是生成交给DBA执行的pt-online-schema-change或gh-ost命令
+//生成的命令只写入data_dir下的.osc.sh文件，工具本身不会执行
+type OSCCommandBuilder struct {
+	tool             string
+	min_size         int64
+	extra_args       []string
+	host             string
+	port             string
+	user             string
+	dbname           string
+	dest_table_stats map[string]*TableStats
+}
+
+func NewOSCCommandBuilder(dest_table_stats map[string]*TableStats) (*OSCCommandBuilder, error) {
+	builder := &OSCCommandBuilder{
+		tool:             strings.ToLower(GetConfigString("osc.tool", OSC_TOOL_NONE)),
+		min_size:         GetConfigInt("osc.min_table_size_mb", 1024) * 1024 * 1024,
+		extra_args:       strings.Fields(GetConfigString("osc.extra_args", "")),
+		host:             GetConfigString("mysql_dest.host", ""),
+		port:             GetConfigString("mysql_dest.port", "3306"),
+		user:             GetConfigString("mysql_dest.username", ""),
+		dbname:           GetConfigString("mysql_dest.dbname", ""),
+		dest_table_stats: dest_table_stats,
+	}
+
+	switch builder.tool {
+	case OSC_TOOL_NONE, OSC_TOOL_PT_OSC, OSC_TOOL_GH_OST:
+	default:
+		return nil, fmt.Errorf("invalid osc.tool: %v", builder.tool)
+	}
+
+	return builder, nil
+}
+
+func (this *OSCCommandBuilder) IsEnabled() bool {
+	return this != nil && this.tool != OSC_TOOL_NONE
+}
+
+//表大小(数据+索引)达到阈值时改用外部工具
+func (this *OSCCommandBuilder) IsHeavy(table_name string) bool {
+	if !this.IsEnabled() {
+		return false
+	}
+
+	stats, ok := this.dest_table_stats[table_name]
+	if !ok {
+		return false
+	}
+
+	return stats.TotalLength() >= this.min_size
+}
+
+//生成命令，alter_clauses为ALTER TABLE后面的子句
+func (this *OSCCommandBuilder) Command(table_name string, alter_clauses []string) string {
+	alter := strings.Join(alter_clauses, ", ")
+
+	var args []string
+	switch this.tool {
+	case OSC_TOOL_PT_OSC:
+		args = append(args, "pt-online-schema-change")
+		args = append(args, "--alter "+ShellQuote(alter))
+		dsn := fmt.Sprintf("h=%v,P=%v,u=%v,D=%v,t=%v", this.host, this.port, this.user, this.dbname, table_name)
+		args = append(args, ShellQuote(dsn))
+		args = append(args, "--ask-pass")
+	case OSC_TOOL_GH_OST:
+		args = append(args, "gh-ost")
+		args = append(args, "--host="+ShellQuote(this.host))
+		args = append(args, "--port="+ShellQuote(this.port))
+		args = append(args, "--user="+ShellQuote(this.user))
+		args = append(args, "--ask-pass")
+		args = append(args, "--database="+ShellQuote(this.dbname))
+		args = append(args, "--table="+ShellQuote(table_name))
+		args = append(args, "--alter="+ShellQuote(alter))
+	}
+
+	//额外参数按空格拆开，每个参数单独加引号，避免被shell解释
+	for _, extra_arg := range this.extra_args {
+		args = append(args, ShellQuote(extra_arg))
+	}
+	args = append(args, "--execute")
+
+	return strings.Join(args, " \\\n  ")
+}
+
+//写入data_dir/<表名>.osc.sh
+func (this *OSCCommandBuilder) CreateCommandFile(data_dir string, table_name string, alter_clauses []string) error {
+	filename := filepath.Join(data_dir, table_name+OSC_FILE_SUFFIX)
+
+	f, err := os.Create(filename)
+	if err != nil {
+		LOG_ERROR("create %v file error: %v", filename, err)
+		return err
+	}
+	defer f.Close()
+
+	stats := this.dest_table_stats[table_name]
+
+	fmt.Fprintf(f, "#!/bin/sh\n")
+	fmt.Fprintf(f, "# table %v: %v rows, %v MB, changed by %v instead of plain ALTER TABLE\n",
+		table_name, stats.table_rows, stats.TotalLength()/1024/1024, this.tool)
+	fmt.Fprintf(f, "# db_struct_sync does not execute this file, run it manually after review\n\n")
+	_, err = fmt.Fprintf(f, "%v\n", this.Command(table_name, alter_clauses))
+	if err != nil {
+		LOG_ERROR("write osc command to file[%v] error: %v", filename, err)
+		return err
+	}
+
+	return nil
+}
+
+//单引号包裹，内部的单引号转义成'\''
+func ShellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
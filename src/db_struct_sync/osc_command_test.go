@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func NewTestOSCCommandBuilder(t *testing.T, config string) (*OSCCommandBuilder, error) {
+	restore := SetTestConfig(t, config+`
+mysql_dest.host = db1
+mysql_dest.port = 3307
+mysql_dest.username = dss
+mysql_dest.dbname = shop
+`)
+	defer restore()
+
+	return NewOSCCommandBuilder(map[string]*TableStats{
+		"orders": {table_name: "orders", table_rows: 1000000, data_length: 900 * 1024 * 1024, index_length: 200 * 1024 * 1024},
+		"users":  {table_name: "users", table_rows: 1000, data_length: 10 * 1024 * 1024},
+	})
+}
+
+func TestOSCCommand(t *testing.T) {
+	cases := []struct {
+		tool     string
+		expected string
+	}{
+		{OSC_TOOL_PT_OSC, "pt-online-schema-change \\\n" +
+			"  --alter 'ADD `note` varchar(32) NOT NULL DEFAULT '\\''n/a'\\''' \\\n" +
+			"  'h=db1,P=3307,u=dss,D=shop,t=orders' \\\n" +
+			"  --ask-pass \\\n" +
+			"  '--max-load=Threads_running=50' \\\n" +
+			"  '--chunk-size=1000' \\\n" +
+			"  --execute"},
+		{OSC_TOOL_GH_OST, "gh-ost \\\n" +
+			"  --host='db1' \\\n" +
+			"  --port='3307' \\\n" +
+			"  --user='dss' \\\n" +
+			"  --ask-pass \\\n" +
+			"  --database='shop' \\\n" +
+			"  --table='orders' \\\n" +
+			"  --alter='ADD `note` varchar(32) NOT NULL DEFAULT '\\''n/a'\\''' \\\n" +
+			"  '--max-load=Threads_running=50' \\\n" +
+			"  '--chunk-size=1000' \\\n" +
+			"  --execute"},
+	}
+
+	for _, c := range cases {
+		builder, err := NewTestOSCCommandBuilder(t, "osc.tool = "+c.tool+"\nosc.extra_args = --max-load=Threads_running=50  --chunk-size=1000\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		command := builder.Command("orders", []string{"ADD `note` varchar(32) NOT NULL DEFAULT 'n/a'"})
+		if command != c.expected {
+			t.Errorf("%v command:\n%v\nwant:\n%v", c.tool, command, c.expected)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	cases := map[string]string{
+		"":           "''",
+		"abc":        "'abc'",
+		"it's":       `'it'\''s'`,
+		"a b; rm -f": "'a b; rm -f'",
+		"$(id)":      "'$(id)'",
+	}
+	for s, expected := range cases {
+		if quoted := ShellQuote(s); quoted != expected {
+			t.Errorf("ShellQuote(%q) = %v, want %v", s, quoted, expected)
+		}
+	}
+}
+
+func TestOSCIsHeavy(t *testing.T) {
+	cases := []struct {
+		config string
+		table  string
+		heavy  bool
+	}{
+		{"osc.tool = pt-osc\nosc.min_table_size_mb = 1024\n", "orders", true},
+		{"osc.tool = pt-osc\nosc.min_table_size_mb = 1101\n", "orders", false},
+		{"osc.tool = pt-osc\nosc.min_table_size_mb = 1100\n", "orders", true},
+		{"osc.tool = gh-ost\n", "users", false},
+		{"osc.tool = gh-ost\n", "missing", false},
+		{"osc.tool = none\nosc.min_table_size_mb = 1\n", "orders", false},
+	}
+
+	for _, c := range cases {
+		builder, err := NewTestOSCCommandBuilder(t, c.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if heavy := builder.IsHeavy(c.table); heavy != c.heavy {
+			t.Errorf("IsHeavy(%v) with %q = %v, want %v", c.table, c.config, heavy, c.heavy)
+		}
+	}
+}
+
+func TestOSCInvalidTool(t *testing.T) {
+	_, err := NewTestOSCCommandBuilder(t, "osc.tool = liquibase\n")
+	if err == nil || !strings.Contains(err.Error(), "invalid osc.tool") {
+		t.Errorf("expected invalid osc.tool error, got %v", err)
+	}
+}
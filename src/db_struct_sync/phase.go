@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	PHASE_ALL      string = "all"
+	PHASE_EXPAND   string = "expand"
+	PHASE_CONTRACT string = "contract"
+
+	//本次生成中属于contract阶段的变更，每行一个
+	CONTRACT_CHANGES_FILE string = "CONTRACT_CHANGES.txt"
+
+	//expand执行之后等待执行的contract变更保存在目标库的这张表中
+	PHASE_PENDING_TABLE string = "_dss_pending_contract"
+)
+
+//--phase: 只生成和执行一个阶段的变更
+var g_phase string
+
+//零停机发布时把变更分成两个阶段：
+//expand: 新建表、添加字段和普通索引、放宽字段定义，新旧代码都能兼容，先于代码发布执行
+//contract: 删除表、字段和索引，收紧字段定义(变短、范围变小、NULL改为NOT NULL)，添加唯一索引，新代码上线之后执行
+func GetPhase() (string, error) {
+	phase := g_phase
+	if phase == "" {
+		phase = GetConfigString("phase.default", PHASE_ALL)
+	}
+
+	phase = strings.ToLower(phase)
+	switch phase {
+	case PHASE_ALL, PHASE_EXPAND, PHASE_CONTRACT:
+	default:
+		return "", fmt.Errorf("invalid phase: %v", phase)
+	}
+	return phase, nil
+}
+
+func ChangePhase(change *SchemaChange) string {
+	switch change.change_type {
+	case CHANGE_CREATE_TABLE, CHANGE_ADD_FIELD:
+		return PHASE_EXPAND
+	case CHANGE_DROP_TABLE, CHANGE_DROP_FIELD, CHANGE_DROP_INDEX:
+		return PHASE_CONTRACT
+	case CHANGE_ADD_INDEX, CHANGE_MODIFY_INDEX:
+		new_kind, new_columns := SplitKeyAttr(change.src_attr)
+		old_kind, old_columns := SplitKeyAttr(change.dest_attr)
+		if new_kind != "UNIQUE" {
+			return PHASE_EXPAND
+		}
+		//唯一索引的字段少于原来的字段时约束变严，现有数据可能违反，旧代码也可能写入失败
+		if old_kind != "UNIQUE" || !IsColumnSuperset(ParseKeyColumns(new_columns), ParseKeyColumns(old_columns)) {
+			return PHASE_CONTRACT
+		}
+		return PHASE_EXPAND
+	case CHANGE_MODIFY_FIELD:
+		if IsFieldWidening(change.src_attr, change.dest_attr) {
+			return PHASE_EXPAND
+		}
+		return PHASE_CONTRACT
+	}
+	return PHASE_CONTRACT
+}
+
+//字段从dest_attr改为src_attr是否只是放宽，现有数据和旧代码都不受影响；不能确定时按收紧处理
+func IsFieldWidening(src_attr string, dest_attr string) bool {
+	new_type, new_rest := SplitFieldTypeWithSign(src_attr)
+	old_type, old_rest := SplitFieldTypeWithSign(dest_attr)
+
+	if IsNotNull(new_rest) && !IsNotNull(old_rest) {
+		return false
+	}
+
+	//字符集或排序规则改变可能丢失无法转换的字符，也会改变比较结果
+	if FieldCharset(new_rest) != FieldCharset(old_rest) || FieldCollation(new_rest) != FieldCollation(old_rest) {
+		return false
+	}
+
+	return IsTypeWidening(new_type, old_type)
+}
+
+var g_charsetRegExp = regexp.MustCompile(`(?i)\bCHARACTER SET (\w+)`)
+var g_collateRegExp = regexp.MustCompile(`(?i)\bCOLLATE (\w+)`)
+
+//字段定义中显式指定的字符集，没有指定时为空
+func FieldCharset(field_rest string) string {
+	if match := g_charsetRegExp.FindStringSubmatch(field_rest); match != nil {
+		return strings.ToLower(match[1])
+	}
+	return ""
+}
+
+func FieldCollation(field_rest string) string {
+	if match := g_collateRegExp.FindStringSubmatch(field_rest); match != nil {
+		return strings.ToLower(match[1])
+	}
+	return ""
+}
+
+//columns是否包含base中的全部字段
+func IsColumnSuperset(columns []string, base []string) bool {
+	for _, column := range base {
+		if !StringInSlice(column, columns) {
+			return false
+		}
+	}
+	return true
+}
+
+//字段类型从old_type改为new_type是否能容纳所有原有的值，类型是SplitFieldTypeWithSign拆出来的
+func IsTypeWidening(new_type string, old_type string) bool {
+	if new_type == old_type {
+		return true
+	}
+
+	//字符串长度变长
+	if match := g_lengthTypeRegExp.FindStringSubmatch(new_type); match != nil {
+		old_match := g_lengthTypeRegExp.FindStringSubmatch(old_type)
+		return old_match != nil && old_match[2] == match[2] && AtoiOrZero(old_match[3]) <= AtoiOrZero(match[3])
+	}
+
+	//整数范围变大
+	if match := g_intTypeRegExp.FindStringSubmatch(new_type); match != nil {
+		old_match := g_intTypeRegExp.FindStringSubmatch(old_type)
+		if old_match == nil {
+			return false
+		}
+		new_range := g_intRanges[NormalizeIntType(match[1])+match[3]]
+		old_range := g_intRanges[NormalizeIntType(old_match[1])+old_match[3]]
+		return CompareBigInt(new_range[0], old_range[0]) <= 0 && CompareBigInt(new_range[1], old_range[1]) >= 0
+	}
+
+	//定点数的整数部分和小数部分都不变短
+	if match := g_decimalTypeRegExp.FindStringSubmatch(new_type); match != nil {
+		old_match := g_decimalTypeRegExp.FindStringSubmatch(old_type)
+		if old_match == nil || (match[5] != "" && old_match[5] == "") {
+			return false
+		}
+		new_precision, _ := strconv.Atoi(match[2])
+		new_scale, _ := strconv.Atoi(match[4])
+		old_precision, _ := strconv.Atoi(old_match[2])
+		old_scale, _ := strconv.Atoi(old_match[4])
+		return new_precision-new_scale >= old_precision-old_scale && new_scale >= old_scale
+	}
+
+	//ENUM只增加了值
+	new_match := g_enumTypeRegExp.FindStringSubmatch(new_type)
+	old_match := g_enumTypeRegExp.FindStringSubmatch(old_type)
+	if new_match != nil && old_match != nil {
+		return len(RemovedEnumValues(new_match[1], old_match[1])) == 0
+	}
+
+	return false
+}
+
+func RemovedEnumValues(new_list string, old_list string) []string {
+	new_values := make(map[string]bool)
+	for _, value := range ParseEnumValues(new_list) {
+		new_values[value] = true
+	}
+
+	var removed []string
+	for _, value := range ParseEnumValues(old_list) {
+		if !new_values[value] {
+			removed = append(removed, value)
+		}
+	}
+	return removed
+}
+
+func CompareBigInt(a string, b string) int {
+	x, _ := new(big.Int).SetString(a, 10)
+	y, _ := new(big.Int).SetString(b, 10)
+	if x == nil || y == nil {
+		return 0
+	}
+	return x.Cmp(y)
+}
+
+//按阶段拆分变更
+func SplitPhases(table_changes_list []*TableChanges) ([]*TableChanges, []*TableChanges) {
+	var expand_list, contract_list []*TableChanges
+
+	for _, table_changes := range table_changes_list {
+		expand := NewTableChanges(table_changes.table_name)
+		contract := NewTableChanges(table_changes.table_name)
+		for _, change := range table_changes.changes {
+			if ChangePhase(change) == PHASE_EXPAND {
+				expand.changes = append(expand.changes, change)
+			} else {
+				contract.changes = append(contract.changes, change)
+			}
+		}
+		if !expand.IsEmpty() {
+			expand_list = append(expand_list, expand)
+		}
+		if !contract.IsEmpty() {
+			contract_list = append(contract_list, contract)
+		}
+	}
+
+	return expand_list, contract_list
+}
+
+//只保留当前阶段的变更，同时把contract阶段的变更记录到CONTRACT_CHANGES.txt：
+//expand阶段时是推迟执行的变更，其他阶段时是本次执行的变更
+//contract阶段要求expand阶段已经执行完
+func SelectPhase(data_dir string, phase string, table_changes_list []*TableChanges) ([]*TableChanges, error) {
+	expand_list, contract_list := SplitPhases(table_changes_list)
+
+	var lines []string
+	for _, table_changes := range contract_list {
+		for _, change := range table_changes.changes {
+			lines = append(lines, change.String())
+		}
+	}
+	err := ioutil.WriteFile(filepath.Join(data_dir, CONTRACT_CHANGES_FILE), []byte(strings.Join(lines, "\n")+"\n"), 0666)
+	if err != nil {
+		LOG_ERROR("write %v error: %v", CONTRACT_CHANGES_FILE, err)
+		return nil, err
+	}
+
+	switch phase {
+	case PHASE_EXPAND:
+		if len(lines) > 0 {
+			LOG_INFO("phase expand: %v contract changes deferred, see %v", len(lines), filepath.Join(data_dir, CONTRACT_CHANGES_FILE))
+		}
+		return expand_list, nil
+	case PHASE_CONTRACT:
+		if len(expand_list) > 0 {
+			for _, table_changes := range expand_list {
+				for _, change := range table_changes.changes {
+					LOG_ERROR("expand change not applied: %v", change)
+				}
+			}
+			return nil, fmt.Errorf("apply the expand phase before the contract phase")
+		}
+		return contract_list, nil
+	}
+
+	return table_changes_list, nil
+}
+
+func ReadContractChanges(data_dir string) ([]string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(data_dir, CONTRACT_CHANGES_FILE))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var changes []string
+	for _, line := range strings.Split(string(content), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			changes = append(changes, line)
+		}
+	}
+	return changes, nil
+}
+
+//变更描述可能很长，utf8mb4下varchar(255)作主键会超过索引长度限制，用描述的sha256作主键
+func PhaseChangeHash(change string) string {
+	hash := sha256.Sum256([]byte(change))
+	return hex.EncodeToString(hash[:])
+}
+
+func CreatePhaseTable(dbAdaptor *MysqlDBAdaptor) error {
+	return dbAdaptor.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %v ("+
+		"`change_hash` char(64) NOT NULL, "+
+		"`change_desc` text NOT NULL, "+
+		"`plan_checksum` varchar(64) NOT NULL DEFAULT '', "+
+		"`created` datetime NOT NULL, "+
+		"PRIMARY KEY (`change_hash`))", QuoteName(PHASE_PENDING_TABLE)))
+}
+
+//计划执行成功之后更新目标库上等待执行的contract变更：
+//expand阶段把推迟的变更记为等待执行，contract阶段把执行了的变更从等待列表中去掉
+//不分阶段的计划不修改等待列表，也不会在目标库上建表
+func RecordPhase(dbAdaptor *MysqlDBAdaptor, plan *Plan) error {
+	if plan.Phase != PHASE_EXPAND && plan.Phase != PHASE_CONTRACT {
+		return nil
+	}
+
+	err := CreatePhaseTable(dbAdaptor)
+	if err != nil {
+		LOG_ERROR("create %v error: %v", PHASE_PENDING_TABLE, err)
+		return err
+	}
+
+	if plan.Phase == PHASE_EXPAND {
+		//没有过滤条件时生成的是完整的差异，以前记录的但已经不存在的变更也去掉
+		if plan.Filter == nil {
+			err = dbAdaptor.Exec(fmt.Sprintf("DELETE FROM %v", QuoteName(PHASE_PENDING_TABLE)))
+			if err != nil {
+				return err
+			}
+		}
+		for _, change := range plan.Contract {
+			err = dbAdaptor.ExecFormat(fmt.Sprintf("REPLACE INTO %v (change_hash, change_desc, plan_checksum, created) VALUES (?, ?, ?, NOW())",
+				QuoteName(PHASE_PENDING_TABLE)), PhaseChangeHash(change), change, plan.Checksum)
+			if err != nil {
+				LOG_ERROR("record pending contract change %v error: %v", change, err)
+				return err
+			}
+		}
+		if len(plan.Contract) > 0 {
+			LOG_WARN("%v contract changes pending, run with --phase contract after the new code is live", len(plan.Contract))
+		}
+		return nil
+	}
+
+	for _, change := range plan.Contract {
+		err = dbAdaptor.ExecFormat(fmt.Sprintf("DELETE FROM %v WHERE change_hash = ?", QuoteName(PHASE_PENDING_TABLE)), PhaseChangeHash(change))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type PendingContractChange struct {
+	change_desc   string
+	plan_checksum string
+	created       string
+}
+
+func QueryPendingContract(dbAdaptor *MysqlDBAdaptor) ([]*PendingContractChange, error) {
+	row, err := dbAdaptor.QueryRowFormat("SELECT COUNT(*) FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?", PHASE_PENDING_TABLE)
+	if err != nil {
+		return nil, err
+	}
+	var count int
+	err = row.Scan(&count)
+	if err != nil || count == 0 {
+		return nil, err
+	}
+
+	rows, err := dbAdaptor.Query(fmt.Sprintf("SELECT change_desc, plan_checksum, created FROM %v ORDER BY created, change_desc", QuoteName(PHASE_PENDING_TABLE)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pending []*PendingContractChange
+	for rows.Next() {
+		change := &PendingContractChange{}
+		err = rows.Scan(&change.change_desc, &change.plan_checksum, &change.created)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, change)
+	}
+
+	return pending, rows.Err()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestIsFieldWidening(t *testing.T) {
+	cases := []struct {
+		src_attr  string
+		dest_attr string
+		widening  bool
+	}{
+		{"varchar(20) NOT NULL", "varchar(10) NOT NULL", true},
+		{"varchar(10)", "varchar(20)", false},
+		{"bigint(20)", "int(11)", true},
+		{"int(11) unsigned", "int(11)", false},
+		{"int(11) NOT NULL", "int(11)", false},
+		{"int(11)", "int(11) NOT NULL", true},
+		{"decimal(12,2)", "decimal(10,2)", true},
+		{"decimal(10,3)", "decimal(10,2)", false},
+		{"enum('a','b','c')", "enum('a','b')", true},
+		{"enum('a')", "enum('a','b')", false},
+		{"text", "varchar(10)", false},
+		{"varchar(20) CHARACTER SET utf8mb4", "varchar(10) CHARACTER SET utf8mb4", true},
+		{"varchar(20) CHARACTER SET latin1", "varchar(20) CHARACTER SET utf8mb4", false},
+		{"varchar(20) COLLATE utf8mb4_bin", "varchar(20) COLLATE utf8mb4_general_ci", false},
+		{"varchar(20) CHARACTER SET utf8mb4", "varchar(20)", false},
+	}
+
+	for _, c := range cases {
+		if got := IsFieldWidening(c.src_attr, c.dest_attr); got != c.widening {
+			t.Errorf("IsFieldWidening(%q, %q) = %v, want %v", c.src_attr, c.dest_attr, got, c.widening)
+		}
+	}
+}
+
+func TestChangePhase(t *testing.T) {
+	cases := []struct {
+		change *SchemaChange
+		phase  string
+	}{
+		{&SchemaChange{change_type: CHANGE_CREATE_TABLE}, PHASE_EXPAND},
+		{&SchemaChange{change_type: CHANGE_ADD_FIELD}, PHASE_EXPAND},
+		{&SchemaChange{change_type: CHANGE_DROP_FIELD}, PHASE_CONTRACT},
+		{&SchemaChange{change_type: CHANGE_DROP_TABLE}, PHASE_CONTRACT},
+		{&SchemaChange{change_type: CHANGE_DROP_INDEX}, PHASE_CONTRACT},
+		{&SchemaChange{change_type: CHANGE_ADD_INDEX, src_attr: "(`a`)"}, PHASE_EXPAND},
+		{&SchemaChange{change_type: CHANGE_ADD_INDEX, src_attr: "UNIQUE (`a`)"}, PHASE_CONTRACT},
+		{&SchemaChange{change_type: CHANGE_MODIFY_INDEX, src_attr: "UNIQUE (`a`,`b`)", dest_attr: "UNIQUE (`a`)"}, PHASE_EXPAND},
+		{&SchemaChange{change_type: CHANGE_MODIFY_INDEX, src_attr: "UNIQUE (`a`)", dest_attr: "UNIQUE (`a`,`b`)"}, PHASE_CONTRACT},
+		{&SchemaChange{change_type: CHANGE_MODIFY_INDEX, src_attr: "UNIQUE (`a`,`c`)", dest_attr: "UNIQUE (`a`,`b`)"}, PHASE_CONTRACT},
+		{&SchemaChange{change_type: CHANGE_MODIFY_FIELD, src_attr: "varchar(20)", dest_attr: "varchar(10)"}, PHASE_EXPAND},
+		{&SchemaChange{change_type: CHANGE_MODIFY_FIELD, src_attr: "varchar(10)", dest_attr: "varchar(20)"}, PHASE_CONTRACT},
+	}
+
+	for _, c := range cases {
+		if got := ChangePhase(c.change); got != c.phase {
+			t.Errorf("ChangePhase(%v %q %q) = %v, want %v", g_changeTypeNames[c.change.change_type], c.change.src_attr, c.change.dest_attr, got, c.phase)
+		}
+	}
+}
+
+func TestPhaseChangeHash(t *testing.T) {
+	long_desc := "MODIFY COLUMN `t`.`c` " + string(make([]byte, 1000))
+	hash := PhaseChangeHash(long_desc)
+	if len(hash) != 64 {
+		t.Errorf("hash length = %v, want 64", len(hash))
+	}
+	if hash != PhaseChangeHash(long_desc) {
+		t.Errorf("hash is not stable")
+	}
+	if hash == PhaseChangeHash(long_desc+"x") {
+		t.Errorf("different changes have the same hash")
+	}
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	PLAN_FORMAT_VERSION int    = 1
+	PLAN_FILE_SUFFIX    string = ".plan.json"
+)
+
+//计划中的一个文件，sql文件同时列出其中按顺序执行的语句
+type PlanFile struct {
+	Name       string   `json:"name"`
+	Content    string   `json:"content"`
+	Statements []string `json:"statements,omitempty"`
+	Checksum   string   `json:"checksum"`
+}
+
+type PlanDatabase struct {
+	Identity          string `json:"identity"`
+	SchemaFingerprint string `json:"schema_fingerprint"`
+}
+
+//可移植的执行计划：plan命令生成，apply命令可以在另一台机器上执行
+//files: data_dir下按文件名顺序执行的sql文件
+//commands: 大表的在线变更工具命令，apply不会执行
+//rollback: 回滚脚本
+//dest_schema: 生成计划时目标库的表结构，用于执行前对比
+//src_schema: 生成计划时源库的表结构，review命令对比显示用
+//filter: 生成计划时的过滤条件，apply重新拉取目标库表结构时使用
+//base: 三路合并时基准快照的指纹
+//phase/contract: 计划的阶段，以及推迟(expand)或包含(contract/all)的contract变更
+type Plan struct {
+	Version     int           `json:"version"`
+	Created     string        `json:"created"`
+	CreatedBy   string        `json:"created_by"`
+	Source      PlanDatabase  `json:"source"`
+	Destination PlanDatabase  `json:"destination"`
+	Files       []*PlanFile   `json:"files"`
+	Commands    []*PlanFile   `json:"commands"`
+	Rollback    []*PlanFile   `json:"rollback"`
+	DestSchema  []*PlanFile   `json:"dest_schema"`
+	SrcSchema   []*PlanFile   `json:"src_schema,omitempty"`
+	Filter      *ObjectFilter `json:"filter,omitempty"`
+	Base        string        `json:"base,omitempty"`
+	Phase       string        `json:"phase,omitempty"`
+	Contract    []string      `json:"contract,omitempty"`
+	Checksum    string        `json:"checksum"`
+
+	//表名 => 将被删除的字段，执行前用于备份
+	DroppedColumns map[string][]string `json:"dropped_columns,omitempty"`
+}
+
+func NewPlanFile(name string, content string) (*PlanFile, error) {
+	plan_file := &PlanFile{
+		Name:    name,
+		Content: content,
+	}
+
+	if strings.HasSuffix(name, ".sql") {
+		statements, err := ParseSqlStatements(strings.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		plan_file.Statements = statements
+	}
+	plan_file.Checksum = plan_file.ComputeChecksum()
+
+	return plan_file, nil
+}
+
+func (this *PlanFile) ComputeChecksum() string {
+	hash := sha256.Sum256([]byte(this.Content))
+	return hex.EncodeToString(hash[:])
+}
+
+//读取目录下以suffix结尾的文件，按文件名排序
+func LoadPlanFiles(dir string, suffix string) ([]*PlanFile, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		LOG_ERROR("ReadDir %v error: %v", dir, err)
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), suffix) {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var plan_files []*PlanFile
+	for _, name := range names {
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			LOG_ERROR("read %v error: %v", name, err)
+			return nil, err
+		}
+		plan_file, err := NewPlanFile(name, string(content))
+		if err != nil {
+			return nil, err
+		}
+		plan_files = append(plan_files, plan_file)
+	}
+
+	return plan_files, nil
+}
+
+//根据BuildSqlFiles在data_dir下生成的文件创建执行计划
+func LoadPlanFromDir(data_dir string) (*Plan, error) {
+	var err error
+
+	plan := &Plan{
+		Version: PLAN_FORMAT_VERSION,
+		Created: time.Now().Format("2006-01-02 15:04:05"),
+	}
+
+	hostname, _ := os.Hostname()
+	if current, err := user.Current(); err == nil {
+		plan.CreatedBy = fmt.Sprintf("%v@%v", current.Username, hostname)
+	} else {
+		plan.CreatedBy = hostname
+	}
+
+	plan.Source.SchemaFingerprint, err = SchemaFingerprint(filepath.Join(data_dir, "src_mysql_tmp"))
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(data_dir, PLAN_FINGERPRINT_FILE))
+	if err != nil {
+		LOG_ERROR("read plan fingerprint error: %v", err)
+		return nil, err
+	}
+	plan.Destination.SchemaFingerprint = strings.TrimSpace(string(content))
+
+	if plan.Files, err = LoadPlanFiles(data_dir, ".sql"); err != nil {
+		return nil, err
+	}
+	if plan.Commands, err = LoadPlanFiles(data_dir, OSC_FILE_SUFFIX); err != nil {
+		return nil, err
+	}
+	if plan.Rollback, err = LoadPlanFiles(filepath.Join(data_dir, ROLLBACK_DIR), ".sql"); err != nil {
+		return nil, err
+	}
+	if plan.DestSchema, err = LoadPlanFiles(filepath.Join(data_dir, "dest_mysql_tmp"), ".sql"); err != nil {
+		return nil, err
+	}
+	if plan.SrcSchema, err = LoadPlanFiles(filepath.Join(data_dir, "src_mysql_tmp"), ".sql"); err != nil {
+		return nil, err
+	}
+
+	if !g_objectFilter.IsEmpty() {
+		plan.Filter = g_objectFilter
+	}
+
+	if base_dir := GetMergeBaseDir(); base_dir != "" {
+		if plan.Base, err = SchemaFingerprint(base_dir); err != nil {
+			return nil, err
+		}
+	}
+
+	plan.Phase = g_phase
+	if plan.Contract, err = ReadContractChanges(data_dir); err != nil {
+		return nil, err
+	}
+
+	dropped_columns, err := ReadDroppedColumns(data_dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(dropped_columns) > 0 {
+		plan.DroppedColumns = dropped_columns
+	}
+
+	plan.Checksum = plan.ComputeChecksum()
+
+	return plan, nil
+}
+
+//整个计划的校验和：覆盖版本、两个库的身份和指纹，以及每个文件的校验和
+func (this *Plan) ComputeChecksum() string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%v\n%v\n%v\n%v\n%v\n", this.Version,
+		this.Source.Identity, this.Source.SchemaFingerprint, this.Destination.Identity, this.Destination.SchemaFingerprint)
+	if this.Filter != nil {
+		fmt.Fprintf(hash, "filter %v\n", this.Filter)
+	}
+	if this.Base != "" {
+		fmt.Fprintf(hash, "base %v\n", this.Base)
+	}
+	if this.Phase != "" {
+		fmt.Fprintf(hash, "phase %v\n%v\n", this.Phase, strings.Join(this.Contract, "\n"))
+	}
+	//没有删除字段的计划不改变校验和
+	if len(this.DroppedColumns) > 0 {
+		var tables []string
+		for table_name := range this.DroppedColumns {
+			tables = append(tables, table_name)
+		}
+		sort.Strings(tables)
+		for _, table_name := range tables {
+			fmt.Fprintf(hash, "dropped %v %v\n", table_name, strings.Join(this.DroppedColumns[table_name], ","))
+		}
+	}
+
+	groups := [][]*PlanFile{this.Files, this.Commands, this.Rollback, this.DestSchema}
+	//旧版本的计划没有源库表结构，不改变它们的校验和
+	if len(this.SrcSchema) > 0 {
+		groups = append(groups, this.SrcSchema)
+	}
+	for _, group := range groups {
+		for _, plan_file := range group {
+			fmt.Fprintf(hash, "%v %v\n", plan_file.Name, plan_file.Checksum)
+		}
+		fmt.Fprintf(hash, "\n")
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+//检查计划没有被修改：每个文件的内容、语句列表和整个计划的校验和
+func (this *Plan) Verify() error {
+	if this.Version != PLAN_FORMAT_VERSION {
+		return fmt.Errorf("unsupported plan version: %v", this.Version)
+	}
+
+	for _, group := range [][]*PlanFile{this.Files, this.Commands, this.Rollback, this.DestSchema, this.SrcSchema} {
+		for _, plan_file := range group {
+			if filepath.Base(plan_file.Name) != plan_file.Name {
+				return fmt.Errorf("invalid file name in plan: %v", plan_file.Name)
+			}
+			if plan_file.ComputeChecksum() != plan_file.Checksum {
+				return fmt.Errorf("checksum mismatch of %v", plan_file.Name)
+			}
+			expected, err := NewPlanFile(plan_file.Name, plan_file.Content)
+			if err != nil {
+				return err
+			}
+			if strings.Join(expected.Statements, "\n") != strings.Join(plan_file.Statements, "\n") {
+				return fmt.Errorf("statements of %v do not match its content", plan_file.Name)
+			}
+		}
+	}
+
+	if this.ComputeChecksum() != this.Checksum {
+		return fmt.Errorf("plan checksum mismatch")
+	}
+
+	return nil
+}
+
+func (this *Plan) StatementCount() int {
+	count := 0
+	for _, plan_file := range this.Files {
+		count += len(plan_file.Statements)
+	}
+	return count
+}
+
+func SavePlan(plan *Plan, filename string) error {
+	content, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(filename, content, 0666)
+	if err != nil {
+		LOG_ERROR("write plan %v error: %v", filename, err)
+		return err
+	}
+
+	return nil
+}
+
+func LoadPlan(filename string) (*Plan, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		LOG_ERROR("read plan %v error: %v", filename, err)
+		return nil, err
+	}
+
+	plan := &Plan{}
+	err = json.Unmarshal(content, plan)
+	if err != nil {
+		LOG_ERROR("parse plan %v error: %v", filename, err)
+		return nil, err
+	}
+
+	err = plan.Verify()
+	if err != nil {
+		LOG_ERROR("verify plan %v error: %v", filename, err)
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+//把计划还原成data_dir下的文件，之后按sync的流程执行
+func (this *Plan) Materialize(data_dir string) error {
+	err := os.MkdirAll(data_dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	err = RemoveGeneratedFiles(data_dir)
+	if err != nil {
+		return err
+	}
+
+	groups := []struct {
+		dir   string
+		files []*PlanFile
+	}{
+		{data_dir, this.Files},
+		{data_dir, this.Commands},
+		{filepath.Join(data_dir, ROLLBACK_DIR), this.Rollback},
+		{filepath.Join(data_dir, "dest_mysql_tmp"), this.DestSchema},
+		{filepath.Join(data_dir, "src_mysql_tmp"), this.SrcSchema},
+	}
+
+	for _, group := range groups {
+		if group.dir != data_dir {
+			err = os.RemoveAll(group.dir)
+			if err != nil {
+				return err
+			}
+			err = os.MkdirAll(group.dir, os.ModePerm)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, plan_file := range group.files {
+			mode := os.FileMode(0666)
+			if strings.HasSuffix(plan_file.Name, OSC_FILE_SUFFIX) {
+				mode = 0755
+			}
+			err = ioutil.WriteFile(filepath.Join(group.dir, plan_file.Name), []byte(plan_file.Content), mode)
+			if err != nil {
+				LOG_ERROR("write %v error: %v", plan_file.Name, err)
+				return err
+			}
+		}
+	}
+
+	err = WriteDroppedColumns(data_dir, this.DroppedColumns)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(data_dir, PLAN_FINGERPRINT_FILE), []byte(this.Destination.SchemaFingerprint+"\n"), 0666)
+}
+
+//生成sql文件并保存为执行计划，不执行
+func RunPlan(data_dir string, plan_file string) error {
+	var err error
+
+	g_srcMysqlAdaptor, err = OpenMysqlDBAdaptor("mysql_src", true)
+	if err != nil {
+		return err
+	}
+	defer g_srcMysqlAdaptor.Release()
+
+	g_destMysqlAdaptor, err = OpenMysqlDBAdaptor("mysql_dest", false)
+	if err != nil {
+		return err
+	}
+	defer g_destMysqlAdaptor.Release()
+
+	src, dest, err := CheckDBIdentity(g_srcMysqlAdaptor, g_destMysqlAdaptor)
+	if err != nil {
+		LOG_ERROR("check database identity fail: %v", err)
+		return err
+	}
+
+	run_lock, err := AcquireRunLock(g_destMysqlAdaptor, "plan")
+	if err != nil {
+		LOG_ERROR("lock destination fail: %v", err)
+		return err
+	}
+	defer run_lock.Release()
+
+	err = BuildSqlFiles(data_dir)
+	if err != nil {
+		return err
+	}
+
+	if g_review {
+		accepted, err := ReviewSqlFiles(data_dir)
+		if err != nil {
+			return err
+		}
+		if !accepted {
+			LOG_INFO("review discarded, plan not written")
+			return fmt.Errorf("not approved")
+		}
+	}
+
+	plan, err := LoadPlanFromDir(data_dir)
+	if err != nil {
+		return err
+	}
+	plan.Source.Identity = src.Fingerprint()
+	plan.Destination.Identity = dest.Fingerprint()
+	plan.Checksum = plan.ComputeChecksum()
+
+	if plan_file == "" {
+		plan_file = filepath.Join(data_dir, "plan_"+time.Now().Format("20060102150405")+PLAN_FILE_SUFFIX)
+	}
+	err = SavePlan(plan, plan_file)
+	if err != nil {
+		return err
+	}
+
+	LOG_INFO("plan written to %v: %v sql files, %v statements, checksum %v", plan_file, len(plan.Files), plan.StatementCount(), plan.Checksum)
+	if len(plan.Commands) > 0 {
+		LOG_WARN("%v tables need the online schema change tool, their commands are included but not executed by apply", len(plan.Commands))
+	}
+
+	return nil
+}
+
+//在目标库上执行plan命令生成的计划
+func RunApply(data_dir string, plan_file string) error {
+	if plan_file == "" {
+		return fmt.Errorf("plan file not specified")
+	}
+
+	plan, err := LoadPlan(plan_file)
+	if err != nil {
+		return err
+	}
+
+	err = VerifyApprovals(plan_file, plan)
+	if err != nil {
+		return err
+	}
+
+	//expand和contract计划需要用--phase明确指定要执行的阶段
+	if plan.Phase != "" && plan.Phase != g_phase {
+		LOG_ERROR("plan %v is built for phase %v, run apply with --phase %v", plan_file, plan.Phase, plan.Phase)
+		return fmt.Errorf("phase does not match the plan")
+	}
+
+	g_destMysqlAdaptor, err = OpenMysqlDBAdaptor("mysql_dest", false)
+	if err != nil {
+		return err
+	}
+	defer g_destMysqlAdaptor.Release()
+
+	//计划只能在生成它时的目标库上执行
+	dest, err := QueryDBIdentity(g_destMysqlAdaptor, "mysql_dest")
+	if err != nil {
+		return err
+	}
+	if dest.Fingerprint() != plan.Destination.Identity {
+		LOG_ERROR("plan was built for %v, but mysql_dest is %v", plan.Destination.Identity, dest.Fingerprint())
+		return fmt.Errorf("destination does not match the plan")
+	}
+	dest_allow := GetConfigList("identity.dest_allow")
+	if len(dest_allow) > 0 && !dest.Match(dest_allow) {
+		return fmt.Errorf("%v does not match identity.dest_allow", dest)
+	}
+
+	run_lock, err := AcquireRunLock(g_destMysqlAdaptor, "apply")
+	if err != nil {
+		LOG_ERROR("lock destination fail: %v", err)
+		return err
+	}
+	defer run_lock.Release()
+
+	LOG_INFO("apply plan %v created at %v by %v: %v sql files, %v statements",
+		plan_file, plan.Created, plan.CreatedBy, len(plan.Files), plan.StatementCount())
+
+	err = plan.Materialize(data_dir)
+	if err != nil {
+		return err
+	}
+
+	//按生成计划时的过滤条件拉取目标库表结构，否则指纹无法对比
+	if !g_objectFilter.IsEmpty() && g_objectFilter.String() != plan.Filter.String() {
+		LOG_WARN("filter %v ignored, apply uses the filter of the plan: %v", g_objectFilter, plan.Filter)
+	}
+	g_objectFilter = plan.Filter
+
+	approved, err := ConfirmApply(plan, dest)
+	if err != nil {
+		return err
+	}
+	if !approved {
+		LOG_INFO("program terminated!")
+		return fmt.Errorf("not approved")
+	}
+
+	//确认可能等待很久，在确认之后、执行之前检查目标库的表结构
+	//没有源库，目标库被修改时无法重新生成，只能终止
+	if GetConfigBool("fingerprint.enable", true) {
+		matched, err := CheckPlanFingerprint(data_dir)
+		if err != nil {
+			return err
+		}
+		if !matched {
+			LOG_ERROR("目标库的表结构在生成计划之后被修改，请重新生成计划")
+			return fmt.Errorf("destination schema changed after the plan was built")
+		}
+	}
+
+	err = ApplySqlFiles(data_dir, plan.StatementsHash())
+	if err != nil {
+		return err
+	}
+
+	return RecordPhase(g_destMysqlAdaptor, plan)
+}
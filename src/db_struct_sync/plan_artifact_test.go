@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func MakeTestPlan(t *testing.T) *Plan {
+	orders, err := NewPlanFile("orders.sql", "-- risk: safe\nALTER TABLE `orders` ADD `note` varchar(32);\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := NewPlanFile("users.sql", "ALTER TABLE `users`\n  DROP `old`,\n  ADD `age` int(11);\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema, err := NewPlanFile("orders.sql", "CREATE TABLE `orders` (\n  `id` int(11) NOT NULL\n);\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan := &Plan{
+		Version:     PLAN_FORMAT_VERSION,
+		Source:      PlanDatabase{Identity: "src:3306:db:uuid1", SchemaFingerprint: "aaa"},
+		Destination: PlanDatabase{Identity: "dest:3306:db:uuid2", SchemaFingerprint: "bbb"},
+		Files:       []*PlanFile{orders, users},
+		DestSchema:  []*PlanFile{schema},
+		Phase:       PHASE_EXPAND,
+		Contract:    []string{"DROP COLUMN users.`old`"},
+	}
+	plan.Checksum = plan.ComputeChecksum()
+	return plan
+}
+
+func TestPlanVerify(t *testing.T) {
+	cases := []struct {
+		name   string
+		tamper func(plan *Plan)
+		valid  bool
+	}{
+		{"untouched", func(plan *Plan) {}, true},
+		{"content changed", func(plan *Plan) {
+			plan.Files[0].Content = "DROP TABLE `orders`;\n"
+		}, false},
+		{"content and file checksum changed", func(plan *Plan) {
+			plan.Files[0].Content = "DROP TABLE `orders`;\n"
+			plan.Files[0].Checksum = plan.Files[0].ComputeChecksum()
+		}, false},
+		{"statements changed", func(plan *Plan) {
+			plan.Files[1].Statements = []string{"DROP TABLE `users`"}
+		}, false},
+		{"file removed", func(plan *Plan) {
+			plan.Files = plan.Files[:1]
+		}, false},
+		{"destination changed", func(plan *Plan) {
+			plan.Destination.Identity = "prod:3306:db:uuid3"
+		}, false},
+		{"phase changed", func(plan *Plan) {
+			plan.Phase = PHASE_ALL
+		}, false},
+		{"dropped columns changed", func(plan *Plan) {
+			plan.DroppedColumns = map[string][]string{"orders": {"id"}}
+		}, false},
+		{"filter added", func(plan *Plan) {
+			plan.Filter = &ObjectFilter{Tables: []string{"orders"}}
+		}, false},
+		{"file name outside data dir", func(plan *Plan) {
+			plan.Files[0].Name = "../orders.sql"
+			plan.Checksum = plan.ComputeChecksum()
+		}, false},
+		{"unsupported version", func(plan *Plan) {
+			plan.Version = PLAN_FORMAT_VERSION + 1
+			plan.Checksum = plan.ComputeChecksum()
+		}, false},
+		{"rebuilt checksum", func(plan *Plan) {
+			plan.Files[0].Content = "DROP TABLE `orders`;\n"
+			plan.Files[0].Statements = []string{"DROP TABLE `orders`"}
+			plan.Files[0].Checksum = plan.Files[0].ComputeChecksum()
+			plan.Checksum = plan.ComputeChecksum()
+		}, true},
+	}
+
+	for _, c := range cases {
+		plan := MakeTestPlan(t)
+		c.tamper(plan)
+		err := plan.Verify()
+		if (err == nil) != c.valid {
+			t.Errorf("%v: Verify error = %v, want valid %v", c.name, err, c.valid)
+		}
+	}
+}
+
+func TestPlanSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plan_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	plan := MakeTestPlan(t)
+	plan_file := filepath.Join(dir, "test"+PLAN_FILE_SUFFIX)
+	if err := SavePlan(plan, plan_file); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadPlan(plan_file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Checksum != plan.Checksum || loaded.StatementCount() != 2 {
+		t.Errorf("loaded plan checksum %v with %v statements, want %v with 2", loaded.Checksum, loaded.StatementCount(), plan.Checksum)
+	}
+
+	//没有源库表结构的旧计划，校验和不变
+	if len(loaded.SrcSchema) != 0 || loaded.ComputeChecksum() != plan.Checksum {
+		t.Errorf("checksum of a plan without src_schema changed")
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ALGORITHM_NONE    string = "-"
+	ALGORITHM_INSTANT string = "INSTANT"
+	ALGORITHM_INPLACE string = "INPLACE"
+	ALGORITHM_COPY    string = "COPY"
+)
+
+var g_versionRegExp = regexp.MustCompile(`^(\d+)\.(\d+)\.(\d+)`)
+
+//数据库版本，用于预测ALTER TABLE使用的算法
+type ServerVersion struct {
+	raw        string
+	major      int
+	minor      int
+	patch      int
+	is_mariadb bool
+}
+
+func QueryServerVersion(dbAdaptor *MysqlDBAdaptor) (*ServerVersion, error) {
+	row, err := dbAdaptor.QueryRow("SELECT VERSION()")
+	if err != nil {
+		return nil, err
+	}
+
+	var raw string
+	err = row.Scan(&raw)
+	if err != nil {
+		LOG_ERROR("query server version error: %v", err)
+		return nil, err
+	}
+
+	return ParseServerVersion(raw), nil
+}
+
+func ParseServerVersion(raw string) *ServerVersion {
+	version := &ServerVersion{
+		raw:        raw,
+		is_mariadb: strings.Contains(strings.ToLower(raw), "mariadb"),
+	}
+
+	match := g_versionRegExp.FindStringSubmatch(raw)
+	if match != nil {
+		version.major, _ = strconv.Atoi(match[1])
+		version.minor, _ = strconv.Atoi(match[2])
+		version.patch, _ = strconv.Atoi(match[3])
+	}
+
+	return version
+}
+
+func (this *ServerVersion) AtLeast(major, minor, patch int) bool {
+	if this.major != major {
+		return this.major > major
+	}
+	if this.minor != minor {
+		return this.minor > minor
+	}
+	return this.patch >= patch
+}
+
+//MySQL 5.6开始支持online DDL
+func (this *ServerVersion) HasInplace() bool {
+	return this.is_mariadb || this.AtLeast(5, 6, 0)
+}
+
+func (this *ServerVersion) HasInstantAddColumn() bool {
+	if this.is_mariadb {
+		return this.AtLeast(10, 3, 2)
+	}
+	return this.AtLeast(8, 0, 12)
+}
+
+func (this *ServerVersion) HasInstantDropColumn() bool {
+	if this.is_mariadb {
+		return this.AtLeast(10, 4, 0)
+	}
+	return this.AtLeast(8, 0, 29)
+}
+
+//预测的算法，rebuild表示需要扫描或重建整张表
+type AlgorithmPrediction struct {
+	algorithm string
+	rebuild   bool
+}
+
+var g_algorithmRank = map[string]int{
+	ALGORITHM_NONE:    0,
+	ALGORITHM_INSTANT: 1,
+	ALGORITHM_INPLACE: 2,
+	ALGORITHM_COPY:    3,
+}
+
+//按变更类型和目标库版本预测ALTER TABLE的算法，只是粗略估计，以服务器实际执行为准
+func PredictAlgorithm(change *SchemaChange, version *ServerVersion) *AlgorithmPrediction {
+	inplace_or_copy := ALGORITHM_COPY
+	if version.HasInplace() {
+		inplace_or_copy = ALGORITHM_INPLACE
+	}
+
+	switch change.change_type {
+	case CHANGE_CREATE_TABLE, CHANGE_DROP_TABLE:
+		return &AlgorithmPrediction{ALGORITHM_NONE, false}
+	case CHANGE_ADD_FIELD:
+		if version.HasInstantAddColumn() {
+			return &AlgorithmPrediction{ALGORITHM_INSTANT, false}
+		}
+		return &AlgorithmPrediction{inplace_or_copy, true}
+	case CHANGE_DROP_FIELD:
+		if version.HasInstantDropColumn() {
+			return &AlgorithmPrediction{ALGORITHM_INSTANT, false}
+		}
+		return &AlgorithmPrediction{inplace_or_copy, true}
+	case CHANGE_MODIFY_FIELD:
+		src_type, src_rest := SplitFieldType(change.src_attr)
+		dest_type, dest_rest := SplitFieldType(change.dest_attr)
+		if src_type == dest_type {
+			//只修改默认值
+			if RemoveDefaultClause(src_rest) == RemoveDefaultClause(dest_rest) {
+				if version.HasInstantAddColumn() {
+					return &AlgorithmPrediction{ALGORITHM_INSTANT, false}
+				}
+				return &AlgorithmPrediction{inplace_or_copy, false}
+			}
+			//修改NULL/NOT NULL需要重建
+			return &AlgorithmPrediction{inplace_or_copy, true}
+		}
+		//5.7开始varchar加长可以in-place
+		if IsVarcharWidening(dest_type, src_type) && version.AtLeast(5, 7, 0) {
+			return &AlgorithmPrediction{ALGORITHM_INPLACE, false}
+		}
+		return &AlgorithmPrediction{ALGORITHM_COPY, true}
+	case CHANGE_ADD_INDEX, CHANGE_MODIFY_INDEX:
+		return &AlgorithmPrediction{inplace_or_copy, true}
+	case CHANGE_DROP_INDEX:
+		return &AlgorithmPrediction{inplace_or_copy, false}
+	}
+
+	return &AlgorithmPrediction{ALGORITHM_COPY, true}
+}
+
+//一条语句中所有子句里最重的算法
+func PredictStatementAlgorithm(changes []*SchemaChange, version *ServerVersion) *AlgorithmPrediction {
+	prediction := &AlgorithmPrediction{ALGORITHM_NONE, false}
+	for _, change := range changes {
+		change_prediction := PredictAlgorithm(change, version)
+		if g_algorithmRank[change_prediction.algorithm] > g_algorithmRank[prediction.algorithm] {
+			prediction.algorithm = change_prediction.algorithm
+		}
+		prediction.rebuild = prediction.rebuild || change_prediction.rebuild
+	}
+	return prediction
+}
+
+//把字段定义拆成类型和其余部分，如"varchar(64) NOT NULL DEFAULT ''" => "varchar(64)", "NOT NULL DEFAULT ''"
+func SplitFieldType(field_attr string) (string, string) {
+	field_attr = strings.TrimSpace(field_attr)
+
+	depth := 0
+	for i, c := range field_attr {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ' ':
+			if depth == 0 {
+				return strings.ToLower(field_attr[:i]), strings.TrimSpace(field_attr[i+1:])
+			}
+		}
+	}
+
+	return strings.ToLower(field_attr), ""
+}
+
+var g_defaultClauseRegExp = regexp.MustCompile(`(?i)\s*DEFAULT\s+('(?:[^'\\]|\\.|'')*'|\S+)`)
+
+func RemoveDefaultClause(field_rest string) string {
+	return strings.TrimSpace(g_defaultClauseRegExp.ReplaceAllString(field_rest, ""))
+}
+
+var g_varcharRegExp = regexp.MustCompile(`^varchar\((\d+)\)$`)
+
+func IsVarcharWidening(old_type, new_type string) bool {
+	old_match := g_varcharRegExp.FindStringSubmatch(old_type)
+	new_match := g_varcharRegExp.FindStringSubmatch(new_type)
+	if old_match == nil || new_match == nil {
+		return false
+	}
+
+	old_length, _ := strconv.Atoi(old_match[1])
+	new_length, _ := strconv.Atoi(new_match[1])
+	return new_length >= old_length
+}
+
+//按表大小和配置的吞吐量估算语句执行时间
+type PlanEstimator struct {
+	version          *ServerVersion
+	dest_table_stats map[string]*TableStats
+	inplace_rate     float64
+	copy_rate        float64
+}
+
+func NewPlanEstimator(version *ServerVersion, dest_table_stats map[string]*TableStats) *PlanEstimator {
+	estimator := &PlanEstimator{
+		version:          version,
+		dest_table_stats: dest_table_stats,
+		inplace_rate:     float64(GetConfigInt("estimate.inplace_mb_per_sec", 50)),
+		copy_rate:        float64(GetConfigInt("estimate.copy_mb_per_sec", 20)),
+	}
+	if estimator.inplace_rate <= 0 {
+		estimator.inplace_rate = 50
+	}
+	if estimator.copy_rate <= 0 {
+		estimator.copy_rate = 20
+	}
+	return estimator
+}
+
+func (this *PlanEstimator) Estimate(table_name string, changes []*SchemaChange) (*AlgorithmPrediction, time.Duration) {
+	prediction := PredictStatementAlgorithm(changes, this.version)
+	if !prediction.rebuild {
+		return prediction, 0
+	}
+
+	stats, ok := this.dest_table_stats[table_name]
+	if !ok {
+		return prediction, 0
+	}
+
+	size_mb := float64(stats.TotalLength()) / 1024 / 1024
+	rate := this.inplace_rate
+	if prediction.algorithm == ALGORITHM_COPY {
+		rate = this.copy_rate
+	}
+
+	return prediction, time.Duration(size_mb / rate * float64(time.Second))
+}
+
+//写在sql语句前面的注释
+func (this *PlanEstimator) Annotation(table_name string, changes []*SchemaChange) []string {
+	var lines []string
+
+	stats, ok := this.dest_table_stats[table_name]
+	if ok {
+		lines = append(lines, fmt.Sprintf("-- table %v: rows ~%v, data %v, index %v",
+			table_name, stats.table_rows, FormatSize(stats.data_length), FormatSize(stats.index_length)))
+	} else {
+		lines = append(lines, fmt.Sprintf("-- table %v: not exists in destination", table_name))
+	}
+
+	prediction, duration := this.Estimate(table_name, changes)
+	if prediction.algorithm != ALGORITHM_NONE {
+		lines = append(lines, fmt.Sprintf("-- predicted algorithm: %v (%v), estimated duration: %v",
+			prediction.algorithm, this.version.raw, FormatDuration(duration)))
+	}
+
+	return lines
+}
+
+func FormatSize(size int64) string {
+	switch {
+	case size >= 1024*1024*1024:
+		return fmt.Sprintf("%.1f GB", float64(size)/1024/1024/1024)
+	case size >= 1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(size)/1024/1024)
+	case size >= 1024:
+		return fmt.Sprintf("%.1f KB", float64(size)/1024)
+	}
+	return fmt.Sprintf("%v B", size)
+}
+
+func FormatDuration(duration time.Duration) string {
+	if duration < time.Second {
+		return "<1s"
+	}
+	return duration.Round(time.Second).String()
+}
+
+type StatementEstimate struct {
+	table_name string
+	algorithm  string
+	duration   time.Duration
+}
+
+//在人工确认之前输出预计总耗时和最耗时的几条语句
+func LogEstimateSummary(estimates []*StatementEstimate) {
+	if len(estimates) == 0 {
+		return
+	}
+
+	sort.Slice(estimates, func(i, j int) bool {
+		return estimates[i].duration > estimates[j].duration
+	})
+
+	var total time.Duration
+	algorithm_count := make(map[string]int)
+	for _, estimate := range estimates {
+		total += estimate.duration
+		algorithm_count[estimate.algorithm]++
+	}
+
+	LOG_INFO("共%v条语句，INSTANT: %v, INPLACE: %v, COPY: %v，预计总耗时: %v",
+		len(estimates), algorithm_count[ALGORITHM_INSTANT], algorithm_count[ALGORITHM_INPLACE],
+		algorithm_count[ALGORITHM_COPY], FormatDuration(total))
+
+	for i, estimate := range estimates {
+		if i >= 5 || estimate.duration == 0 {
+			break
+		}
+		LOG_INFO("  table %v: %v, estimated %v", estimate.table_name, estimate.algorithm, FormatDuration(estimate.duration))
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseServerVersion(t *testing.T) {
+	cases := []struct {
+		raw        string
+		major      int
+		minor      int
+		patch      int
+		is_mariadb bool
+	}{
+		{"8.0.32", 8, 0, 32, false},
+		{"5.7.44-log", 5, 7, 44, false},
+		{"10.6.12-MariaDB-0ubuntu0.22.04.1", 10, 6, 12, true},
+		{"unknown", 0, 0, 0, false},
+	}
+
+	for _, c := range cases {
+		version := ParseServerVersion(c.raw)
+		if version.major != c.major || version.minor != c.minor || version.patch != c.patch || version.is_mariadb != c.is_mariadb {
+			t.Errorf("ParseServerVersion(%q) = %v.%v.%v mariadb %v, want %v.%v.%v mariadb %v", c.raw,
+				version.major, version.minor, version.patch, version.is_mariadb, c.major, c.minor, c.patch, c.is_mariadb)
+		}
+	}
+}
+
+func TestPredictAlgorithm(t *testing.T) {
+	mysql56 := ParseServerVersion("5.6.51")
+	mysql57 := ParseServerVersion("5.7.44")
+	mysql80 := ParseServerVersion("8.0.20")
+	mysql8029 := ParseServerVersion("8.0.29")
+	mariadb := ParseServerVersion("10.3.2-MariaDB")
+	mysql55 := ParseServerVersion("5.5.62")
+
+	cases := []struct {
+		name      string
+		change    *SchemaChange
+		version   *ServerVersion
+		algorithm string
+		rebuild   bool
+	}{
+		{"create table", &SchemaChange{change_type: CHANGE_CREATE_TABLE}, mysql80, ALGORITHM_NONE, false},
+		{"add column 5.7", &SchemaChange{change_type: CHANGE_ADD_FIELD}, mysql57, ALGORITHM_INPLACE, true},
+		{"add column 8.0", &SchemaChange{change_type: CHANGE_ADD_FIELD}, mysql80, ALGORITHM_INSTANT, false},
+		{"add column mariadb", &SchemaChange{change_type: CHANGE_ADD_FIELD}, mariadb, ALGORITHM_INSTANT, false},
+		{"add column 5.5", &SchemaChange{change_type: CHANGE_ADD_FIELD}, mysql55, ALGORITHM_COPY, true},
+		{"drop column 8.0.20", &SchemaChange{change_type: CHANGE_DROP_FIELD}, mysql80, ALGORITHM_INPLACE, true},
+		{"drop column 8.0.29", &SchemaChange{change_type: CHANGE_DROP_FIELD}, mysql8029, ALGORITHM_INSTANT, false},
+		{"change default", &SchemaChange{change_type: CHANGE_MODIFY_FIELD, src_attr: "int(11) NOT NULL DEFAULT '1'", dest_attr: "int(11) NOT NULL DEFAULT '0'"}, mysql80, ALGORITHM_INSTANT, false},
+		{"change default 5.6", &SchemaChange{change_type: CHANGE_MODIFY_FIELD, src_attr: "int(11) DEFAULT '1'", dest_attr: "int(11) DEFAULT '0'"}, mysql56, ALGORITHM_INPLACE, false},
+		{"null to not null", &SchemaChange{change_type: CHANGE_MODIFY_FIELD, src_attr: "int(11) NOT NULL", dest_attr: "int(11)"}, mysql80, ALGORITHM_INPLACE, true},
+		{"varchar widening", &SchemaChange{change_type: CHANGE_MODIFY_FIELD, src_attr: "varchar(64)", dest_attr: "varchar(32)"}, mysql57, ALGORITHM_INPLACE, false},
+		{"varchar widening 5.6", &SchemaChange{change_type: CHANGE_MODIFY_FIELD, src_attr: "varchar(64)", dest_attr: "varchar(32)"}, mysql56, ALGORITHM_COPY, true},
+		{"type change", &SchemaChange{change_type: CHANGE_MODIFY_FIELD, src_attr: "bigint(20)", dest_attr: "int(11)"}, mysql80, ALGORITHM_COPY, true},
+		{"add index", &SchemaChange{change_type: CHANGE_ADD_INDEX}, mysql80, ALGORITHM_INPLACE, true},
+		{"drop index", &SchemaChange{change_type: CHANGE_DROP_INDEX}, mysql80, ALGORITHM_INPLACE, false},
+	}
+
+	for _, c := range cases {
+		prediction := PredictAlgorithm(c.change, c.version)
+		if prediction.algorithm != c.algorithm || prediction.rebuild != c.rebuild {
+			t.Errorf("%v: PredictAlgorithm = %v rebuild %v, want %v rebuild %v", c.name,
+				prediction.algorithm, prediction.rebuild, c.algorithm, c.rebuild)
+		}
+	}
+}
+
+func TestPredictStatementAlgorithm(t *testing.T) {
+	changes := []*SchemaChange{
+		{change_type: CHANGE_ADD_FIELD},
+		{change_type: CHANGE_DROP_INDEX},
+	}
+
+	prediction := PredictStatementAlgorithm(changes, ParseServerVersion("8.0.32"))
+	if prediction.algorithm != ALGORITHM_INPLACE || prediction.rebuild {
+		t.Errorf("PredictStatementAlgorithm = %v rebuild %v, want %v rebuild false", prediction.algorithm, prediction.rebuild, ALGORITHM_INPLACE)
+	}
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	PREFLIGHT_REPORT_FILE string = "PREFLIGHT_FAILURES.txt"
+
+	MDL_INSTRUMENT string = "wait/lock/metadata/sql/mdl"
+)
+
+var g_createTableRegExp = regexp.MustCompile("(?i)^\\s*CREATE\\s+TABLE\\s+(?:IF\\s+NOT\\s+EXISTS\\s+)?(`?[^`\\s(]+`?)")
+var g_renameTableRegExp = regexp.MustCompile("(?i)^\\s*RENAME\\s+TABLE\\s+(`?[^`\\s]+`?)\\s+TO\\s+((?:`[^`]+`\\.)?`?[^`\\s;]+`?)")
+var g_indexClauseRegExp = regexp.MustCompile("(?i)\\b(INDEX|KEY)\\b")
+var g_foreignKeyRegExp = regexp.MustCompile("(?i)\\bFOREIGN\\s+KEY\\b")
+
+//一个语句需要的权限
+type RequiredPrivilege struct {
+	schema    string
+	table     string
+	privilege string
+}
+
+//语句涉及的表和执行需要的权限
+type PreflightStatement struct {
+	sql_file   string
+	statement  string
+	table_name string
+	required   []*RequiredPrivilege
+}
+
+type PreflightFailure struct {
+	statement *PreflightStatement
+	reason    string
+}
+
+//当前账号在information_schema中可以看到的权限，不包括MySQL 8.0的角色
+type AccountPrivileges struct {
+	grantee string
+	global  map[string]bool
+	schemas map[string]map[string]bool
+	tables  map[string]map[string]bool
+}
+
+//执行sql文件之前对目标库的检查：
+//1. 账号对涉及的表有ALTER/DROP/CREATE/INDEX/REFERENCES等权限
+//2. 服务器不是read_only/super_read_only
+//3. 没有长事务持有目标表的元数据锁，需要performance_schema开启了元数据锁的instrument
+//4. 重建的表都不超过preflight.max_rebuild_mb，这是人工设置的阈值，服务器无法通过sql告诉我们磁盘可用空间
+type Preflight struct {
+	dbAdaptor       *MysqlDBAdaptor
+	dbname          string
+	max_trx_seconds int64
+	max_rebuild_mb  int64
+	statements      []*PreflightStatement
+	failures        []*PreflightFailure
+}
+
+func NewPreflight(dbAdaptor *MysqlDBAdaptor) *Preflight {
+	return &Preflight{
+		dbAdaptor:       dbAdaptor,
+		max_trx_seconds: GetConfigInt("preflight.max_trx_seconds", 60),
+		max_rebuild_mb:  GetConfigInt("preflight.max_rebuild_mb", 0),
+	}
+}
+
+//检查data_dir下所有待执行的语句，有失败时生成报告并返回错误
+func RunPreflight(data_dir string) error {
+	preflight := NewPreflight(g_destMysqlAdaptor)
+
+	err := preflight.Run(data_dir)
+	if err != nil {
+		return err
+	}
+
+	if len(preflight.failures) == 0 {
+		LOG_INFO("preflight checks passed, %v statements", len(preflight.statements))
+		return nil
+	}
+
+	report_file, err := WritePreflightReport(data_dir, preflight.failures)
+	if err != nil {
+		return err
+	}
+	LOG_ERROR("%v项预检失败，详见%v", len(preflight.failures), report_file)
+	return fmt.Errorf("preflight checks failed")
+}
+
+func (this *Preflight) Run(data_dir string) error {
+	sql_files, err := ListSqlFiles(data_dir)
+	if err != nil {
+		return err
+	}
+
+	for _, sql_file := range sql_files {
+		sqls, err := ReadSqlStatements(sql_file)
+		if err != nil {
+			return err
+		}
+		for _, sql := range sqls {
+			this.statements = append(this.statements, this.ParseStatement(sql_file, sql))
+		}
+	}
+
+	if len(this.statements) == 0 {
+		return nil
+	}
+
+	row, err := this.dbAdaptor.QueryRow("SELECT IFNULL(DATABASE(), '')")
+	if err != nil {
+		return err
+	}
+	err = row.Scan(&this.dbname)
+	if err != nil {
+		return err
+	}
+
+	checks := []func() error{
+		this.CheckReadOnly,
+		this.CheckPrivileges,
+		this.CheckMetadataLocks,
+		this.CheckRebuildSize,
+	}
+	for _, check := range checks {
+		err = check()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *Preflight) Fail(statement *PreflightStatement, format string, args ...interface{}) {
+	this.failures = append(this.failures, &PreflightFailure{statement, fmt.Sprintf(format, args...)})
+}
+
+//解析语句涉及的表和需要的权限
+func (this *Preflight) ParseStatement(sql_file string, sql string) *PreflightStatement {
+	statement := &PreflightStatement{
+		sql_file:  sql_file,
+		statement: sql,
+	}
+
+	require := func(schema string, table string, privileges ...string) {
+		for _, privilege := range privileges {
+			statement.required = append(statement.required, &RequiredPrivilege{schema, table, privilege})
+		}
+	}
+
+	if match := g_createTableRegExp.FindStringSubmatch(sql); match != nil {
+		statement.table_name = strings.Trim(match[1], "`")
+		require("", statement.table_name, "CREATE")
+	} else if match := g_dropTableRegExp.FindStringSubmatch(sql); match != nil {
+		statement.table_name = strings.Trim(match[1], "`")
+		require("", statement.table_name, "DROP")
+	} else if match := g_renameTableRegExp.FindStringSubmatch(sql); match != nil {
+		statement.table_name = strings.Trim(match[1], "`")
+		require("", statement.table_name, "ALTER", "DROP")
+		schema, table := SplitQualifiedName(match[2])
+		require(schema, table, "CREATE", "INSERT")
+	} else if IsAlterTableSql(sql) {
+		statement.table_name = GetAlterTableName(sql)
+		require("", statement.table_name, "ALTER", "CREATE", "INSERT")
+		if g_indexClauseRegExp.MatchString(sql) {
+			require("", statement.table_name, "INDEX")
+		}
+		//在线变更被拒绝时改用影子表迁移，需要创建触发器
+		if g_onlineDDLPolicy != nil && g_onlineDDLPolicy.on_reject == "shadow" {
+			require("", statement.table_name, "TRIGGER", "SELECT")
+		}
+	}
+
+	if g_foreignKeyRegExp.MatchString(sql) {
+		require("", statement.table_name, "REFERENCES")
+	}
+
+	return statement
+}
+
+//`db`.`t` => "db", "t"
+func SplitQualifiedName(name string) (string, string) {
+	idx := strings.Index(name, "`.`")
+	if idx == -1 {
+		return "", strings.Trim(name, "`")
+	}
+	return strings.Trim(name[:idx], "`"), strings.Trim(name[idx+2:], "`")
+}
+
+func (this *Preflight) CheckReadOnly() error {
+	for _, variable := range []string{"read_only", "super_read_only"} {
+		row, err := this.dbAdaptor.QueryRow(fmt.Sprintf("SELECT @@%v", variable))
+		if err != nil {
+			return err
+		}
+
+		//MariaDB和5.7之前的MySQL没有super_read_only
+		var value int
+		if row.Scan(&value) != nil || value == 0 {
+			continue
+		}
+
+		for _, statement := range this.statements {
+			this.Fail(statement, "server is %v", variable)
+		}
+		return nil
+	}
+
+	return nil
+}
+
+func (this *Preflight) CheckPrivileges() error {
+	if !GetConfigBool("preflight.check_privileges", true) {
+		return nil
+	}
+
+	privileges, err := QueryAccountPrivileges(this.dbAdaptor)
+	if err != nil {
+		return err
+	}
+
+	for _, statement := range this.statements {
+		var missing []string
+		for _, required := range statement.required {
+			schema := required.schema
+			if schema == "" {
+				schema = this.dbname
+			}
+			if !privileges.Has(schema, required.table, required.privilege) {
+				missing = append(missing, fmt.Sprintf("%v on %v.%v", required.privilege, schema, required.table))
+			}
+		}
+		if len(missing) > 0 {
+			this.Fail(statement, "%v lacks privileges: %v", privileges.grantee, strings.Join(missing, ", "))
+		}
+	}
+
+	return nil
+}
+
+//metadata_locks表只有在wait/lock/metadata/sql/mdl开启时才有数据，没开启时查询成功但永远为空
+func (this *Preflight) IsMdlInstrumentEnabled() (bool, error) {
+	row, err := this.dbAdaptor.QueryRowFormat("SELECT ENABLED FROM performance_schema.setup_instruments WHERE NAME = ?", MDL_INSTRUMENT)
+	if err != nil {
+		return false, err
+	}
+	var enabled string
+	err = row.Scan(&enabled)
+	if err != nil {
+		return false, err
+	}
+	return strings.ToUpper(enabled) == "YES", nil
+}
+
+//持有目标表元数据锁的长事务会阻塞DDL，DDL又会阻塞后续所有访问该表的查询
+func (this *Preflight) CheckMetadataLocks() error {
+	enabled, err := this.IsMdlInstrumentEnabled()
+	if err != nil || !enabled {
+		if GetConfigBool("preflight.require_mdl_instrument", false) {
+			for _, statement := range this.statements {
+				this.Fail(statement, "instrument %v is not enabled, metadata locks can not be checked", MDL_INSTRUMENT)
+			}
+			return nil
+		}
+		LOG_WARN("instrument %v is not enabled (%v), check long transactions only", MDL_INSTRUMENT, err)
+		return this.CheckLongTransactions()
+	}
+
+	rows, err := this.dbAdaptor.QueryFormat("SELECT ml.OBJECT_NAME, trx.trx_mysql_thread_id, TIMESTAMPDIFF(SECOND, trx.trx_started, NOW()) "+
+		"FROM performance_schema.metadata_locks ml "+
+		"JOIN performance_schema.threads th ON th.THREAD_ID = ml.OWNER_THREAD_ID "+
+		"JOIN information_schema.INNODB_TRX trx ON trx.trx_mysql_thread_id = th.PROCESSLIST_ID "+
+		"WHERE ml.OBJECT_TYPE = 'TABLE' AND ml.OBJECT_SCHEMA = DATABASE() AND ml.LOCK_STATUS = 'GRANTED' "+
+		"AND th.PROCESSLIST_ID <> CONNECTION_ID() AND trx.trx_started < NOW() - INTERVAL ? SECOND", this.max_trx_seconds)
+	if err != nil {
+		//performance_schema未开启时只能看到长事务，无法知道涉及哪些表
+		LOG_WARN("query metadata locks error: %v, check long transactions only", err)
+		return this.CheckLongTransactions()
+	}
+	defer rows.Close()
+
+	holders := make(map[string][]string)
+	for rows.Next() {
+		var table_name string
+		var thread_id, seconds int64
+		err = rows.Scan(&table_name, &thread_id, &seconds)
+		if err != nil {
+			return err
+		}
+		holders[table_name] = append(holders[table_name], fmt.Sprintf("thread %v (transaction running %vs)", thread_id, seconds))
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, statement := range this.statements {
+		if threads, ok := holders[statement.table_name]; ok {
+			this.Fail(statement, "metadata lock on %v held by %v", statement.table_name, strings.Join(threads, ", "))
+		}
+	}
+
+	return nil
+}
+
+func (this *Preflight) CheckLongTransactions() error {
+	rows, err := this.dbAdaptor.QueryFormat("SELECT trx_mysql_thread_id, TIMESTAMPDIFF(SECOND, trx_started, NOW()) FROM information_schema.INNODB_TRX "+
+		"WHERE trx_mysql_thread_id <> CONNECTION_ID() AND trx_started < NOW() - INTERVAL ? SECOND", this.max_trx_seconds)
+	if err != nil {
+		LOG_WARN("query long transactions error: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var thread_id, seconds int64
+		err = rows.Scan(&thread_id, &seconds)
+		if err != nil {
+			return err
+		}
+		LOG_WARN("thread %v has a transaction running for %vs, it may block the ddl", thread_id, seconds)
+	}
+
+	return rows.Err()
+}
+
+//重建表需要一份表大小的临时空间，没有指定ALGORITHM=INSTANT的ALTER都按重建计算
+//阈值由人工按数据目录所在磁盘的可用空间设置，这里只比较表的大小
+func (this *Preflight) CheckRebuildSize() error {
+	if this.max_rebuild_mb <= 0 {
+		return nil
+	}
+
+	table_stats, err := QueryTableStats(this.dbAdaptor)
+	if err != nil {
+		return err
+	}
+
+	max_rebuild := this.max_rebuild_mb * 1024 * 1024
+	for _, statement := range this.statements {
+		if !IsAlterTableSql(statement.statement) || GetOnlineAlgorithm(statement.statement) == ALGORITHM_INSTANT {
+			continue
+		}
+		stats, ok := table_stats[statement.table_name]
+		if !ok {
+			continue
+		}
+		if stats.TotalLength() > max_rebuild {
+			this.Fail(statement, "rebuilding %v needs about %v, more than preflight.max_rebuild_mb %v",
+				statement.table_name, FormatSize(stats.TotalLength()), FormatSize(max_rebuild))
+		}
+	}
+
+	return nil
+}
+
+func QueryAccountPrivileges(dbAdaptor *MysqlDBAdaptor) (*AccountPrivileges, error) {
+	row, err := dbAdaptor.QueryRow("SELECT CURRENT_USER()")
+	if err != nil {
+		return nil, err
+	}
+	var current_user string
+	err = row.Scan(&current_user)
+	if err != nil {
+		return nil, err
+	}
+
+	//information_schema中的GRANTEE格式为 'user'@'host'
+	privileges := &AccountPrivileges{
+		global:  make(map[string]bool),
+		schemas: make(map[string]map[string]bool),
+		tables:  make(map[string]map[string]bool),
+	}
+	idx := strings.LastIndex(current_user, "@")
+	if idx == -1 {
+		privileges.grantee = fmt.Sprintf("'%v'@'%%'", current_user)
+	} else {
+		privileges.grantee = fmt.Sprintf("'%v'@'%v'", current_user[:idx], current_user[idx+1:])
+	}
+
+	rows, err := dbAdaptor.QueryFormat("SELECT PRIVILEGE_TYPE FROM information_schema.USER_PRIVILEGES WHERE GRANTEE = ?", privileges.grantee)
+	if err != nil {
+		return nil, err
+	}
+	global, err := ScanStrings(rows)
+	if err != nil {
+		return nil, err
+	}
+	for _, privilege := range global {
+		privileges.global[privilege] = true
+	}
+
+	rows, err = dbAdaptor.QueryFormat("SELECT TABLE_SCHEMA, PRIVILEGE_TYPE FROM information_schema.SCHEMA_PRIVILEGES WHERE GRANTEE = ?", privileges.grantee)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var schema, privilege string
+		err = rows.Scan(&schema, &privilege)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if privileges.schemas[schema] == nil {
+			privileges.schemas[schema] = make(map[string]bool)
+		}
+		privileges.schemas[schema][privilege] = true
+	}
+	rows.Close()
+
+	rows, err = dbAdaptor.QueryFormat("SELECT TABLE_SCHEMA, TABLE_NAME, PRIVILEGE_TYPE FROM information_schema.TABLE_PRIVILEGES WHERE GRANTEE = ?", privileges.grantee)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var schema, table, privilege string
+		err = rows.Scan(&schema, &table, &privilege)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		key := schema + "." + table
+		if privileges.tables[key] == nil {
+			privileges.tables[key] = make(map[string]bool)
+		}
+		privileges.tables[key][privilege] = true
+	}
+	rows.Close()
+
+	return privileges, nil
+}
+
+func (this *AccountPrivileges) Has(schema string, table string, privilege string) bool {
+	if this.global[privilege] {
+		return true
+	}
+
+	//库级权限的库名可以带LIKE通配符
+	for pattern, schema_privileges := range this.schemas {
+		if schema_privileges[privilege] && MatchSchemaPattern(pattern, schema) {
+			return true
+		}
+	}
+
+	return this.tables[schema+"."+table][privilege]
+}
+
+//GRANT中库名的通配符：%匹配任意字符串，_匹配单个字符，\_和\%匹配字面值
+func MatchSchemaPattern(pattern string, schema string) bool {
+	var expr []string
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			expr = append(expr, regexp.QuoteMeta(string(pattern[i])))
+		case c == '%':
+			expr = append(expr, ".*")
+		case c == '_':
+			expr = append(expr, ".")
+		default:
+			expr = append(expr, regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	matched, _ := regexp.MatchString("^"+strings.Join(expr, "")+"$", schema)
+	return matched
+}
+
+//把预检失败写到data_dir下的报告文件中，并返回报告路径
+func WritePreflightReport(data_dir string, failures []*PreflightFailure) (string, error) {
+	filename := filepath.Join(data_dir, PREFLIGHT_REPORT_FILE)
+
+	f, err := os.Create(filename)
+	if err != nil {
+		LOG_ERROR("create %v file error: %v", filename, err)
+		return "", err
+	}
+	defer f.Close()
+
+	fmt.Fprintf(f, "以下语句没有通过预检，所有sql文件都没有执行:\n\n")
+	for _, failure := range failures {
+		fmt.Fprintf(f, "%v: %v\n  %v\n\n", filepath.Base(failure.statement.sql_file), failure.reason, failure.statement.statement)
+	}
+
+	return filename, nil
+}
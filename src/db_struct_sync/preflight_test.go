@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestMatchSchemaPattern(t *testing.T) {
+	cases := []struct {
+		pattern string
+		schema  string
+		matched bool
+	}{
+		{"shop", "shop", true},
+		{"shop", "shop2", false},
+		{"shop", "SHOP", false},
+		{"%", "anything", true},
+		{"%", "", true},
+		{"shop%", "shop_test", true},
+		{"shop%", "myshop", false},
+		{"%_test", "shop_test", true},
+		{"shop_", "shop1", true},
+		{"shop_", "shop", false},
+		{"shop_", "shop12", false},
+		{"shop\\_test", "shop_test", true},
+		{"shop\\_test", "shopxtest", false},
+		{"100\\%", "100%", true},
+		{"100\\%", "1000", false},
+		{"a.b", "a.b", true},
+		{"a.b", "axb", false},
+		{"db(1)", "db(1)", true},
+		{"shop\\", "shop\\", true},
+	}
+
+	for _, c := range cases {
+		if got := MatchSchemaPattern(c.pattern, c.schema); got != c.matched {
+			t.Errorf("MatchSchemaPattern(%q, %q) = %v, want %v", c.pattern, c.schema, got, c.matched)
+		}
+	}
+}
+
+func TestSplitQualifiedName(t *testing.T) {
+	cases := []struct {
+		name   string
+		schema string
+		table  string
+	}{
+		{"`db`.`t`", "db", "t"},
+		{"`t`", "", "t"},
+		{"t", "", "t"},
+		{"`trash`.`_trash_20240101000000_orders`", "trash", "_trash_20240101000000_orders"},
+		{"`my.db`.`t`", "my.db", "t"},
+		{"`db`.`t.x`", "db", "t.x"},
+	}
+
+	for _, c := range cases {
+		schema, table := SplitQualifiedName(c.name)
+		if schema != c.schema || table != c.table {
+			t.Errorf("SplitQualifiedName(%q) = %q, %q, want %q, %q", c.name, schema, table, c.schema, c.table)
+		}
+	}
+}
+
+func TestPreflightParseStatement(t *testing.T) {
+	defer func(policy *OnlineDDLPolicy) { g_onlineDDLPolicy = policy }(g_onlineDDLPolicy)
+
+	cases := []struct {
+		name       string
+		sql        string
+		shadow     bool
+		table_name string
+		required   []string
+	}{
+		{"create table", "CREATE TABLE `orders` (\n  `id` int(11) NOT NULL\n);", false, "orders", []string{".orders:CREATE"}},
+		{"create table if not exists", "create table if not exists orders(`id` int);", false, "orders", []string{".orders:CREATE"}},
+		{"drop table", "DROP TABLE `orders`;", false, "orders", []string{".orders:DROP"}},
+		{"drop table if exists", "DROP TABLE IF EXISTS orders;", false, "orders", []string{".orders:DROP"}},
+		{"rename to trash", "RENAME TABLE `orders` TO `_trash_1_orders`;", false, "orders",
+			[]string{".orders:ALTER", ".orders:DROP", "._trash_1_orders:CREATE", "._trash_1_orders:INSERT"}},
+		{"rename to trash db", "RENAME TABLE `orders` TO `trash`.`_trash_1_orders`;", false, "orders",
+			[]string{".orders:ALTER", ".orders:DROP", "trash._trash_1_orders:CREATE", "trash._trash_1_orders:INSERT"}},
+		{"add column", "ALTER TABLE `orders` ADD `note` varchar(32);", false, "orders", []string{".orders:ALTER", ".orders:CREATE", ".orders:INSERT"}},
+		{"add index", "ALTER TABLE orders ADD INDEX `idx_day` (`day`);", false, "orders",
+			[]string{".orders:ALTER", ".orders:CREATE", ".orders:INSERT", ".orders:INDEX"}},
+		{"shadow migration", "ALTER TABLE `orders` DROP `note`;", true, "orders",
+			[]string{".orders:ALTER", ".orders:CREATE", ".orders:INSERT", ".orders:TRIGGER", ".orders:SELECT"}},
+		{"foreign key", "ALTER TABLE `items` ADD CONSTRAINT `fk` FOREIGN KEY (`oid`) REFERENCES `orders` (`id`);", false, "items",
+			[]string{".items:ALTER", ".items:CREATE", ".items:INSERT", ".items:INDEX", ".items:REFERENCES"}},
+		{"other statement", "SET NAMES utf8mb4;", false, "", nil},
+	}
+
+	preflight := &Preflight{}
+	for _, c := range cases {
+		g_onlineDDLPolicy = nil
+		if c.shadow {
+			g_onlineDDLPolicy = &OnlineDDLPolicy{on_reject: "shadow"}
+		}
+
+		statement := preflight.ParseStatement("orders.sql", c.sql)
+		if statement.table_name != c.table_name {
+			t.Errorf("%v: table_name = %q, want %q", c.name, statement.table_name, c.table_name)
+		}
+
+		var required []string
+		for _, privilege := range statement.required {
+			required = append(required, fmt.Sprintf("%v.%v:%v", privilege.schema, privilege.table, privilege.privilege))
+		}
+		if !reflect.DeepEqual(required, c.required) {
+			t.Errorf("%v: required = %v, want %v", c.name, required, c.required)
+		}
+	}
+}
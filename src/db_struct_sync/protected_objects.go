@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	MANUAL_HANDLING_FILE string = "MANUAL_HANDLING.txt"
+)
+
+//受保护的表和字段，无论源库怎么变都不会自动修改
+//表的模式匹配表名，字段的模式匹配"表名.字段名"
+type ProtectedObjects struct {
+	tables  []string
+	columns []string
+}
+
+func NewProtectedObjects() *ProtectedObjects {
+	return &ProtectedObjects{
+		tables:  GetConfigList("protect.tables"),
+		columns: GetConfigList("protect.columns"),
+	}
+}
+
+func (this *ProtectedObjects) IsTableProtected(table_name string) bool {
+	return MatchAnyPattern(this.tables, table_name)
+}
+
+func (this *ProtectedObjects) IsColumnProtected(table_name string, column_name string) bool {
+	return MatchAnyPattern(this.columns, fmt.Sprintf("%v.%v", table_name, strings.Trim(column_name, "`")))
+}
+
+//变更是否涉及受保护的对象，索引变更涉及受保护的字段时也算
+func (this *ProtectedObjects) IsProtected(change *SchemaChange) bool {
+	if this.IsTableProtected(change.table_name) {
+		return true
+	}
+
+	switch change.change_type {
+	case CHANGE_ADD_FIELD, CHANGE_DROP_FIELD, CHANGE_MODIFY_FIELD:
+		return this.IsColumnProtected(change.table_name, change.object_name)
+	case CHANGE_ADD_INDEX, CHANGE_DROP_INDEX, CHANGE_MODIFY_INDEX:
+		for _, key_attr := range []string{change.src_attr, change.dest_attr} {
+			_, key_columns := SplitKeyAttr(key_attr)
+			for _, column := range ParseKeyColumns(key_columns) {
+				if strings.HasPrefix(column, "LEFT(") {
+					column = strings.TrimPrefix(column, "LEFT(")
+					column = column[:strings.LastIndex(column, ",")]
+				}
+				if this.IsColumnProtected(change.table_name, column) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+//把涉及受保护对象的变更从列表中去掉，返回剩下的变更和被去掉的变更
+func (this *ProtectedObjects) Filter(table_changes_list []*TableChanges) ([]*TableChanges, []*SchemaChange) {
+	if len(this.tables) == 0 && len(this.columns) == 0 {
+		return table_changes_list, nil
+	}
+
+	var kept_list []*TableChanges
+	var excluded []*SchemaChange
+
+	for _, table_changes := range table_changes_list {
+		kept := NewTableChanges(table_changes.table_name)
+		for _, change := range table_changes.changes {
+			if this.IsProtected(change) {
+				excluded = append(excluded, change)
+			} else {
+				kept.changes = append(kept.changes, change)
+			}
+		}
+		if !kept.IsEmpty() {
+			kept_list = append(kept_list, kept)
+		}
+	}
+
+	return kept_list, excluded
+}
+
+//把需要人工处理的变更写到data_dir下的报告文件中，不会被执行，并返回报告路径
+func WriteManualHandlingReport(data_dir string, src_tmp_dir string, excluded []*SchemaChange) (string, error) {
+	filename := filepath.Join(data_dir, MANUAL_HANDLING_FILE)
+
+	f, err := os.Create(filename)
+	if err != nil {
+		LOG_ERROR("create %v file error: %v", filename, err)
+		return "", err
+	}
+	defer f.Close()
+
+	fmt.Fprintf(f, "以下变更涉及受保护的表或字段(protect.tables/protect.columns)，没有写入sql文件，需要人工处理:\n\n")
+	for _, change := range excluded {
+		fmt.Fprintf(f, "%v\n", change)
+
+		if change.change_type == CHANGE_CREATE_TABLE {
+			fmt.Fprintf(f, "  see %v\n\n", filepath.Join(src_tmp_dir, change.table_name+".sql"))
+			continue
+		}
+
+		table_changes := NewTableChanges(change.table_name)
+		table_changes.changes = append(table_changes.changes, change)
+		for _, statement := range table_changes.Statements(false) {
+			fmt.Fprintf(f, "  %v\n", strings.Replace(statement.sql, "\n", "\n  ", -1))
+		}
+		fmt.Fprintf(f, "\n")
+	}
+
+	return filename, nil
+}
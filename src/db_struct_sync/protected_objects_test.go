@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestProtectedObjectsIsProtected(t *testing.T) {
+	protected := &ProtectedObjects{
+		tables:  []string{"billing_*", "re:^audit_"},
+		columns: []string{"users.password", "*.created_at"},
+	}
+
+	cases := []struct {
+		name      string
+		change    *SchemaChange
+		protected bool
+	}{
+		{"protected table", &SchemaChange{change_type: CHANGE_ADD_FIELD, table_name: "billing_2024", object_name: "`a`"}, true},
+		{"protected table by regexp", &SchemaChange{change_type: CHANGE_DROP_TABLE, table_name: "audit_log"}, true},
+		{"other table", &SchemaChange{change_type: CHANGE_DROP_TABLE, table_name: "orders"}, false},
+		{"protected column", &SchemaChange{change_type: CHANGE_MODIFY_FIELD, table_name: "users", object_name: "`password`"}, true},
+		{"protected column in any table", &SchemaChange{change_type: CHANGE_DROP_FIELD, table_name: "orders", object_name: "`created_at`"}, true},
+		{"other column", &SchemaChange{change_type: CHANGE_DROP_FIELD, table_name: "users", object_name: "`name`"}, false},
+		{"index on protected column", &SchemaChange{change_type: CHANGE_ADD_INDEX, table_name: "users", object_name: "`idx_pw`", src_attr: "(`name`,`password`)"}, true},
+		{"old index on protected column", &SchemaChange{change_type: CHANGE_DROP_INDEX, table_name: "orders", object_name: "`idx_c`", dest_attr: "(`created_at`)"}, true},
+		{"prefix index on protected column", &SchemaChange{change_type: CHANGE_ADD_INDEX, table_name: "users", object_name: "`idx_pw`", src_attr: "UNIQUE (`password`(10))"}, true},
+		{"index on other columns", &SchemaChange{change_type: CHANGE_ADD_INDEX, table_name: "users", object_name: "`idx_name`", src_attr: "(`name`)"}, false},
+	}
+
+	for _, c := range cases {
+		if got := protected.IsProtected(c.change); got != c.protected {
+			t.Errorf("%v: IsProtected(%v) = %v, want %v", c.name, c.change, got, c.protected)
+		}
+	}
+}
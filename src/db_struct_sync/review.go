@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	//被取消的语句以注释的形式保留在sql文件中，执行时会被忽略
+	DISABLED_PREFIX string = "-- [disabled] "
+
+	REVIEW_COLUMN_WIDTH int = 60
+)
+
+//--review: 确认之前逐个表检查并选择要执行的语句
+var g_review bool
+
+//sql文件中的一条语句以及它前面的注释
+type ReviewStatement struct {
+	comments []string
+	lines    []string
+	enabled  bool
+}
+
+func (this *ReviewStatement) Risk() string {
+	for _, comment := range this.comments {
+		if strings.HasPrefix(comment, "-- risk: ") {
+			return strings.TrimPrefix(comment, "-- risk: ")
+		}
+	}
+	return ""
+}
+
+func (this *ReviewStatement) Render() []string {
+	lines := append([]string{}, this.comments...)
+	for _, line := range this.lines {
+		if this.enabled {
+			lines = append(lines, line)
+		} else {
+			lines = append(lines, DISABLED_PREFIX+line)
+		}
+	}
+	return lines
+}
+
+type ReviewTable struct {
+	table_name string
+	sql_file   string
+	statements []*ReviewStatement
+	trailing   []string
+	modified   bool
+}
+
+//把sql文件拆成语句，取消过的语句仍然识别为语句
+func ParseReviewTable(sql_file string) (*ReviewTable, error) {
+	content, err := ioutil.ReadFile(sql_file)
+	if err != nil {
+		LOG_ERROR("read %v error: %v", sql_file, err)
+		return nil, err
+	}
+
+	table := &ReviewTable{
+		table_name: strings.TrimSuffix(filepath.Base(sql_file), ".sql"),
+		sql_file:   sql_file,
+	}
+
+	current := &ReviewStatement{enabled: true}
+	for _, line := range strings.Split(strings.TrimRight(string(content), "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+
+		disabled := strings.HasPrefix(trimmed, DISABLED_PREFIX)
+		if disabled {
+			line = strings.TrimPrefix(trimmed, DISABLED_PREFIX)
+			trimmed = strings.TrimSpace(line)
+			current.enabled = false
+		} else if strings.HasPrefix(trimmed, "--") || trimmed == "" {
+			if len(current.lines) == 0 {
+				current.comments = append(current.comments, line)
+				continue
+			}
+		}
+
+		current.lines = append(current.lines, line)
+		if strings.HasSuffix(trimmed, ";") {
+			table.statements = append(table.statements, current)
+			current = &ReviewStatement{enabled: true}
+		}
+	}
+	table.trailing = append(current.comments, current.lines...)
+
+	return table, nil
+}
+
+func (this *ReviewTable) Save() error {
+	var lines []string
+	for _, statement := range this.statements {
+		lines = append(lines, statement.Render()...)
+	}
+	lines = append(lines, this.trailing...)
+
+	err := ioutil.WriteFile(this.sql_file, []byte(strings.Join(lines, "\n")+"\n"), 0666)
+	if err != nil {
+		LOG_ERROR("write %v error: %v", this.sql_file, err)
+		return err
+	}
+	return nil
+}
+
+//被取消的语句不会执行，对应的回滚语句也要取消，否则回滚时会撤销没有发生的变更
+//回滚语句只要撤销的语句中有一条执行，就保留
+func (this *ReviewTable) UpdateRollback(data_dir string) error {
+	rollback_file := filepath.Join(data_dir, ROLLBACK_DIR, this.table_name+".sql")
+	if _, err := os.Stat(rollback_file); os.IsNotExist(err) {
+		return nil
+	}
+
+	rollback, err := ParseReviewTable(rollback_file)
+	if err != nil {
+		return err
+	}
+
+	for _, statement := range rollback.statements {
+		indexes := ParseRollbackOf(statement.comments)
+		if indexes == nil {
+			LOG_WARN("statements of %v changed in review, check %v before using it", this.table_name, rollback_file)
+			return nil
+		}
+
+		statement.enabled = false
+		for _, index := range indexes {
+			if index >= 1 && index <= len(this.statements) && this.statements[index-1].enabled {
+				statement.enabled = true
+			}
+		}
+	}
+
+	return rollback.Save()
+}
+
+func (this *ReviewTable) EnabledCount() int {
+	count := 0
+	for _, statement := range this.statements {
+		if statement.enabled {
+			count++
+		}
+	}
+	return count
+}
+
+func (this *ReviewTable) MaxRisk() string {
+	max_level := -1
+	for _, statement := range this.statements {
+		risk := strings.SplitN(statement.Risk(), ",", 2)[0]
+		if level, ok := RiskLevel(risk); ok && level > max_level {
+			max_level = level
+		}
+	}
+	if max_level < 0 {
+		return ""
+	}
+	return g_riskNames[max_level]
+}
+
+func RiskLevel(risk string) (int, bool) {
+	for level, name := range g_riskNames {
+		if name == risk {
+			return level, true
+		}
+	}
+	return RISK_SAFE, false
+}
+
+//交互式检查data_dir下的sql文件：逐个表对比源库和目标库的定义，按语句选择是否执行
+//返回false表示放弃执行
+func ReviewSqlFiles(data_dir string) (bool, error) {
+	if !IsTerminal(os.Stdin) {
+		return false, fmt.Errorf("stdin is not a terminal, cannot review interactively")
+	}
+
+	sql_files, err := ListSqlFiles(data_dir)
+	if err != nil {
+		return false, err
+	}
+
+	var tables []*ReviewTable
+	for _, sql_file := range sql_files {
+		table, err := ParseReviewTable(sql_file)
+		if err != nil {
+			return false, err
+		}
+		tables = append(tables, table)
+	}
+
+	if len(tables) == 0 {
+		fmt.Printf("no sql files to review in %v\n", data_dir)
+		return true, nil
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Printf("\n%-4v %-40v %-12v %v\n", "#", "table", "risk", "statements")
+		for i, table := range tables {
+			fmt.Printf("%-4v %-40v %-12v %v/%v\n", i+1, table.table_name, table.MaxRisk(), table.EnabledCount(), len(table.statements))
+		}
+		fmt.Printf("\n输入编号查看表，a: 保存并继续，q: 放弃执行 > ")
+
+		input, err := ReadInput(reader)
+		if err != nil {
+			return false, err
+		}
+
+		switch input {
+		case "a":
+			for _, table := range tables {
+				if !table.modified {
+					continue
+				}
+				err = table.Save()
+				if err != nil {
+					return false, err
+				}
+				err = table.UpdateRollback(data_dir)
+				if err != nil {
+					return false, err
+				}
+			}
+			return true, nil
+		case "q":
+			return false, nil
+		}
+
+		idx, err := strconv.Atoi(input)
+		if err != nil || idx < 1 || idx > len(tables) {
+			continue
+		}
+
+		err = ReviewTableStatements(reader, data_dir, tables[idx-1])
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+func ReviewTableStatements(reader *bufio.Reader, data_dir string, table *ReviewTable) error {
+	for {
+		fmt.Printf("\n==== %v ====\n", table.table_name)
+		PrintSideBySide(
+			ReadCreateTableLines(filepath.Join(data_dir, "src_mysql_tmp", table.table_name+".sql")),
+			ReadCreateTableLines(filepath.Join(data_dir, "dest_mysql_tmp", table.table_name+".sql")))
+
+		fmt.Printf("\n")
+		for i, statement := range table.statements {
+			mark := "x"
+			if !statement.enabled {
+				mark = " "
+			}
+			fmt.Printf("[%v] %v. ", mark, i+1)
+			if risk := statement.Risk(); risk != "" {
+				fmt.Printf("(risk: %v)", risk)
+			}
+			fmt.Printf("\n")
+			for _, line := range statement.lines {
+				fmt.Printf("       %v\n", line)
+			}
+		}
+		fmt.Printf("\n输入编号切换是否执行，b: 返回 > ")
+
+		input, err := ReadInput(reader)
+		if err != nil {
+			return err
+		}
+		if input == "b" {
+			return nil
+		}
+
+		idx, err := strconv.Atoi(input)
+		if err != nil || idx < 1 || idx > len(table.statements) {
+			continue
+		}
+		table.statements[idx-1].enabled = !table.statements[idx-1].enabled
+		table.modified = true
+	}
+}
+
+func ReadInput(reader *bufio.Reader) (string, error) {
+	input, err := reader.ReadString('\n')
+	if err != nil && strings.TrimSpace(input) == "" {
+		return "", err
+	}
+	return strings.TrimSpace(input), nil
+}
+
+func ReadCreateTableLines(filename string) []string {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil
+	}
+	return strings.Split(strings.TrimSpace(string(content)), "\n")
+}
+
+//建表语句中一行的对齐键：字段和索引按名字对齐，其他行按内容对齐
+func CreateTableLineKey(line string) string {
+	line = strings.TrimSuffix(strings.TrimSpace(line), ",")
+	if strings.HasPrefix(line, "`") {
+		if idx := strings.Index(line, " "); idx != -1 {
+			return line[:idx]
+		}
+	}
+	if IsKeyLine(line) {
+		idx := strings.Index(line, "KEY ")
+		items := strings.SplitN(line[idx+len("KEY "):], " ", 2)
+		return "KEY " + items[0]
+	}
+	if strings.HasPrefix(line, "CREATE TABLE") {
+		return "CREATE TABLE"
+	}
+	if strings.HasPrefix(line, ")") {
+		return ")"
+	}
+	return line
+}
+
+//左边是源库，右边是目标库：~ 不同，+ 只在源库，- 只在目标库
+func PrintSideBySide(src_lines []string, dest_lines []string) {
+	dest_by_key := make(map[string]string)
+	for _, line := range dest_lines {
+		dest_by_key[CreateTableLineKey(line)] = line
+	}
+
+	fmt.Printf("  %-*v | %v\n", REVIEW_COLUMN_WIDTH, "source", "destination")
+
+	seen := make(map[string]bool)
+	for _, src_line := range src_lines {
+		key := CreateTableLineKey(src_line)
+		seen[key] = true
+
+		dest_line, ok := dest_by_key[key]
+		mark := " "
+		if !ok {
+			mark = "+"
+		} else if strings.TrimSuffix(strings.TrimSpace(src_line), ",") != strings.TrimSuffix(strings.TrimSpace(dest_line), ",") {
+			mark = "~"
+		}
+		PrintSideBySideLine(mark, src_line, dest_line)
+	}
+
+	for _, dest_line := range dest_lines {
+		if !seen[CreateTableLineKey(dest_line)] {
+			PrintSideBySideLine("-", "", dest_line)
+		}
+	}
+}
+
+func PrintSideBySideLine(mark string, left string, right string) {
+	fmt.Printf("%v %-*v | %v\n", mark, REVIEW_COLUMN_WIDTH, TruncateString(strings.TrimRight(left, " "), REVIEW_COLUMN_WIDTH), TruncateString(right, REVIEW_COLUMN_WIDTH))
+}
+
+func TruncateString(s string, width int) string {
+	runes := []rune(s)
+	if len(runes) <= width {
+		return s
+	}
+	return string(runes[:width-3]) + "..."
+}
+
+//单独的review命令：检查plan命令生成的计划，保存后计划的校验和改变，之前的审批全部失效，apply执行的是检查后的计划
+func RunReview(plan_file string) error {
+	if plan_file == "" {
+		return fmt.Errorf("plan file not specified")
+	}
+
+	plan, err := LoadPlan(plan_file)
+	if err != nil {
+		return err
+	}
+
+	//在临时目录中展开计划，不影响data_dir下的文件
+	review_dir, err := ioutil.TempDir("", "db_struct_sync_review")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(review_dir)
+
+	err = plan.Materialize(review_dir)
+	if err != nil {
+		return err
+	}
+
+	accepted, err := ReviewSqlFiles(review_dir)
+	if err != nil {
+		return err
+	}
+	if !accepted {
+		LOG_INFO("review discarded, plan %v unchanged", plan_file)
+		return nil
+	}
+
+	files, err := LoadPlanFiles(review_dir, ".sql")
+	if err != nil {
+		return err
+	}
+	if StatementsHash(files) == plan.StatementsHash() {
+		LOG_INFO("no statement changed, plan %v unchanged", plan_file)
+		return nil
+	}
+
+	//回滚脚本在review时已经按取消的语句更新
+	rollback, err := LoadPlanFiles(filepath.Join(review_dir, ROLLBACK_DIR), ".sql")
+	if err != nil {
+		return err
+	}
+
+	old_checksum := plan.Checksum
+	plan.Files = files
+	plan.Rollback = rollback
+	plan.Checksum = plan.ComputeChecksum()
+
+	err = SavePlan(plan, plan_file)
+	if err != nil {
+		return err
+	}
+
+	LOG_INFO("plan %v reviewed: %v statements enabled, checksum %v => %v", plan_file, plan.StatementCount(), old_checksum, plan.Checksum)
+	if approvals, _ := LoadApprovals(plan_file); len(approvals) > 0 {
+		LOG_WARN("%v existing approvals of %v no longer match the plan and must be given again", len(approvals), plan_file)
+	}
+
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReviewTableToggle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "review_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := "-- risk: safe\nALTER TABLE `t` ADD `a` int;\n-- risk: destructive\nALTER TABLE `t`\n  DROP `b`;\n"
+
+	cases := []struct {
+		name    string
+		disable []int
+		expect  []string
+	}{
+		{"keep all", nil, []string{"ALTER TABLE `t` ADD `a` int", "ALTER TABLE `t` DROP `b`"}},
+		{"disable multi-line statement", []int{1}, []string{"ALTER TABLE `t` ADD `a` int"}},
+		{"disable all", []int{0, 1}, nil},
+	}
+
+	for _, c := range cases {
+		sql_file := filepath.Join(dir, "t.sql")
+		if err := ioutil.WriteFile(sql_file, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		table, err := ParseReviewTable(sql_file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(table.statements) != 2 {
+			t.Fatalf("%v: got %v statements, want 2", c.name, len(table.statements))
+		}
+		for _, i := range c.disable {
+			table.statements[i].enabled = false
+		}
+		if err := table.Save(); err != nil {
+			t.Fatal(err)
+		}
+
+		statements, err := ReadSqlStatements(sql_file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(statements) == 0 && len(c.expect) == 0 {
+			statements = nil
+		}
+		if !reflect.DeepEqual(statements, c.expect) {
+			t.Errorf("%v: statements = %q, want %q", c.name, statements, c.expect)
+		}
+
+		//重新解析后取消的状态保留，可以再次启用
+		reparsed, err := ParseReviewTable(sql_file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reparsed.EnabledCount() != 2-len(c.disable) {
+			t.Errorf("%v: enabled = %v, want %v", c.name, reparsed.EnabledCount(), 2-len(c.disable))
+		}
+	}
+}
+
+func TestReviewTableUpdateRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "review_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	table_changes := NewTableChanges("t")
+	table_changes.Add(CHANGE_ADD_FIELD, "`a`", "int(11) DEFAULT NULL", "")
+	table_changes.Add(CHANGE_DROP_FIELD, "`b`", "", "int(11) DEFAULT NULL")
+	table_changes.Add(CHANGE_MODIFY_INDEX, "`k`", "UNIQUE (`a`)", "(`a`)")
+
+	//sql文件中的语句: 1.DROP INDEX k 2.DROP b 3.ADD a 4.ADD UNIQUE INDEX k
+	var lines []string
+	for _, statement := range table_changes.Statements(false) {
+		lines = append(lines, statement.sql)
+	}
+	sql_file := filepath.Join(dir, "t.sql")
+	rollback_file := filepath.Join(dir, ROLLBACK_DIR, "t.sql")
+
+	cases := []struct {
+		name    string
+		disable []int
+		expect  []string
+	}{
+		{"keep all", nil, []string{"ALTER TABLE t DROP INDEX `k`", "ALTER TABLE t DROP `a`", "ALTER TABLE t ADD `b` int(11) DEFAULT NULL", "ALTER TABLE t ADD INDEX `k` (`a`)"}},
+		{"disable drop column", []int{1}, []string{"ALTER TABLE t DROP INDEX `k`", "ALTER TABLE t DROP `a`", "ALTER TABLE t ADD INDEX `k` (`a`)"}},
+		{"disable half of modify index", []int{3}, []string{"ALTER TABLE t DROP INDEX `k`", "ALTER TABLE t DROP `a`", "ALTER TABLE t ADD `b` int(11) DEFAULT NULL", "ALTER TABLE t ADD INDEX `k` (`a`)"}},
+		{"disable modify index", []int{0, 3}, []string{"ALTER TABLE t DROP `a`", "ALTER TABLE t ADD `b` int(11) DEFAULT NULL"}},
+		{"disable all", []int{0, 1, 2, 3}, nil},
+	}
+
+	for _, c := range cases {
+		if err := ioutil.WriteFile(sql_file, []byte(strings.Join(lines, "\n")+"\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		writer, err := NewRollbackWriter(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Write(table_changes, false); err != nil {
+			t.Fatal(err)
+		}
+
+		table, err := ParseReviewTable(sql_file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, i := range c.disable {
+			table.statements[i].enabled = false
+		}
+		if err := table.Save(); err != nil {
+			t.Fatal(err)
+		}
+		if err := table.UpdateRollback(dir); err != nil {
+			t.Fatal(err)
+		}
+
+		statements, err := ReadSqlStatements(rollback_file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(statements) == 0 && len(c.expect) == 0 {
+			statements = nil
+		}
+		if !reflect.DeepEqual(statements, c.expect) {
+			t.Errorf("%v: rollback statements = %q, want %q", c.name, statements, c.expect)
+		}
+	}
+}
+
+func TestParseRollbackOf(t *testing.T) {
+	cases := []struct {
+		comments []string
+		indexes  []int
+	}{
+		{[]string{"-- rollback of t.sql", RollbackOfComment([]int{4, 1, 4})}, []int{1, 4}},
+		{[]string{"  -- rollback of statement 2"}, []int{2}},
+		{[]string{"-- rollback of t.sql"}, nil},
+		{[]string{"-- rollback of statement x"}, nil},
+	}
+
+	for _, c := range cases {
+		if got := ParseRollbackOf(c.comments); !reflect.DeepEqual(got, c.indexes) {
+			t.Errorf("ParseRollbackOf(%q) = %v, want %v", c.comments, got, c.indexes)
+		}
+	}
+}
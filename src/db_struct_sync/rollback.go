@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	ROLLBACK_DIR string = "rollback"
+
+	//回滚语句前注明它撤销的是sql文件中的第几条语句，review取消语句时据此取消对应的回滚语句
+	ROLLBACK_OF_PREFIX string = "-- rollback of statement "
+)
+
+var g_inverseChangeTypes = map[int]int{
+	CHANGE_CREATE_TABLE: CHANGE_DROP_TABLE,
+	CHANGE_DROP_TABLE:   CHANGE_CREATE_TABLE,
+	CHANGE_ADD_FIELD:    CHANGE_DROP_FIELD,
+	CHANGE_DROP_FIELD:   CHANGE_ADD_FIELD,
+	CHANGE_MODIFY_FIELD: CHANGE_MODIFY_FIELD,
+	CHANGE_ADD_INDEX:    CHANGE_DROP_INDEX,
+	CHANGE_DROP_INDEX:   CHANGE_ADD_INDEX,
+	CHANGE_MODIFY_INDEX: CHANGE_MODIFY_INDEX,
+}
+
+//撤销该变更的变更：类型取反，源库和目标库的定义互换
+func (this *SchemaChange) Inverse() *SchemaChange {
+	return &SchemaChange{
+		change_type: g_inverseChangeTypes[this.change_type],
+		table_name:  this.table_name,
+		object_name: this.object_name,
+		src_attr:    this.dest_attr,
+		dest_attr:   this.src_attr,
+	}
+}
+
+//为data_dir下的每个sql文件在data_dir/rollback下生成同名的回滚脚本
+type RollbackWriter struct {
+	rollback_dir   string
+	dest_tmp_dir   string
+	backup_enabled bool
+	backup_dir     string
+}
+
+func NewRollbackWriter(data_dir string) (*RollbackWriter, error) {
+	writer := &RollbackWriter{
+		rollback_dir:   filepath.Join(data_dir, ROLLBACK_DIR),
+		dest_tmp_dir:   filepath.Join(data_dir, "dest_mysql_tmp"),
+		backup_enabled: GetConfigBool("backup.enable", true),
+		backup_dir:     GetBackupDir(data_dir),
+	}
+
+	//清掉上一次生成的回滚脚本，避免和本次的sql文件对不上
+	err := os.RemoveAll(writer.rollback_dir)
+	if err != nil {
+		LOG_ERROR("remove rollback dir %v error: %v", writer.rollback_dir, err)
+		return nil, err
+	}
+	err = os.MkdirAll(writer.rollback_dir, os.ModePerm)
+	if err != nil {
+		LOG_ERROR("create rollback dir %v error: %v", writer.rollback_dir, err)
+		return nil, err
+	}
+
+	return writer, nil
+}
+
+//数据无法通过DDL恢复时，提示从备份中恢复
+func (this *RollbackWriter) BackupNote(object string) string {
+	if !this.backup_enabled {
+		return fmt.Sprintf("-- %v的数据无法通过DDL恢复，backup.enable未开启，没有可用的备份", object)
+	}
+	return fmt.Sprintf("-- %v的数据无法通过DDL恢复，执行本脚本后用同步时生成的备份恢复: db_struct_sync restore %v/<执行时间>",
+		object, this.backup_dir)
+}
+
+func (this *RollbackWriter) Write(table_changes *TableChanges, combine bool) error {
+	table_name := table_changes.table_name
+
+	lines := []string{fmt.Sprintf("-- rollback of %v.sql", table_name)}
+
+	switch {
+	case table_changes.HasChange(CHANGE_CREATE_TABLE):
+		lines = append(lines, fmt.Sprintf("-- 同步后写入%v的数据会随表一起删除", table_name))
+		lines = append(lines, RollbackOfComment([]int{1}))
+		lines = append(lines, MakeDropTableSql(table_name))
+
+	case table_changes.HasChange(CHANGE_DROP_TABLE):
+		if trash_name, ok := TrashTableLocation(table_name); ok {
+			lines = append(lines, RollbackOfComment([]int{1}))
+			lines = append(lines, fmt.Sprintf("RENAME TABLE %v TO %v;", trash_name, QuoteName(table_name)))
+			break
+		}
+
+		//用目标库原来的表结构重建
+		content, err := ioutil.ReadFile(filepath.Join(this.dest_tmp_dir, table_name+".sql"))
+		if err != nil {
+			LOG_ERROR("read original definition of table %v error: %v", table_name, err)
+			return err
+		}
+		lines = append(lines, this.BackupNote("表"+table_name))
+		lines = append(lines, RollbackOfComment([]int{1}))
+		lines = append(lines, strings.TrimSuffix(strings.TrimSpace(string(content)), ";")+";")
+
+	default:
+		//每个变更在sql文件中对应的语句序号，修改索引不合并时对应两条语句
+		forward := make(map[*SchemaChange][]int)
+		for i, statement := range table_changes.Statements(combine) {
+			for _, change := range statement.changes {
+				forward[change] = append(forward[change], i+1)
+			}
+		}
+
+		inverse := NewTableChanges(table_name)
+		inverse_of := make(map[*SchemaChange]*SchemaChange)
+		for _, change := range table_changes.changes {
+			inverse_change := change.Inverse()
+			inverse_of[inverse_change] = change
+			inverse.changes = append(inverse.changes, inverse_change)
+
+			switch {
+			case change.change_type == CHANGE_DROP_FIELD:
+				lines = append(lines, this.BackupNote(fmt.Sprintf("字段%v.%v", table_name, change.object_name)))
+			case change.change_type == CHANGE_MODIFY_FIELD && len(change.issues) > 0:
+				lines = append(lines, fmt.Sprintf("-- 修改字段%v.%v时被截断或转换的数据无法恢复", table_name, change.object_name))
+			}
+		}
+
+		for _, statement := range inverse.Statements(combine) {
+			var indexes []int
+			for _, change := range statement.changes {
+				indexes = append(indexes, forward[inverse_of[change]]...)
+			}
+			lines = append(lines, RollbackOfComment(indexes))
+			lines = append(lines, statement.sql)
+		}
+	}
+
+	return CreateSqlFile(this.rollback_dir, table_name, strings.Join(lines, "\n"))
+}
+
+func RollbackOfComment(indexes []int) string {
+	sort.Ints(indexes)
+
+	var items []string
+	for i, index := range indexes {
+		if i > 0 && index == indexes[i-1] {
+			continue
+		}
+		items = append(items, strconv.Itoa(index))
+	}
+	return ROLLBACK_OF_PREFIX + strings.Join(items, ",")
+}
+
+//从回滚语句前的注释中读出它撤销的语句序号，没有时返回nil
+func ParseRollbackOf(comments []string) []int {
+	for _, comment := range comments {
+		comment = strings.TrimSpace(comment)
+		if !strings.HasPrefix(comment, ROLLBACK_OF_PREFIX) {
+			continue
+		}
+
+		var indexes []int
+		for _, item := range strings.Split(strings.TrimPrefix(comment, ROLLBACK_OF_PREFIX), ",") {
+			index, err := strconv.Atoi(strings.TrimSpace(item))
+			if err != nil {
+				return nil
+			}
+			indexes = append(indexes, index)
+		}
+		return indexes
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSchemaChangeInverse(t *testing.T) {
+	cases := []struct {
+		change_type  int
+		inverse_type int
+	}{
+		{CHANGE_CREATE_TABLE, CHANGE_DROP_TABLE},
+		{CHANGE_DROP_TABLE, CHANGE_CREATE_TABLE},
+		{CHANGE_ADD_FIELD, CHANGE_DROP_FIELD},
+		{CHANGE_DROP_FIELD, CHANGE_ADD_FIELD},
+		{CHANGE_MODIFY_FIELD, CHANGE_MODIFY_FIELD},
+		{CHANGE_ADD_INDEX, CHANGE_DROP_INDEX},
+		{CHANGE_DROP_INDEX, CHANGE_ADD_INDEX},
+		{CHANGE_MODIFY_INDEX, CHANGE_MODIFY_INDEX},
+	}
+
+	for _, c := range cases {
+		change := &SchemaChange{
+			change_type: c.change_type,
+			table_name:  "t",
+			object_name: "`x`",
+			src_attr:    "new",
+			dest_attr:   "old",
+			issues:      []*ValidationIssue{{description: "values out of range"}},
+		}
+
+		inverse := change.Inverse()
+		expect := &SchemaChange{
+			change_type: c.inverse_type,
+			table_name:  "t",
+			object_name: "`x`",
+			src_attr:    "old",
+			dest_attr:   "new",
+		}
+		if !reflect.DeepEqual(inverse, expect) {
+			t.Errorf("Inverse(%v) = %+v, want %+v", g_changeTypeNames[c.change_type], *inverse, *expect)
+		}
+
+		//撤销两次回到原来的变更
+		if twice := inverse.Inverse(); twice.change_type != c.change_type || twice.src_attr != "new" || twice.dest_attr != "old" {
+			t.Errorf("Inverse(Inverse(%v)) = %+v", g_changeTypeNames[c.change_type], *twice)
+		}
+	}
+}
+
+func TestRollbackWriterWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rollback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	WriteTestSchema(t, filepath.Join(dir, "dest_mysql_tmp"), map[string]string{
+		"t": "CREATE TABLE `t` (\n  `id` int(11) NOT NULL,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB;\n",
+	})
+
+	make_changes := func(change_type int, object_name string, src_attr string, dest_attr string) *TableChanges {
+		table_changes := NewTableChanges("t")
+		table_changes.Add(change_type, object_name, src_attr, dest_attr)
+		return table_changes
+	}
+
+	truncated := make_changes(CHANGE_MODIFY_FIELD, "`c`", "varchar(8)", "varchar(32)")
+	truncated.changes[0].issues = []*ValidationIssue{{description: "values longer than new type varchar(8)", count: 3}}
+
+	several := NewTableChanges("t")
+	several.Add(CHANGE_ADD_FIELD, "`a`", "int(11) DEFAULT NULL", "")
+	several.Add(CHANGE_DROP_INDEX, "`k`", "", "(`a`)")
+
+	cases := []struct {
+		name       string
+		config     string
+		changes    *TableChanges
+		combine    bool
+		statements []string
+		notes      []string
+	}{
+		{"create table", "", make_changes(CHANGE_CREATE_TABLE, "t", "", ""), true,
+			[]string{"DROP TABLE t"}, []string{"数据会随表一起删除"}},
+		{"drop table", "", make_changes(CHANGE_DROP_TABLE, "t", "", ""), true,
+			[]string{"CREATE TABLE `t` ( `id` int(11) NOT NULL, PRIMARY KEY (`id`) ) ENGINE=InnoDB"}, []string{"表t的数据无法通过DDL恢复", "restore"}},
+		{"drop table without backup", "backup.enable = false\n", make_changes(CHANGE_DROP_TABLE, "t", "", ""), true,
+			[]string{"CREATE TABLE `t` ( `id` int(11) NOT NULL, PRIMARY KEY (`id`) ) ENGINE=InnoDB"}, []string{"没有可用的备份"}},
+		{"soft-dropped table", "drop.mode = rename\n", make_changes(CHANGE_DROP_TABLE, "t", "", ""), true,
+			[]string{"RENAME TABLE `" + MakeTrashTableName("t", g_trashTime) + "` TO `t`"}, nil},
+		{"add column", "", make_changes(CHANGE_ADD_FIELD, "`a`", "int(11) DEFAULT NULL", ""), true,
+			[]string{"ALTER TABLE t DROP `a`"}, nil},
+		{"drop column", "", make_changes(CHANGE_DROP_FIELD, "`b`", "", "int(11) DEFAULT NULL"), true,
+			[]string{"ALTER TABLE t ADD `b` int(11) DEFAULT NULL"}, []string{"字段t.`b`的数据无法通过DDL恢复"}},
+		{"modify column", "", make_changes(CHANGE_MODIFY_FIELD, "`c`", "varchar(64)", "varchar(32)"), true,
+			[]string{"ALTER TABLE t MODIFY `c` varchar(32)"}, nil},
+		{"truncating modify column", "", truncated, true,
+			[]string{"ALTER TABLE t MODIFY `c` varchar(32)"}, []string{"字段t.`c`时被截断或转换的数据无法恢复"}},
+		{"add index", "", make_changes(CHANGE_ADD_INDEX, "`k`", "UNIQUE (`a`)", ""), true,
+			[]string{"ALTER TABLE t DROP INDEX `k`"}, nil},
+		{"drop index", "", make_changes(CHANGE_DROP_INDEX, "`k`", "", "(`a`,`b`)"), true,
+			[]string{"ALTER TABLE t ADD INDEX `k` (`a`,`b`)"}, nil},
+		{"modify index", "", make_changes(CHANGE_MODIFY_INDEX, "`k`", "UNIQUE (`a`)", "(`a`)"), true,
+			[]string{"ALTER TABLE t DROP INDEX `k`, ADD INDEX `k` (`a`)"}, []string{ROLLBACK_OF_PREFIX + "1"}},
+		{"modify index not combined", "", make_changes(CHANGE_MODIFY_INDEX, "`k`", "UNIQUE (`a`)", "(`a`)"), false,
+			[]string{"ALTER TABLE t DROP INDEX `k`", "ALTER TABLE t ADD INDEX `k` (`a`)"}, []string{ROLLBACK_OF_PREFIX + "1,2"}},
+		{"several changes combined", "", several, true,
+			[]string{"ALTER TABLE t DROP `a`, ADD INDEX `k` (`a`)"}, nil},
+		{"several changes not combined", "", several, false,
+			[]string{"ALTER TABLE t DROP `a`", "ALTER TABLE t ADD INDEX `k` (`a`)"}, []string{ROLLBACK_OF_PREFIX + "2\n", ROLLBACK_OF_PREFIX + "1\n"}},
+	}
+
+	for _, c := range cases {
+		restore := SetTestConfig(t, c.config)
+		writer, err := NewRollbackWriter(dir)
+		if err == nil {
+			err = writer.Write(c.changes, c.combine)
+		}
+		restore()
+		if err != nil {
+			t.Errorf("%v: Write error: %v", c.name, err)
+			continue
+		}
+
+		rollback_file := filepath.Join(dir, ROLLBACK_DIR, "t.sql")
+		statements, err := ReadSqlStatements(rollback_file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(statements, c.statements) {
+			t.Errorf("%v: rollback statements = %q, want %q", c.name, statements, c.statements)
+		}
+
+		content, _ := ioutil.ReadFile(rollback_file)
+		for _, note := range c.notes {
+			if !strings.Contains(string(content), note) {
+				t.Errorf("%v: rollback file does not contain %q:\n%v", c.name, note, string(content))
+			}
+		}
+	}
+
+	//目标库中没有原表结构时无法生成删除表的回滚
+	writer, err := NewRollbackWriter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := NewTableChanges("missing")
+	missing.Add(CHANGE_DROP_TABLE, "missing", "", "")
+	if err := writer.Write(missing, true); err == nil {
+		t.Errorf("Write of a dropped table without its definition should fail")
+	}
+}
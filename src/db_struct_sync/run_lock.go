@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+)
+
+const (
+	//持有者信息保存在目标库的这张表中，以工具前缀开头，拉取表结构时会被忽略
+	RUN_LOCK_TABLE string = "_dss_lock"
+
+	MYSQL_MAX_LOCK_NAME_LENGTH int = 64
+)
+
+//当前进程持有的目标库锁，执行语句前用它确认锁没有丢失
+var g_runLock *RunLock
+
+//目标库上的排他锁：用GET_LOCK在一个独占的连接上加锁，整个生成和执行过程都持有，
+//防止两个人同时对同一个目标库执行同步；进程退出时连接断开，锁会被服务器自动释放
+type RunLock struct {
+	conn *sql.Conn
+	name string
+
+	//保活：连接空闲超过wait_timeout会被服务器断开，锁也随之释放
+	mutex sync.Mutex
+	lost  error
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+type RunLockHolder struct {
+	host          string
+	user          string
+	pid           int64
+	command       string
+	start_time    string
+	connection_id int64
+}
+
+func (this *RunLockHolder) String() string {
+	return fmt.Sprintf("host=%v user=%v pid=%v command=%v since %v (connection %v)",
+		this.host, this.user, this.pid, this.command, this.start_time, this.connection_id)
+}
+
+//锁名默认为db_struct_sync.<目标库名>，可以用lock.name指定
+func GetRunLockName(dbAdaptor *MysqlDBAdaptor) (string, error) {
+	name := GetConfigString("lock.name", "")
+	if name == "" {
+		row, err := dbAdaptor.QueryRow("SELECT IFNULL(DATABASE(), '')")
+		if err != nil {
+			return "", err
+		}
+		var dbname string
+		err = row.Scan(&dbname)
+		if err != nil {
+			return "", err
+		}
+		name = "db_struct_sync." + dbname
+	}
+
+	if len(name) > MYSQL_MAX_LOCK_NAME_LENGTH {
+		name = name[:MYSQL_MAX_LOCK_NAME_LENGTH]
+	}
+	return name, nil
+}
+
+//保活的间隔，需要小于目标库的wait_timeout；0表示不保活
+func GetRunLockKeepalive() (time.Duration, error) {
+	seconds := GetConfigInt("lock.keepalive_seconds", 60)
+	if seconds < 0 {
+		return 0, fmt.Errorf("invalid lock.keepalive_seconds %v", seconds)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+//根据IS_USED_LOCK的结果判断锁是否仍由本连接持有
+func CheckRunLockOwner(name string, used_by sql.NullInt64, connection_id int64) error {
+	if !used_by.Valid {
+		return fmt.Errorf("destination lock %v is no longer held, the connection may have been dropped", name)
+	}
+	if used_by.Int64 != connection_id {
+		return fmt.Errorf("destination lock %v is held by connection %v instead of %v", name, used_by.Int64, connection_id)
+	}
+	return nil
+}
+
+func AcquireRunLock(dbAdaptor *MysqlDBAdaptor, command string) (*RunLock, error) {
+	name, err := GetRunLockName(dbAdaptor)
+	if err != nil {
+		return nil, err
+	}
+
+	keepalive, err := GetRunLockKeepalive()
+	if err != nil {
+		LOG_ERROR("%v", err)
+		return nil, err
+	}
+
+	conn, err := dbAdaptor.Conn()
+	if err != nil {
+		LOG_ERROR("get a dedicated connection for lock %v error: %v", name, err)
+		return nil, err
+	}
+
+	ctx := context.Background()
+	timeout := GetConfigInt("lock.timeout", 10)
+
+	var acquired sql.NullInt64
+	err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", name, timeout).Scan(&acquired)
+	if err != nil {
+		conn.Close()
+		LOG_ERROR("get lock %v error: %v", name, err)
+		return nil, err
+	}
+
+	if !acquired.Valid || acquired.Int64 != 1 {
+		conn.Close()
+		holder, _ := QueryRunLockHolder(dbAdaptor, name)
+		if holder != nil {
+			return nil, fmt.Errorf("destination is locked by another db_struct_sync: %v", holder)
+		}
+		return nil, fmt.Errorf("destination lock %v not acquired within %v seconds", name, timeout)
+	}
+
+	lock := &RunLock{
+		conn: conn,
+		name: name,
+	}
+
+	//持有者信息只用于status命令展示，写入失败不影响加锁
+	err = lock.SaveHolder(command)
+	if err != nil {
+		LOG_WARN("save holder of lock %v error: %v", name, err)
+	}
+
+	if keepalive > 0 {
+		lock.stop = make(chan struct{})
+		lock.done = make(chan struct{})
+		go lock.KeepAlive(keepalive)
+	}
+	g_runLock = lock
+
+	LOG_INFO("acquired destination lock %v", name)
+
+	return lock, nil
+}
+
+//定期在加锁的连接上确认锁仍然持有，同时防止连接因空闲被断开
+func (this *RunLock) KeepAlive(interval time.Duration) {
+	defer close(this.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-this.stop:
+			return
+		case <-ticker.C:
+			err := this.Check()
+			if err != nil {
+				LOG_ERROR("keepalive of lock %v error: %v", this.name, err)
+				return
+			}
+		}
+	}
+}
+
+//确认锁仍由本连接持有；锁丢失后其他进程可能已经开始操作目标库，不能再继续执行
+func (this *RunLock) Check() error {
+	if this == nil {
+		return nil
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.lost != nil {
+		return this.lost
+	}
+	if this.conn == nil {
+		return fmt.Errorf("destination lock %v already released", this.name)
+	}
+
+	var used_by sql.NullInt64
+	var connection_id int64
+	err := this.conn.QueryRowContext(context.Background(), "SELECT IS_USED_LOCK(?), CONNECTION_ID()", this.name).Scan(&used_by, &connection_id)
+	if err != nil {
+		this.lost = fmt.Errorf("check destination lock %v error: %v", this.name, err)
+		return this.lost
+	}
+
+	this.lost = CheckRunLockOwner(this.name, used_by, connection_id)
+	return this.lost
+}
+
+func (this *RunLock) SaveHolder(command string) error {
+	ctx := context.Background()
+
+	_, err := this.conn.ExecContext(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %v ("+
+		"`lock_name` varchar(64) NOT NULL, "+
+		"`host` varchar(255) NOT NULL DEFAULT '', "+
+		"`user` varchar(255) NOT NULL DEFAULT '', "+
+		"`pid` bigint(20) NOT NULL DEFAULT '0', "+
+		"`command` varchar(64) NOT NULL DEFAULT '', "+
+		"`start_time` datetime NOT NULL, "+
+		"`connection_id` bigint(20) NOT NULL DEFAULT '0', "+
+		"PRIMARY KEY (`lock_name`))", QuoteName(RUN_LOCK_TABLE)))
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	username := ""
+	if current, err := user.Current(); err == nil {
+		username = current.Username
+	}
+
+	_, err = this.conn.ExecContext(ctx, fmt.Sprintf("REPLACE INTO %v (`lock_name`, `host`, `user`, `pid`, `command`, `start_time`, `connection_id`) "+
+		"VALUES (?, ?, ?, ?, ?, ?, CONNECTION_ID())", QuoteName(RUN_LOCK_TABLE)),
+		this.name, hostname, username, os.Getpid(), command, time.Now().Format("2006-01-02 15:04:05"))
+	return err
+}
+
+func (this *RunLock) Release() {
+	if this == nil || this.conn == nil {
+		return
+	}
+
+	if this.stop != nil {
+		close(this.stop)
+		<-this.done
+		this.stop = nil
+	}
+	if g_runLock == this {
+		g_runLock = nil
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	ctx := context.Background()
+
+	_, err := this.conn.ExecContext(ctx, fmt.Sprintf("DELETE FROM %v WHERE `lock_name` = ? AND `connection_id` = CONNECTION_ID()", QuoteName(RUN_LOCK_TABLE)), this.name)
+	if err != nil {
+		LOG_WARN("remove holder of lock %v error: %v", this.name, err)
+	}
+
+	var released sql.NullInt64
+	err = this.conn.QueryRowContext(ctx, "SELECT RELEASE_LOCK(?)", this.name).Scan(&released)
+	if err != nil {
+		LOG_WARN("release lock %v error: %v", this.name, err)
+	}
+
+	this.conn.Close()
+	this.conn = nil
+
+	LOG_INFO("released destination lock %v", this.name)
+}
+
+//读取持有者信息，没有记录时返回nil
+func QueryRunLockHolder(dbAdaptor *MysqlDBAdaptor, name string) (*RunLockHolder, error) {
+	exists, err := TableExists(dbAdaptor, RUN_LOCK_TABLE)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	row, err := dbAdaptor.QueryRowFormat(fmt.Sprintf("SELECT `host`, `user`, `pid`, `command`, `start_time`, `connection_id` FROM %v WHERE `lock_name` = ?",
+		QuoteName(RUN_LOCK_TABLE)), name)
+	if err != nil {
+		return nil, err
+	}
+
+	holder := &RunLockHolder{}
+	err = row.Scan(&holder.host, &holder.user, &holder.pid, &holder.command, &holder.start_time, &holder.connection_id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return holder, nil
+}
+
+//输出目标库上锁的状态
+func RunStatus() error {
+	var err error
+
+	g_destMysqlAdaptor, err = OpenMysqlDBAdaptor("mysql_dest", false)
+	if err != nil {
+		return err
+	}
+	defer g_destMysqlAdaptor.Release()
+
+	name, err := GetRunLockName(g_destMysqlAdaptor)
+	if err != nil {
+		return err
+	}
+
+	row, err := g_destMysqlAdaptor.QueryRowFormat("SELECT IS_USED_LOCK(?)", name)
+	if err != nil {
+		return err
+	}
+	var connection_id sql.NullInt64
+	err = row.Scan(&connection_id)
+	if err != nil {
+		LOG_ERROR("query lock %v error: %v", name, err)
+		return err
+	}
+
+	holder, err := QueryRunLockHolder(g_destMysqlAdaptor, name)
+	if err != nil {
+		LOG_ERROR("query holder of lock %v error: %v", name, err)
+		return err
+	}
+
+	if !connection_id.Valid {
+		fmt.Printf("lock %v is free\n", name)
+		if holder != nil {
+			fmt.Printf("stale holder record left by an aborted run: %v\n", holder)
+		}
+	} else if holder != nil && holder.connection_id == connection_id.Int64 {
+		fmt.Printf("lock %v is held by %v\n", name, holder)
+	} else {
+		fmt.Printf("lock %v is held by connection %v, holder information unavailable\n", name, connection_id.Int64)
+	}
+
+	//expand之后还没有执行的contract变更
+	pending, err := QueryPendingContract(g_destMysqlAdaptor)
+	if err != nil {
+		LOG_ERROR("query pending contract changes error: %v", err)
+		return err
+	}
+	if len(pending) > 0 {
+		fmt.Printf("%v contract changes pending:\n", len(pending))
+		for _, change := range pending {
+			fmt.Printf("  %v (plan %v, since %v)\n", change.change_desc, change.plan_checksum, change.created)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetRunLockName(t *testing.T) {
+	cases := []struct {
+		name   string
+		config string
+		expect string
+	}{
+		{"configured", "lock.name = db_struct_sync.shop\n", "db_struct_sync.shop"},
+		{"truncated", "lock.name = " + strings.Repeat("x", 70) + "\n", strings.Repeat("x", MYSQL_MAX_LOCK_NAME_LENGTH)},
+	}
+
+	for _, c := range cases {
+		restore := SetTestConfig(t, c.config)
+		//配置了lock.name时不需要查询目标库
+		name, err := GetRunLockName(nil)
+		restore()
+
+		if err != nil || name != c.expect {
+			t.Errorf("%v: GetRunLockName = %q, %v, want %q", c.name, name, err, c.expect)
+		}
+	}
+}
+
+func TestGetRunLockKeepalive(t *testing.T) {
+	cases := []struct {
+		config string
+		ok     bool
+		expect time.Duration
+	}{
+		{"", true, 60 * time.Second},
+		{"lock.keepalive_seconds = 30\n", true, 30 * time.Second},
+		{"lock.keepalive_seconds = 0\n", true, 0},
+		{"lock.keepalive_seconds = -1\n", false, 0},
+	}
+
+	for _, c := range cases {
+		restore := SetTestConfig(t, c.config)
+		interval, err := GetRunLockKeepalive()
+		restore()
+
+		if (err == nil) != c.ok {
+			t.Errorf("GetRunLockKeepalive with %q error = %v, want ok=%v", c.config, err, c.ok)
+			continue
+		}
+		if interval != c.expect {
+			t.Errorf("GetRunLockKeepalive with %q = %v, want %v", c.config, interval, c.expect)
+		}
+	}
+}
+
+func TestCheckRunLockOwner(t *testing.T) {
+	cases := []struct {
+		name          string
+		used_by       sql.NullInt64
+		connection_id int64
+		ok            bool
+	}{
+		{"held by this connection", sql.NullInt64{Int64: 12, Valid: true}, 12, true},
+		{"released", sql.NullInt64{}, 12, false},
+		{"held by another connection", sql.NullInt64{Int64: 13, Valid: true}, 12, false},
+	}
+
+	for _, c := range cases {
+		err := CheckRunLockOwner("db_struct_sync.shop", c.used_by, c.connection_id)
+		if (err == nil) != c.ok {
+			t.Errorf("%v: CheckRunLockOwner error = %v, want ok=%v", c.name, err, c.ok)
+		}
+	}
+}
+
+func TestRunLockCheck(t *testing.T) {
+	//没有持有锁的命令不需要检查
+	var lock *RunLock
+	if err := lock.Check(); err != nil {
+		t.Errorf("Check of nil lock error: %v", err)
+	}
+
+	released := &RunLock{name: "db_struct_sync.shop"}
+	if err := released.Check(); err == nil {
+		t.Errorf("Check of released lock should fail")
+	}
+}
+
+func TestRunLockHolderString(t *testing.T) {
+	holder := &RunLockHolder{
+		host:          "deploy01",
+		user:          "alice",
+		pid:           4242,
+		command:       "apply",
+		start_time:    "2024-01-01 10:00:00",
+		connection_id: 17,
+	}
+
+	expect := "host=deploy01 user=alice pid=4242 command=apply since 2024-01-01 10:00:00 (connection 17)"
+	if got := holder.String(); got != expect {
+		t.Errorf("String() = %q, want %q", got, expect)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	CHANGE_CREATE_TABLE int = iota
+	CHANGE_DROP_TABLE
+	CHANGE_ADD_FIELD
+	CHANGE_DROP_FIELD
+	CHANGE_MODIFY_FIELD
+	CHANGE_ADD_INDEX
+	CHANGE_DROP_INDEX
+	CHANGE_MODIFY_INDEX
+)
+
+//一条结构变更，src_attr是源库中的定义，dest_attr是目标库中的定义
+type SchemaChange struct {
+	change_type int
+	table_name  string
+	object_name string
+	src_attr    string
+	dest_attr   string
+	issues      []*ValidationIssue
+}
+
+//一张表的全部结构变更
+type TableChanges struct {
+	table_name string
+	changes    []*SchemaChange
+}
+
+func NewTableChanges(table_name string) *TableChanges {
+	return &TableChanges{
+		table_name: table_name,
+	}
+}
+
+func (this *TableChanges) Add(change_type int, object_name, src_attr, dest_attr string) {
+	this.changes = append(this.changes, &SchemaChange{
+		change_type: change_type,
+		table_name:  this.table_name,
+		object_name: object_name,
+		src_attr:    src_attr,
+		dest_attr:   dest_attr,
+	})
+}
+
+func (this *TableChanges) IsEmpty() bool {
+	return len(this.changes) == 0
+}
+
+func (this *TableChanges) HasChange(change_type int) bool {
+	for _, change := range this.changes {
+		if change.change_type == change_type {
+			return true
+		}
+	}
+	return false
+}
+
+//ALTER TABLE中的一个子句，以及它所对应的变更
+type AlterClause struct {
+	change *SchemaChange
+	clause string
+}
+
+//一条sql语句，以及它所包含的变更
+type TableStatement struct {
+	sql     string
+	changes []*SchemaChange
+}
+
+//生成该表的sql语句
+//combine为true时，所有的字段和索引变更合并成一条ALTER TABLE语句，表只需要重建一次；
+//否则每个变更单独生成一条语句，便于调试
+func (this *TableChanges) Statements(combine bool) []*TableStatement {
+	if this.HasChange(CHANGE_DROP_TABLE) {
+		return []*TableStatement{
+			&TableStatement{
+				sql:     MakeDropTableSql(this.table_name),
+				changes: this.changes,
+			},
+		}
+	}
+
+	alter_clauses := this.AlterClauses()
+	if len(alter_clauses) == 0 {
+		return nil
+	}
+
+	var statements []*TableStatement
+	if combine {
+		statements = append(statements, &TableStatement{
+			sql:     MakeAlterTableSql(this.table_name, ClauseStrings(alter_clauses)),
+			changes: ClauseChanges(alter_clauses),
+		})
+	} else {
+		for _, alter_clause := range alter_clauses {
+			statements = append(statements, &TableStatement{
+				sql:     MakeAlterTableSql(this.table_name, []string{alter_clause.clause}),
+				changes: []*SchemaChange{alter_clause.change},
+			})
+		}
+	}
+
+	return statements
+}
+
+//按照合法的顺序生成ALTER TABLE子句：
+//先删除索引，再删除字段，然后添加、修改字段，最后添加索引
+//这样被删除字段上的索引先被删掉，新添加的索引也能引用到新添加的字段
+func (this *TableChanges) AlterClauses() []*AlterClause {
+	var drop_indexes, drop_fields, add_fields, modify_fields, add_indexes []*SchemaChange
+
+	for _, change := range this.changes {
+		switch change.change_type {
+		case CHANGE_ADD_FIELD:
+			add_fields = append(add_fields, change)
+		case CHANGE_DROP_FIELD:
+			drop_fields = append(drop_fields, change)
+		case CHANGE_MODIFY_FIELD:
+			modify_fields = append(modify_fields, change)
+		case CHANGE_ADD_INDEX:
+			add_indexes = append(add_indexes, change)
+		case CHANGE_DROP_INDEX:
+			drop_indexes = append(drop_indexes, change)
+		case CHANGE_MODIFY_INDEX:
+			//修改索引 = 删除旧索引 + 添加新索引
+			drop_indexes = append(drop_indexes, change)
+			add_indexes = append(add_indexes, change)
+		}
+	}
+
+	var alter_clauses []*AlterClause
+	for _, change := range SortChanges(drop_indexes) {
+		alter_clauses = append(alter_clauses, &AlterClause{change, MakeRemoveIndexClause(change.object_name)})
+	}
+	for _, change := range SortChanges(drop_fields) {
+		alter_clauses = append(alter_clauses, &AlterClause{change, MakeRemoveFieldClause(change.object_name)})
+	}
+	for _, change := range SortChanges(add_fields) {
+		alter_clauses = append(alter_clauses, &AlterClause{change, MakeAddFieldClause(change.object_name, change.src_attr)})
+	}
+	for _, change := range SortChanges(modify_fields) {
+		alter_clauses = append(alter_clauses, &AlterClause{change, MakeModifyFieldClause(change.object_name, change.src_attr)})
+	}
+	for _, change := range SortChanges(add_indexes) {
+		alter_clauses = append(alter_clauses, &AlterClause{change, MakeAddIndexClause(change.object_name, change.src_attr)})
+	}
+
+	return alter_clauses
+}
+
+func ClauseStrings(alter_clauses []*AlterClause) []string {
+	var clauses []string
+	for _, alter_clause := range alter_clauses {
+		clauses = append(clauses, alter_clause.clause)
+	}
+	return clauses
+}
+
+//子句对应的变更，修改索引对应两个子句，只保留一次
+func ClauseChanges(alter_clauses []*AlterClause) []*SchemaChange {
+	var changes []*SchemaChange
+	seen := make(map[*SchemaChange]bool)
+	for _, alter_clause := range alter_clauses {
+		if seen[alter_clause.change] {
+			continue
+		}
+		seen[alter_clause.change] = true
+		changes = append(changes, alter_clause.change)
+	}
+	return changes
+}
+
+func SortChanges(changes []*SchemaChange) []*SchemaChange {
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].object_name < changes[j].object_name
+	})
+	return changes
+}
+
+func SortTableChanges(table_changes_list []*TableChanges) []*TableChanges {
+	sort.Slice(table_changes_list, func(i, j int) bool {
+		return table_changes_list[i].table_name < table_changes_list[j].table_name
+	})
+	return table_changes_list
+}
+
+//根据drop.mode生成删除表的语句：
+//drop: 直接DROP TABLE
+//rename: 在原库中改名为_trash_<时间戳>_<表名>
+//trash_db: 改名并移动到drop.trash_db指定的库中
+func MakeDropTableSql(table_name string) string {
+	if trash_name, ok := TrashTableLocation(table_name); ok {
+		return fmt.Sprintf("RENAME TABLE %v TO %v;", QuoteName(table_name), trash_name)
+	}
+	return fmt.Sprintf("DROP TABLE %v;", table_name)
+}
+
+func MakeAlterTableSql(table_name string, clauses []string) string {
+	if len(clauses) == 1 {
+		return fmt.Sprintf("ALTER TABLE %v %v;", table_name, clauses[0])
+	}
+	return fmt.Sprintf("ALTER TABLE %v\n  %v;", table_name, strings.Join(clauses, ",\n  "))
+}
+
+func MakeAddFieldClause(field_name string, field_attr string) string {
+	return fmt.Sprintf("ADD %v %v", field_name, field_attr)
+}
+
+func MakeRemoveFieldClause(field_name string) string {
+	return fmt.Sprintf("DROP %v", field_name)
+}
+
+func MakeModifyFieldClause(field_name string, field_attr string) string {
+	return fmt.Sprintf("MODIFY %v %v", field_name, field_attr)
+}
+
+func MakeAddIndexClause(key_name string, key_attr string) string {
+	key_kind, key_columns := SplitKeyAttr(key_attr)
+	if key_kind != "" {
+		return fmt.Sprintf("ADD %v INDEX %v %v", key_kind, key_name, key_columns)
+	}
+	return fmt.Sprintf("ADD INDEX %v %v", key_name, key_columns)
+}
+
+//把索引定义拆成索引类型和字段部分，如"UNIQUE (`a`)" => "UNIQUE", "(`a`)"
+func SplitKeyAttr(key_attr string) (string, string) {
+	if strings.HasPrefix(key_attr, "(") {
+		return "", key_attr
+	}
+
+	idx := strings.Index(key_attr, " ")
+	if idx == -1 {
+		return "", key_attr
+	}
+	return key_attr[:idx], strings.TrimSpace(key_attr[idx+1:])
+}
+
+func MakeRemoveIndexClause(key_name string) string {
+	return fmt.Sprintf("DROP INDEX %v", key_name)
+}
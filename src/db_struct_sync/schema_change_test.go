@@ -0,0 +1,92 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAlterClauses(t *testing.T) {
+	changes := NewTableChanges("t")
+	changes.Add(CHANGE_ADD_INDEX, "`idx_c`", "(`c`)", "")
+	changes.Add(CHANGE_ADD_FIELD, "`c`", "int(11)", "")
+	changes.Add(CHANGE_MODIFY_FIELD, "`b`", "bigint(20)", "int(11)")
+	changes.Add(CHANGE_DROP_FIELD, "`old`", "", "int(11)")
+	changes.Add(CHANGE_DROP_INDEX, "`idx_old`", "", "(`old`)")
+	changes.Add(CHANGE_MODIFY_INDEX, "`uk_a`", "UNIQUE (`a`,`b`)", "UNIQUE (`a`)")
+	changes.Add(CHANGE_ADD_FIELD, "`a2`", "varchar(8)", "")
+
+	//先删除索引，再删除字段，然后添加、修改字段，最后添加索引，同一类按名字排序
+	expect := []string{
+		"DROP INDEX `idx_old`",
+		"DROP INDEX `uk_a`",
+		"DROP `old`",
+		"ADD `a2` varchar(8)",
+		"ADD `c` int(11)",
+		"MODIFY `b` bigint(20)",
+		"ADD INDEX `idx_c` (`c`)",
+		"ADD UNIQUE INDEX `uk_a` (`a`,`b`)",
+	}
+
+	alter_clauses := changes.AlterClauses()
+	if got := ClauseStrings(alter_clauses); !reflect.DeepEqual(got, expect) {
+		t.Errorf("AlterClauses =\n%q\nwant\n%q", got, expect)
+	}
+
+	//修改索引对应两个子句，但只算一个变更
+	if got := len(ClauseChanges(alter_clauses)); got != len(changes.changes) {
+		t.Errorf("ClauseChanges = %v changes, want %v", got, len(changes.changes))
+	}
+}
+
+func TestTableChangesStatements(t *testing.T) {
+	make_changes := func() *TableChanges {
+		changes := NewTableChanges("t")
+		changes.Add(CHANGE_ADD_FIELD, "`b`", "int(11)", "")
+		changes.Add(CHANGE_DROP_INDEX, "`idx_a`", "", "(`a`)")
+		return changes
+	}
+
+	dropped := NewTableChanges("t")
+	dropped.Add(CHANGE_DROP_TABLE, "", "", "")
+
+	cases := []struct {
+		name    string
+		changes *TableChanges
+		combine bool
+		expect  []string
+	}{
+		{"combine", make_changes(), true, []string{"ALTER TABLE t\n  DROP INDEX `idx_a`,\n  ADD `b` int(11);"}},
+		{"one statement per change", make_changes(), false, []string{"ALTER TABLE t DROP INDEX `idx_a`;", "ALTER TABLE t ADD `b` int(11);"}},
+		{"drop table", dropped, true, []string{"DROP TABLE t;"}},
+		{"no changes", NewTableChanges("t"), true, nil},
+	}
+
+	for _, c := range cases {
+		var got []string
+		for _, statement := range c.changes.Statements(c.combine) {
+			got = append(got, statement.sql)
+		}
+		if !reflect.DeepEqual(got, c.expect) {
+			t.Errorf("%v: Statements = %q, want %q", c.name, got, c.expect)
+		}
+	}
+}
+
+func TestSplitKeyAttr(t *testing.T) {
+	cases := []struct {
+		key_attr string
+		kind     string
+		columns  string
+	}{
+		{"(`a`,`b`)", "", "(`a`,`b`)"},
+		{"UNIQUE (`a`)", "UNIQUE", "(`a`)"},
+		{"FULLTEXT (`body`)", "FULLTEXT", "(`body`)"},
+	}
+
+	for _, c := range cases {
+		kind, columns := SplitKeyAttr(c.key_attr)
+		if kind != c.kind || columns != c.columns {
+			t.Errorf("SplitKeyAttr(%q) = %q, %q, want %q, %q", c.key_attr, kind, columns, c.kind, c.columns)
+		}
+	}
+}
@@ -0,0 +1,806 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	//工具自己创建的表和触发器都以此为前缀，拉取表结构时会被忽略
+	TOOL_OBJECT_PREFIX string = "_dss_"
+
+	SHADOW_NEW_PREFIX     string = "_dss_new_"
+	SHADOW_OLD_PREFIX     string = "_dss_old_"
+	SHADOW_PROGRESS_DIR   string = "shadow_progress"
+	MYSQL_MAX_NAME_LENGTH int    = 64
+	NAME_HASH_LENGTH      int    = 8
+)
+
+var g_alterTableRegExp = regexp.MustCompile("(?i)^\\s*ALTER\\s+TABLE\\s+(`?[^`\\s]+`?)")
+
+//影子表迁移的进度，保存在data_dir/shadow_progress目录下，用于中断后继续
+type ShadowProgress struct {
+	Table     string `json:"table"`
+	Statement string `json:"statement"`
+	LastPK    string `json:"last_pk"`
+	HasLastPK bool   `json:"has_last_pk"`
+	Chunks    int64  `json:"chunks"`
+	StartTime string `json:"start_time"`
+}
+
+//影子表迁移：按新结构创建影子表，用触发器同步增量数据，
+//按主键分批拷贝存量数据，最后用RENAME TABLE原子地交换新旧表
+type ShadowMigration struct {
+	dbAdaptor     *MysqlDBAdaptor
+	conn          *sql.Conn
+	progress_file string
+	table_name    string
+	shadow_name   string
+	old_name      string
+	statement     string
+	chunk_size    int64
+	throttle      time.Duration
+	keep_old      bool
+	pk_name       string
+	columns       []string
+	progress      *ShadowProgress
+}
+
+func NewShadowMigration(data_dir string, dbAdaptor *MysqlDBAdaptor, statement string) (*ShadowMigration, error) {
+	table_name := GetAlterTableName(statement)
+	if table_name == "" {
+		return nil, fmt.Errorf("not an alter table statement: %v", statement)
+	}
+	if len(SHADOW_NEW_PREFIX)+len(table_name) > MYSQL_MAX_NAME_LENGTH {
+		return nil, fmt.Errorf("table name %v too long for shadow migration", table_name)
+	}
+
+	migration := &ShadowMigration{
+		dbAdaptor:     dbAdaptor,
+		progress_file: filepath.Join(data_dir, SHADOW_PROGRESS_DIR, table_name+".json"),
+		table_name:    table_name,
+		shadow_name:   SHADOW_NEW_PREFIX + table_name,
+		old_name:      SHADOW_OLD_PREFIX + table_name,
+		statement:     StripOnlineClause(statement),
+		chunk_size:    GetConfigInt("shadow.chunk_size", 1000),
+		throttle:      time.Duration(GetConfigInt("shadow.throttle_ms", 100)) * time.Millisecond,
+		keep_old:      GetConfigBool("shadow.keep_old", false),
+	}
+	if migration.chunk_size <= 0 {
+		migration.chunk_size = 1000
+	}
+
+	return migration, nil
+}
+
+func GetAlterTableName(statement string) string {
+	match := g_alterTableRegExp.FindStringSubmatch(statement)
+	if match == nil {
+		return ""
+	}
+	return strings.Trim(match[1], "`")
+}
+
+func IsToolObject(name string) bool {
+	return strings.HasPrefix(name, TOOL_OBJECT_PREFIX)
+}
+
+func QuoteName(name string) string {
+	return "`" + strings.Trim(name, "`") + "`"
+}
+
+//名字超过MySQL的长度限制时截断，并追加完整名字的hash，避免前缀相同的长表名截断后得到同一个名字
+func TruncateName(name string) string {
+	if len(name) <= MYSQL_MAX_NAME_LENGTH {
+		return name
+	}
+
+	hash := sha256.Sum256([]byte(name))
+	suffix := "_" + hex.EncodeToString(hash[:])[:NAME_HASH_LENGTH]
+
+	//不能截断在多字节字符的中间
+	end := MYSQL_MAX_NAME_LENGTH - len(suffix)
+	for end > 0 && !utf8.RuneStart(name[end]) {
+		end--
+	}
+	return name[:end] + suffix
+}
+
+func (this *ShadowMigration) TriggerName(event string) string {
+	return TruncateName(fmt.Sprintf("%v%v_%v", TOOL_OBJECT_PREFIX, event, this.table_name))
+}
+
+func (this *ShadowMigration) Run() error {
+	var err error
+
+	LOG_INFO("start shadow migration for table %v: %v", this.table_name, this.statement)
+
+	err = this.OpenConn()
+	if err != nil {
+		return err
+	}
+	defer this.CloseConn()
+
+	err = this.Prepare()
+	if err != nil {
+		return err
+	}
+
+	err = this.CopyRows()
+	if err != nil {
+		return err
+	}
+
+	err = this.Swap()
+	if err != nil {
+		return err
+	}
+
+	os.Remove(this.progress_file)
+
+	LOG_INFO("shadow migration for table %v finished, %v chunks copied", this.table_name, this.progress.Chunks)
+
+	return nil
+}
+
+//触发器和拷贝都在一个独占的严格模式连接上执行：触发器保存创建时的sql_mode，
+//非严格模式下放不下的值会被静默截断，严格模式下则报错
+func (this *ShadowMigration) OpenConn() error {
+	conn, err := this.dbAdaptor.Conn()
+	if err != nil {
+		LOG_ERROR("get a dedicated connection for shadow migration of table %v error: %v", this.table_name, err)
+		return err
+	}
+
+	ctx := context.Background()
+
+	var sql_mode string
+	err = conn.QueryRowContext(ctx, "SELECT @@SESSION.sql_mode").Scan(&sql_mode)
+	if err == nil {
+		_, err = conn.ExecContext(ctx, "SET SESSION sql_mode = ?", StrictSqlMode(sql_mode))
+	}
+	if err != nil {
+		conn.Close()
+		LOG_ERROR("set strict sql_mode for shadow migration of table %v error: %v", this.table_name, err)
+		return err
+	}
+
+	this.conn = conn
+	return nil
+}
+
+func (this *ShadowMigration) CloseConn() {
+	if this.conn != nil {
+		this.conn.Close()
+		this.conn = nil
+	}
+}
+
+//在原有的sql_mode上加上STRICT_ALL_TABLES
+func StrictSqlMode(sql_mode string) string {
+	var modes []string
+	for _, mode := range strings.Split(sql_mode, ",") {
+		mode = strings.ToUpper(strings.TrimSpace(mode))
+		if mode != "" && !StringInSlice(mode, modes) {
+			modes = append(modes, mode)
+		}
+	}
+	if !StringInSlice("STRICT_ALL_TABLES", modes) {
+		modes = append(modes, "STRICT_ALL_TABLES")
+	}
+	return strings.Join(modes, ",")
+}
+
+//创建影子表和触发器，已有同一语句的进度时从断点继续
+func (this *ShadowMigration) Prepare() error {
+	var err error
+
+	//CREATE TABLE LIKE不会复制外键，RENAME后引用原表的外键也会跟着旧表走
+	foreign_keys, err := GetForeignKeys(this.dbAdaptor, this.table_name)
+	if err != nil {
+		return err
+	}
+	if len(foreign_keys) > 0 {
+		return fmt.Errorf("table %v has foreign keys %v, shadow migration not supported", this.table_name, strings.Join(foreign_keys, ","))
+	}
+
+	this.progress, err = this.LoadProgress()
+	if err != nil {
+		return err
+	}
+
+	shadow_exists, err := TableExists(this.dbAdaptor, this.shadow_name)
+	if err != nil {
+		return err
+	}
+
+	if this.progress != nil && shadow_exists {
+		LOG_INFO("resume shadow migration for table %v from primary key %v", this.table_name, this.progress.LastPK)
+	} else {
+		if shadow_exists {
+			return fmt.Errorf("shadow table %v already exists, run the cleanup command first", this.shadow_name)
+		}
+
+		this.progress = &ShadowProgress{
+			Table:     this.table_name,
+			Statement: this.statement,
+			StartTime: time.Now().Format("2006-01-02 15:04:05"),
+		}
+
+		err = this.dbAdaptor.Exec(fmt.Sprintf("CREATE TABLE %v LIKE %v", QuoteName(this.shadow_name), QuoteName(this.table_name)))
+		if err != nil {
+			LOG_ERROR("create shadow table %v error: %v", this.shadow_name, err)
+			return err
+		}
+
+		shadow_statement := g_alterTableRegExp.ReplaceAllString(this.statement, "ALTER TABLE "+QuoteName(this.shadow_name))
+		err = this.dbAdaptor.Exec(shadow_statement)
+		if err != nil {
+			LOG_ERROR("alter shadow table [%v] error: %v", shadow_statement, err)
+			return err
+		}
+
+		err = this.SaveProgress()
+		if err != nil {
+			return err
+		}
+	}
+
+	this.pk_name, err = this.GetPrimaryKey()
+	if err != nil {
+		return err
+	}
+
+	this.columns, err = this.GetCommonColumns()
+	if err != nil {
+		return err
+	}
+
+	//触发器和拷贝只写新旧表都有的字段，新增的NOT NULL且没有默认值的字段会让触发器在严格模式下失败，
+	//导致原表上的写入全部报错，非严格模式下则静默写入隐式默认值，所以必须在创建触发器之前拒绝
+	new_columns, err := GetColumnInfos(this.dbAdaptor, this.shadow_name)
+	if err != nil {
+		return err
+	}
+	if missing := RequiredNewColumns(this.columns, new_columns); len(missing) > 0 {
+		return fmt.Errorf("new columns %v of table %v are NOT NULL without default, shadow migration can not fill them, add a default value first",
+			strings.Join(missing, ","), this.table_name)
+	}
+
+	//字段定义收紧时现有数据必须都符合新定义，否则拷贝会在中途失败
+	err = this.ValidateFields()
+	if err != nil {
+		return err
+	}
+
+	return this.CreateTriggers()
+}
+
+func (this *ShadowMigration) ValidateFields() error {
+	old_create_sql, err := ShowCreateTable(this.dbAdaptor, this.table_name)
+	if err != nil {
+		return err
+	}
+	new_create_sql, err := ShowCreateTable(this.dbAdaptor, this.shadow_name)
+	if err != nil {
+		return err
+	}
+
+	changes := ModifiedFieldChanges(this.table_name, ParseCreateTableFields(old_create_sql), ParseCreateTableFields(new_create_sql))
+
+	validator := NewDataValidator(this.dbAdaptor)
+	var issues []string
+	for _, change := range changes {
+		change_issues, err := validator.ValidateChange(change)
+		if err != nil {
+			return err
+		}
+		for _, issue := range change_issues {
+			issues = append(issues, issue.String())
+		}
+	}
+
+	if len(issues) > 0 {
+		return fmt.Errorf("existing data of table %v does not fit the new definition, fix the data and run the cleanup command before retrying: %v",
+			this.table_name, strings.Join(issues, "; "))
+	}
+	return nil
+}
+
+//建表语句中的字段定义：字段名(带反引号) => 定义
+func ParseCreateTableFields(create_table_sql string) map[string]string {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(create_table_sql, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "`") {
+			ParseFieldStruct(line, fields)
+		}
+	}
+	return fields
+}
+
+//新旧表都有但定义不同的字段，按字段名排序
+func ModifiedFieldChanges(table_name string, old_fields map[string]string, new_fields map[string]string) []*SchemaChange {
+	var names []string
+	for name, new_attr := range new_fields {
+		if old_attr, ok := old_fields[name]; ok && old_attr != new_attr {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var changes []*SchemaChange
+	for _, name := range names {
+		changes = append(changes, &SchemaChange{
+			change_type: CHANGE_MODIFY_FIELD,
+			table_name:  table_name,
+			object_name: name,
+			src_attr:    new_fields[name],
+			dest_attr:   old_fields[name],
+		})
+	}
+	return changes
+}
+
+//主键必须是单字段，且在新结构中仍然存在
+func (this *ShadowMigration) GetPrimaryKey() (string, error) {
+	pk_columns, err := GetPrimaryKeyColumns(this.dbAdaptor, this.table_name)
+	if err != nil {
+		return "", err
+	}
+	if len(pk_columns) != 1 {
+		return "", fmt.Errorf("table %v must have a single-column primary key for shadow migration", this.table_name)
+	}
+
+	shadow_pk_columns, err := GetPrimaryKeyColumns(this.dbAdaptor, this.shadow_name)
+	if err != nil {
+		return "", err
+	}
+	if len(shadow_pk_columns) != 1 || shadow_pk_columns[0] != pk_columns[0] {
+		return "", fmt.Errorf("primary key of table %v changed, shadow migration not supported", this.table_name)
+	}
+
+	return pk_columns[0], nil
+}
+
+//新旧表都存在的字段，按原表中的顺序
+func (this *ShadowMigration) GetCommonColumns() ([]string, error) {
+	old_columns, err := GetTableColumns(this.dbAdaptor, this.table_name)
+	if err != nil {
+		return nil, err
+	}
+
+	new_columns, err := GetTableColumns(this.dbAdaptor, this.shadow_name)
+	if err != nil {
+		return nil, err
+	}
+
+	new_column_set := make(map[string]bool)
+	for _, column := range new_columns {
+		new_column_set[column] = true
+	}
+
+	var columns []string
+	for _, column := range old_columns {
+		if new_column_set[column] {
+			columns = append(columns, column)
+		}
+	}
+
+	return columns, nil
+}
+
+//影子表中字段的定义，用于检查拷贝时无法填充的新字段
+type ColumnInfo struct {
+	name        string
+	nullable    bool
+	has_default bool
+	extra       string
+}
+
+//影子表中不在common_columns里、又必须由插入语句提供值的字段
+//自增和生成列由服务器填充，不需要提供
+func RequiredNewColumns(common_columns []string, new_columns []*ColumnInfo) []string {
+	common_set := make(map[string]bool)
+	for _, column := range common_columns {
+		common_set[strings.ToLower(column)] = true
+	}
+
+	var required []string
+	for _, column := range new_columns {
+		if common_set[strings.ToLower(column.name)] || column.nullable || column.has_default {
+			continue
+		}
+		extra := strings.ToUpper(column.extra)
+		if strings.Contains(extra, "AUTO_INCREMENT") || strings.Contains(extra, "GENERATED") {
+			continue
+		}
+		required = append(required, column.name)
+	}
+
+	return required
+}
+
+func (this *ShadowMigration) CreateTriggers() error {
+	var quoted_columns, new_values []string
+	for _, column := range this.columns {
+		quoted_columns = append(quoted_columns, QuoteName(column))
+		new_values = append(new_values, "NEW."+QuoteName(column))
+	}
+
+	replace_sql := fmt.Sprintf("REPLACE INTO %v (%v) VALUES (%v)",
+		QuoteName(this.shadow_name), strings.Join(quoted_columns, ","), strings.Join(new_values, ","))
+	delete_sql := fmt.Sprintf("DELETE IGNORE FROM %v WHERE %v = OLD.%v",
+		QuoteName(this.shadow_name), QuoteName(this.pk_name), QuoteName(this.pk_name))
+
+	triggers := map[string]string{
+		"ins": fmt.Sprintf("AFTER INSERT ON %v FOR EACH ROW %v", QuoteName(this.table_name), replace_sql),
+		"upd": fmt.Sprintf("AFTER UPDATE ON %v FOR EACH ROW BEGIN %v; %v; END", QuoteName(this.table_name), delete_sql, replace_sql),
+		"del": fmt.Sprintf("AFTER DELETE ON %v FOR EACH ROW %v", QuoteName(this.table_name), delete_sql),
+	}
+
+	for _, event := range []string{"ins", "upd", "del"} {
+		trigger_name := this.TriggerName(event)
+
+		exists, err := TriggerExists(this.dbAdaptor, trigger_name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		_, err = this.conn.ExecContext(context.Background(), fmt.Sprintf("CREATE TRIGGER %v %v", QuoteName(trigger_name), triggers[event]))
+		if err != nil {
+			LOG_ERROR("create trigger %v on table %v error: %v", trigger_name, this.table_name, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *ShadowMigration) DropTriggers() error {
+	for _, event := range []string{"ins", "upd", "del"} {
+		err := this.dbAdaptor.Exec(fmt.Sprintf("DROP TRIGGER IF EXISTS %v", QuoteName(this.TriggerName(event))))
+		if err != nil {
+			LOG_ERROR("drop trigger %v error: %v", this.TriggerName(event), err)
+			return err
+		}
+	}
+	return nil
+}
+
+//按主键分批拷贝存量数据，每批一个事务，批与批之间休眠以降低对线上的影响
+//每批先锁住原表中的这段数据，删掉触发器已经写入影子表的对应行，再用普通INSERT重新拷贝，
+//不用INSERT IGNORE，放不下的值或违反新唯一索引的数据会报错而不是被静默截断或丢弃
+func (this *ShadowMigration) CopyRows() error {
+	var quoted_columns []string
+	for _, column := range this.columns {
+		quoted_columns = append(quoted_columns, QuoteName(column))
+	}
+	column_list := strings.Join(quoted_columns, ",")
+	pk := QuoteName(this.pk_name)
+
+	for {
+		//计算本批次的主键上界
+		var bound_sql string
+		var bound_args []interface{}
+		if this.progress.HasLastPK {
+			bound_sql = fmt.Sprintf("SELECT MAX(%v) FROM (SELECT %v FROM %v WHERE %v > ? ORDER BY %v LIMIT ?) AS chunk",
+				pk, pk, QuoteName(this.table_name), pk, pk)
+			bound_args = []interface{}{this.progress.LastPK, this.chunk_size}
+		} else {
+			bound_sql = fmt.Sprintf("SELECT MAX(%v) FROM (SELECT %v FROM %v ORDER BY %v LIMIT ?) AS chunk",
+				pk, pk, QuoteName(this.table_name), pk)
+			bound_args = []interface{}{this.chunk_size}
+		}
+
+		row, err := this.dbAdaptor.QueryRowFormat(bound_sql, bound_args...)
+		if err != nil {
+			return err
+		}
+
+		var upper_pk sql.NullString
+		err = row.Scan(&upper_pk)
+		if err != nil {
+			LOG_ERROR("query chunk bound for table %v error: %v", this.table_name, err)
+			return err
+		}
+		if !upper_pk.Valid {
+			//已经拷贝完毕
+			return nil
+		}
+
+		range_where := fmt.Sprintf("%v <= ?", pk)
+		range_args := []interface{}{upper_pk.String}
+		if this.progress.HasLastPK {
+			range_where += fmt.Sprintf(" AND %v > ?", pk)
+			range_args = append(range_args, this.progress.LastPK)
+		}
+
+		chunk_sqls := []string{
+			fmt.Sprintf("SELECT COUNT(*) FROM %v WHERE %v LOCK IN SHARE MODE", QuoteName(this.table_name), range_where),
+			fmt.Sprintf("DELETE FROM %v WHERE %v", QuoteName(this.shadow_name), range_where),
+			fmt.Sprintf("INSERT INTO %v (%v) SELECT %v FROM %v WHERE %v LOCK IN SHARE MODE",
+				QuoteName(this.shadow_name), column_list, column_list, QuoteName(this.table_name), range_where),
+		}
+
+		tx, err := this.conn.BeginTx(context.Background(), nil)
+		if err != nil {
+			return err
+		}
+
+		for _, chunk_sql := range chunk_sqls {
+			err = this.dbAdaptor.ExecTransaction(tx, chunk_sql, range_args...)
+			if err != nil {
+				LOG_ERROR("copy rows of table %v up to %v error: %v", this.table_name, upper_pk.String, err)
+				this.dbAdaptor.RollbackTransaction(tx)
+				return err
+			}
+		}
+
+		err = this.dbAdaptor.CommitTransaction(tx)
+		if err != nil {
+			return err
+		}
+
+		this.progress.LastPK = upper_pk.String
+		this.progress.HasLastPK = true
+		this.progress.Chunks++
+
+		err = this.SaveProgress()
+		if err != nil {
+			return err
+		}
+
+		LOG_DEBUG("shadow migration for table %v copied up to primary key %v", this.table_name, upper_pk.String)
+
+		if this.throttle > 0 {
+			time.Sleep(this.throttle)
+		}
+	}
+}
+
+//原子地交换新旧表，然后删除触发器
+func (this *ShadowMigration) Swap() error {
+	old_exists, err := TableExists(this.dbAdaptor, this.old_name)
+	if err != nil {
+		return err
+	}
+	if old_exists {
+		return fmt.Errorf("table %v already exists, drop it before swapping", this.old_name)
+	}
+
+	rename_sql := fmt.Sprintf("RENAME TABLE %v TO %v, %v TO %v",
+		QuoteName(this.table_name), QuoteName(this.old_name), QuoteName(this.shadow_name), QuoteName(this.table_name))
+	err = this.dbAdaptor.Exec(rename_sql)
+	if err != nil {
+		LOG_ERROR("swap table %v error: %v", this.table_name, err)
+		return err
+	}
+
+	err = this.DropTriggers()
+	if err != nil {
+		return err
+	}
+
+	if !this.keep_old {
+		err = this.dbAdaptor.Exec(fmt.Sprintf("DROP TABLE %v", QuoteName(this.old_name)))
+		if err != nil {
+			LOG_ERROR("drop old table %v error: %v", this.old_name, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *ShadowMigration) LoadProgress() (*ShadowProgress, error) {
+	content, err := ioutil.ReadFile(this.progress_file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	progress := &ShadowProgress{}
+	err = json.Unmarshal(content, progress)
+	if err != nil {
+		LOG_ERROR("parse shadow progress file %v error: %v", this.progress_file, err)
+		return nil, err
+	}
+
+	if progress.Statement != this.statement {
+		return nil, fmt.Errorf("shadow progress file %v belongs to another statement, run the cleanup command first", this.progress_file)
+	}
+
+	return progress, nil
+}
+
+func (this *ShadowMigration) SaveProgress() error {
+	err := os.MkdirAll(filepath.Dir(this.progress_file), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	content, err := json.MarshalIndent(this.progress, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(this.progress_file, content, 0666)
+}
+
+//清理中断的影子表迁移留下的影子表、触发器和进度文件
+func RunCleanup(data_dir string) error {
+	var err error
+
+	g_destMysqlAdaptor, err = OpenMysqlDBAdaptor("mysql_dest", false)
+	if err != nil {
+		return err
+	}
+	defer g_destMysqlAdaptor.Release()
+
+	run_lock, err := AcquireRunLock(g_destMysqlAdaptor, "cleanup")
+	if err != nil {
+		LOG_ERROR("lock destination fail: %v", err)
+		return err
+	}
+	defer run_lock.Release()
+
+	rows, err := g_destMysqlAdaptor.QueryFormat("SELECT TRIGGER_NAME FROM information_schema.TRIGGERS WHERE TRIGGER_SCHEMA = DATABASE() AND TRIGGER_NAME LIKE ?",
+		strings.Replace(TOOL_OBJECT_PREFIX, "_", "\\_", -1)+"%")
+	if err != nil {
+		LOG_ERROR("query shadow triggers error: %v", err)
+		return err
+	}
+	triggers, err := ScanStrings(rows)
+	if err != nil {
+		return err
+	}
+
+	for _, trigger := range triggers {
+		err = g_destMysqlAdaptor.Exec(fmt.Sprintf("DROP TRIGGER IF EXISTS %v", QuoteName(trigger)))
+		if err != nil {
+			LOG_ERROR("drop trigger %v error: %v", trigger, err)
+			return err
+		}
+		LOG_INFO("dropped trigger %v", trigger)
+	}
+
+	//GetTableList会忽略工具创建的表，这里直接按前缀查询
+	tables, err := GetTablesWithPrefix(g_destMysqlAdaptor, "", SHADOW_NEW_PREFIX)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		err = g_destMysqlAdaptor.Exec(fmt.Sprintf("DROP TABLE %v", QuoteName(table)))
+		if err != nil {
+			LOG_ERROR("drop shadow table %v error: %v", table, err)
+			return err
+		}
+		LOG_INFO("dropped shadow table %v", table)
+	}
+
+	err = os.RemoveAll(filepath.Join(data_dir, SHADOW_PROGRESS_DIR))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func TableExists(dbAdaptor *MysqlDBAdaptor, table_name string) (bool, error) {
+	row, err := dbAdaptor.QueryRowFormat("SELECT COUNT(*) FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?", table_name)
+	if err != nil {
+		return false, err
+	}
+
+	var count int
+	err = row.Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func TriggerExists(dbAdaptor *MysqlDBAdaptor, trigger_name string) (bool, error) {
+	row, err := dbAdaptor.QueryRowFormat("SELECT COUNT(*) FROM information_schema.TRIGGERS WHERE TRIGGER_SCHEMA = DATABASE() AND TRIGGER_NAME = ?", trigger_name)
+	if err != nil {
+		return false, err
+	}
+
+	var count int
+	err = row.Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func GetPrimaryKeyColumns(dbAdaptor *MysqlDBAdaptor, table_name string) ([]string, error) {
+	rows, err := dbAdaptor.QueryFormat("SELECT COLUMN_NAME FROM information_schema.KEY_COLUMN_USAGE WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND CONSTRAINT_NAME = 'PRIMARY' ORDER BY ORDINAL_POSITION", table_name)
+	if err != nil {
+		LOG_ERROR("query primary key of table %v error: %v", table_name, err)
+		return nil, err
+	}
+	return ScanStrings(rows)
+}
+
+func GetTableColumns(dbAdaptor *MysqlDBAdaptor, table_name string) ([]string, error) {
+	rows, err := dbAdaptor.QueryFormat("SELECT COLUMN_NAME FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION", table_name)
+	if err != nil {
+		LOG_ERROR("query columns of table %v error: %v", table_name, err)
+		return nil, err
+	}
+	return ScanStrings(rows)
+}
+
+//表上的外键和引用该表的外键，格式为<表名>.<约束名>
+func GetForeignKeys(dbAdaptor *MysqlDBAdaptor, table_name string) ([]string, error) {
+	rows, err := dbAdaptor.QueryFormat("SELECT CONCAT(TABLE_NAME, '.', CONSTRAINT_NAME) FROM information_schema.REFERENTIAL_CONSTRAINTS "+
+		"WHERE CONSTRAINT_SCHEMA = DATABASE() AND (TABLE_NAME = ? OR (UNIQUE_CONSTRAINT_SCHEMA = DATABASE() AND REFERENCED_TABLE_NAME = ?))", table_name, table_name)
+	if err != nil {
+		LOG_ERROR("query foreign keys of table %v error: %v", table_name, err)
+		return nil, err
+	}
+	return ScanStrings(rows)
+}
+
+func GetColumnInfos(dbAdaptor *MysqlDBAdaptor, table_name string) ([]*ColumnInfo, error) {
+	rows, err := dbAdaptor.QueryFormat("SELECT COLUMN_NAME, IS_NULLABLE, COLUMN_DEFAULT, EXTRA FROM information_schema.COLUMNS "+
+		"WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION", table_name)
+	if err != nil {
+		LOG_ERROR("query columns of table %v error: %v", table_name, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []*ColumnInfo
+	for rows.Next() {
+		var nullable string
+		var column_default sql.NullString
+		column := &ColumnInfo{}
+		err = rows.Scan(&column.name, &nullable, &column_default, &column.extra)
+		if err != nil {
+			return nil, err
+		}
+		column.nullable = nullable == "YES"
+		column.has_default = column_default.Valid
+		columns = append(columns, column)
+	}
+
+	return columns, rows.Err()
+}
+
+//读取单列结果集，读完后关闭rows
+func ScanStrings(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value string
+		err := rows.Scan(&value)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	return values, rows.Err()
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTriggerName(t *testing.T) {
+	long_prefix := strings.Repeat("a", 60)
+
+	cases := []struct {
+		table_name string
+		event      string
+		expect     string
+	}{
+		{"user", "ins", "_dss_ins_user"},
+		{strings.Repeat("t", 55), "upd", "_dss_upd_" + strings.Repeat("t", 55)},
+	}
+
+	for _, c := range cases {
+		migration := &ShadowMigration{table_name: c.table_name}
+		if got := migration.TriggerName(c.event); got != c.expect {
+			t.Errorf("TriggerName(%v, %v) = %v, want %v", c.table_name, c.event, got, c.expect)
+		}
+	}
+
+	//前缀相同的长表名截断后不能得到同一个触发器名
+	names := make(map[string]string)
+	for _, table_name := range []string{long_prefix + "_orders", long_prefix + "_order_items", long_prefix + "_refunds"} {
+		migration := &ShadowMigration{table_name: table_name}
+		for _, event := range []string{"ins", "upd", "del"} {
+			name := migration.TriggerName(event)
+			if len(name) > MYSQL_MAX_NAME_LENGTH {
+				t.Errorf("TriggerName(%v, %v) = %v, longer than %v", table_name, event, name, MYSQL_MAX_NAME_LENGTH)
+			}
+			if other, ok := names[name]; ok {
+				t.Errorf("TriggerName(%v, %v) collides with %v: %v", table_name, event, other, name)
+			}
+			names[name] = table_name + "/" + event
+		}
+	}
+}
+
+func TestTruncateName(t *testing.T) {
+	cases := []string{
+		"short",
+		strings.Repeat("x", MYSQL_MAX_NAME_LENGTH),
+		strings.Repeat("x", MYSQL_MAX_NAME_LENGTH+1),
+		strings.Repeat("表", 30),
+	}
+
+	for _, name := range cases {
+		got := TruncateName(name)
+		if len(name) <= MYSQL_MAX_NAME_LENGTH {
+			if got != name {
+				t.Errorf("TruncateName(%q) = %q, want unchanged", name, got)
+			}
+			continue
+		}
+		if len(got) > MYSQL_MAX_NAME_LENGTH || !utf8.ValidString(got) {
+			t.Errorf("TruncateName(%q) = %q, invalid", name, got)
+		}
+		if got != TruncateName(name) {
+			t.Errorf("TruncateName(%q) is not stable", name)
+		}
+	}
+}
+
+func TestRequiredNewColumns(t *testing.T) {
+	common := []string{"id", "name"}
+
+	cases := []struct {
+		name     string
+		columns  []*ColumnInfo
+		required []string
+	}{
+		{"only common columns", []*ColumnInfo{{name: "id"}, {name: "name"}}, nil},
+		{"nullable new column", []*ColumnInfo{{name: "id"}, {name: "age", nullable: true}}, nil},
+		{"new column with default", []*ColumnInfo{{name: "id"}, {name: "age", has_default: true}}, nil},
+		{"not null without default", []*ColumnInfo{{name: "id"}, {name: "age"}, {name: "city"}}, []string{"age", "city"}},
+		{"generated column", []*ColumnInfo{{name: "id"}, {name: "full", extra: "VIRTUAL GENERATED"}}, nil},
+		{"auto increment", []*ColumnInfo{{name: "seq", extra: "auto_increment"}}, nil},
+		{"case insensitive names", []*ColumnInfo{{name: "ID"}, {name: "Name"}}, nil},
+	}
+
+	for _, c := range cases {
+		if got := RequiredNewColumns(common, c.columns); !reflect.DeepEqual(got, c.required) {
+			t.Errorf("%v: RequiredNewColumns = %v, want %v", c.name, got, c.required)
+		}
+	}
+}
+
+func TestStrictSqlMode(t *testing.T) {
+	cases := []struct {
+		sql_mode string
+		expect   string
+	}{
+		{"", "STRICT_ALL_TABLES"},
+		{"NO_ENGINE_SUBSTITUTION", "NO_ENGINE_SUBSTITUTION,STRICT_ALL_TABLES"},
+		{"STRICT_TRANS_TABLES,NO_ZERO_DATE", "STRICT_TRANS_TABLES,NO_ZERO_DATE,STRICT_ALL_TABLES"},
+		{"strict_all_tables, ONLY_FULL_GROUP_BY", "STRICT_ALL_TABLES,ONLY_FULL_GROUP_BY"},
+	}
+
+	for _, c := range cases {
+		if got := StrictSqlMode(c.sql_mode); got != c.expect {
+			t.Errorf("StrictSqlMode(%q) = %q, want %q", c.sql_mode, got, c.expect)
+		}
+	}
+}
+
+func TestModifiedFieldChanges(t *testing.T) {
+	old_fields := ParseCreateTableFields("CREATE TABLE `t` (\n" +
+		"  `id` int(11) NOT NULL AUTO_INCREMENT,\n" +
+		"  `name` varchar(20) NOT NULL DEFAULT '',\n" +
+		"  `age` int(11) DEFAULT NULL,\n" +
+		"  `city` varchar(20) DEFAULT NULL,\n" +
+		"  PRIMARY KEY (`id`),\n" +
+		"  KEY `k_name` (`name`)\n" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4")
+	new_fields := ParseCreateTableFields("CREATE TABLE `_dss_new_t` (\n" +
+		"  `id` int(11) NOT NULL AUTO_INCREMENT,\n" +
+		"  `name` varchar(10) NOT NULL DEFAULT '',\n" +
+		"  `age` tinyint(4) NOT NULL,\n" +
+		"  `email` varchar(64) DEFAULT NULL,\n" +
+		"  PRIMARY KEY (`id`)\n" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4")
+
+	if len(old_fields) != 4 || old_fields["`name`"] != "varchar(20) NOT NULL DEFAULT ''" {
+		t.Fatalf("ParseCreateTableFields = %v", old_fields)
+	}
+
+	changes := ModifiedFieldChanges("t", old_fields, new_fields)
+
+	expect := []*SchemaChange{
+		{change_type: CHANGE_MODIFY_FIELD, table_name: "t", object_name: "`age`", src_attr: "tinyint(4) NOT NULL", dest_attr: "int(11) DEFAULT NULL"},
+		{change_type: CHANGE_MODIFY_FIELD, table_name: "t", object_name: "`name`", src_attr: "varchar(10) NOT NULL DEFAULT ''", dest_attr: "varchar(20) NOT NULL DEFAULT ''"},
+	}
+	if !reflect.DeepEqual(changes, expect) {
+		for _, change := range changes {
+			t.Logf("%+v", *change)
+		}
+		t.Errorf("ModifiedFieldChanges returned %v changes, want %v", len(changes), len(expect))
+	}
+
+	//收紧的字段都需要检查现有数据
+	for _, change := range changes {
+		if len(FieldChecks(change.object_name, change.src_attr, change.dest_attr)) == 0 {
+			t.Errorf("FieldChecks(%v) returned no checks for a narrowed field", change.object_name)
+		}
+	}
+}
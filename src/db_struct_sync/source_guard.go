@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+)
+
+var g_allowMassDrop bool
+
+//源库为空或只有很少的表时(如mysql_src配错了库)，对比结果会删除目标库的大部分表
+//超过阈值时终止，需要在命令行加上--allow-mass-drop才能继续
+type SourceGuard struct {
+	max_drop_tables  int64
+	max_drop_percent int64
+	allow_mass_drop  bool
+}
+
+func NewSourceGuard(allow_mass_drop bool) *SourceGuard {
+	return &SourceGuard{
+		max_drop_tables:  GetConfigInt("guard.max_drop_tables", 10),
+		max_drop_percent: GetConfigInt("guard.max_drop_percent", 20),
+		allow_mass_drop:  allow_mass_drop,
+	}
+}
+
+func (this *SourceGuard) Check(src_table_count int, dest_table_count int, table_changes_list []*TableChanges) error {
+	if this.allow_mass_drop {
+		return nil
+	}
+
+	if src_table_count == 0 && dest_table_count > 0 {
+		return fmt.Errorf("source database has no tables, all %v destination tables would be dropped; check mysql_src or use --allow-mass-drop", dest_table_count)
+	}
+
+	drop_count := 0
+	for _, table_changes := range table_changes_list {
+		if table_changes.HasChange(CHANGE_DROP_TABLE) {
+			drop_count++
+		}
+	}
+	if drop_count == 0 {
+		return nil
+	}
+
+	if this.max_drop_tables > 0 && int64(drop_count) > this.max_drop_tables {
+		return fmt.Errorf("%v of %v destination tables would be dropped, more than guard.max_drop_tables(%v); check mysql_src or use --allow-mass-drop",
+			drop_count, dest_table_count, this.max_drop_tables)
+	}
+
+	if this.max_drop_percent > 0 && dest_table_count > 0 && int64(drop_count)*100 > this.max_drop_percent*int64(dest_table_count) {
+		return fmt.Errorf("%v of %v destination tables would be dropped, more than guard.max_drop_percent(%v%%); check mysql_src or use --allow-mass-drop",
+			drop_count, dest_table_count, this.max_drop_percent)
+	}
+
+	return nil
+}
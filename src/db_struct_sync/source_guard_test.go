@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSourceGuardCheck(t *testing.T) {
+	make_drops := func(count int) []*TableChanges {
+		var table_changes_list []*TableChanges
+		for i := 0; i < count; i++ {
+			table_changes := NewTableChanges(fmt.Sprintf("t%v", i))
+			table_changes.Add(CHANGE_DROP_TABLE, "", "", "")
+			table_changes_list = append(table_changes_list, table_changes)
+		}
+		added := NewTableChanges("new_table")
+		added.Add(CHANGE_CREATE_TABLE, "", "", "")
+		return append(table_changes_list, added)
+	}
+
+	guard := &SourceGuard{max_drop_tables: 10, max_drop_percent: 20}
+
+	cases := []struct {
+		name       string
+		guard      *SourceGuard
+		src_count  int
+		dest_count int
+		drops      int
+		valid      bool
+	}{
+		{"no drops", guard, 100, 100, 0, true},
+		{"empty source", guard, 0, 5, 5, false},
+		{"empty source and destination", guard, 0, 0, 0, true},
+		{"few drops", guard, 95, 100, 5, true},
+		{"too many tables", guard, 89, 100, 11, false},
+		{"too high percent", guard, 7, 10, 3, false},
+		{"exactly the percent", guard, 8, 10, 2, true},
+		{"thresholds disabled", &SourceGuard{}, 1, 100, 99, true},
+		{"allow mass drop", &SourceGuard{max_drop_tables: 10, max_drop_percent: 20, allow_mass_drop: true}, 0, 100, 100, true},
+	}
+
+	for _, c := range cases {
+		err := c.guard.Check(c.src_count, c.dest_count, make_drops(c.drops))
+		if (err == nil) != c.valid {
+			t.Errorf("%v: Check error = %v, want valid %v", c.name, err, c.valid)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+//information_schema.TABLES中的表大小信息
+type TableStats struct {
+	table_name   string
+	table_rows   int64
+	data_length  int64
+	index_length int64
+}
+
+func (this *TableStats) TotalLength() int64 {
+	return this.data_length + this.index_length
+}
+
+func QueryTableStats(dbAdaptor *MysqlDBAdaptor) (map[string]*TableStats, error) {
+	rows, err := dbAdaptor.Query("SELECT TABLE_NAME, IFNULL(TABLE_ROWS, 0), IFNULL(DATA_LENGTH, 0), IFNULL(INDEX_LENGTH, 0) FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE()")
+	if err != nil {
+		LOG_ERROR("query table stats error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	table_stats := make(map[string]*TableStats)
+	for rows.Next() {
+		stats := &TableStats{}
+		err = rows.Scan(&stats.table_name, &stats.table_rows, &stats.data_length, &stats.index_length)
+		if err != nil {
+			LOG_ERROR("scan table stats error: %v", err)
+			return nil, err
+		}
+		table_stats[stats.table_name] = stats
+	}
+
+	return table_stats, rows.Err()
+}
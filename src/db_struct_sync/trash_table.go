@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	//被软删除的表以此为前缀，拉取表结构时会被忽略
+	TRASH_TABLE_PREFIX string = "_trash_"
+	TRASH_TIME_LAYOUT  string = "20060102150405"
+
+	DROP_MODE_DROP     string = "drop"
+	DROP_MODE_RENAME   string = "rename"
+	DROP_MODE_TRASH_DB string = "trash_db"
+)
+
+//同一次运行中软删除的表使用相同的时间戳
+var g_trashTime = time.Now()
+
+var g_trashTableRegExp = regexp.MustCompile("^" + TRASH_TABLE_PREFIX + "(\\d{14})_")
+
+func IsTrashTable(name string) bool {
+	return strings.HasPrefix(name, TRASH_TABLE_PREFIX)
+}
+
+//_trash_<时间戳>_<表名>，超过MySQL表名长度限制时截断原表名并追加hash，
+//同一次运行中删除的前缀相同的长表名不会改名成同一个表
+func MakeTrashTableName(table_name string, t time.Time) string {
+	return TruncateName(fmt.Sprintf("%v%v_%v", TRASH_TABLE_PREFIX, t.Format(TRASH_TIME_LAYOUT), table_name))
+}
+
+//从软删除的表名中取出删除时间
+func ParseTrashTime(name string) (time.Time, bool) {
+	match := g_trashTableRegExp.FindStringSubmatch(name)
+	if match == nil {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation(TRASH_TIME_LAYOUT, match[1], time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+//软删除后表的完整名字，drop.mode为drop时返回false
+func TrashTableLocation(table_name string) (string, bool) {
+	trash_name := QuoteName(MakeTrashTableName(table_name, g_trashTime))
+
+	switch strings.ToLower(GetConfigString("drop.mode", DROP_MODE_DROP)) {
+	case DROP_MODE_RENAME:
+		return trash_name, true
+	case DROP_MODE_TRASH_DB:
+		trash_db := GetConfigString("drop.trash_db", "")
+		if trash_db == "" {
+			LOG_WARN("drop.trash_db not set, rename table %v in the destination database instead", table_name)
+			return trash_name, true
+		}
+		return fmt.Sprintf("%v.%v", QuoteName(trash_db), trash_name), true
+	}
+
+	return "", false
+}
+
+//永久删除超过drop.retention_days的软删除表，包括目标库和drop.trash_db中的
+func RunPurge() error {
+	var err error
+
+	g_destMysqlAdaptor, err = OpenMysqlDBAdaptor("mysql_dest", false)
+	if err != nil {
+		return err
+	}
+	defer g_destMysqlAdaptor.Release()
+
+	run_lock, err := AcquireRunLock(g_destMysqlAdaptor, "purge")
+	if err != nil {
+		LOG_ERROR("lock destination fail: %v", err)
+		return err
+	}
+	defer run_lock.Release()
+
+	retention_days := GetConfigInt("drop.retention_days", 7)
+	deadline := time.Now().Add(-time.Duration(retention_days) * 24 * time.Hour)
+
+	schemas := []string{""}
+	if trash_db := GetConfigString("drop.trash_db", ""); trash_db != "" {
+		schemas = append(schemas, trash_db)
+	}
+
+	for _, schema := range schemas {
+		tables, err := GetTablesWithPrefix(g_destMysqlAdaptor, schema, TRASH_TABLE_PREFIX)
+		if err != nil {
+			return err
+		}
+
+		for _, table := range tables {
+			trash_time, ok := ParseTrashTime(table)
+			if !ok {
+				LOG_WARN("cannot parse the drop time of %v, skip it", table)
+				continue
+			}
+			if trash_time.After(deadline) {
+				LOG_DEBUG("keep %v until %v", table, trash_time.Add(time.Duration(retention_days)*24*time.Hour).Format("2006-01-02 15:04:05"))
+				continue
+			}
+
+			full_name := QuoteName(table)
+			if schema != "" {
+				full_name = fmt.Sprintf("%v.%v", QuoteName(schema), full_name)
+			}
+			err = g_destMysqlAdaptor.Exec(fmt.Sprintf("DROP TABLE %v", full_name))
+			if err != nil {
+				LOG_ERROR("purge table %v error: %v", full_name, err)
+				return err
+			}
+			LOG_INFO("purged table %v", full_name)
+		}
+	}
+
+	return nil
+}
+
+//库中以prefix开头的表，schema为空时表示当前库
+func GetTablesWithPrefix(dbAdaptor *MysqlDBAdaptor, schema string, prefix string) ([]string, error) {
+	like := strings.Replace(prefix, "_", "\\_", -1) + "%"
+
+	query := "SELECT TABLE_NAME FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME LIKE ?"
+	args := []interface{}{like}
+	if schema != "" {
+		query = "SELECT TABLE_NAME FROM information_schema.TABLES WHERE TABLE_SCHEMA = ? AND TABLE_NAME LIKE ?"
+		args = []interface{}{schema, like}
+	}
+
+	rows, err := dbAdaptor.QueryFormat(query, args...)
+	if err != nil {
+		LOG_ERROR("query tables with prefix %v error: %v", prefix, err)
+		return nil, err
+	}
+
+	return ScanStrings(rows)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMakeTrashTableName(t *testing.T) {
+	drop_time := time.Date(2024, 3, 5, 10, 20, 30, 0, time.Local)
+
+	cases := []struct {
+		table_name string
+		expect     string
+	}{
+		{"user", "_trash_20240305102030_user"},
+		{strings.Repeat("t", 42), "_trash_20240305102030_" + strings.Repeat("t", 42)},
+	}
+	for _, c := range cases {
+		if got := MakeTrashTableName(c.table_name, drop_time); got != c.expect {
+			t.Errorf("MakeTrashTableName(%v) = %v, want %v", c.table_name, got, c.expect)
+		}
+	}
+
+	//前缀相同的长表名在同一次运行中删除，软删除后的名字不能相同
+	long_prefix := strings.Repeat("a", 50)
+	names := make(map[string]string)
+	for _, table_name := range []string{long_prefix + "_orders", long_prefix + "_order_items", long_prefix + "_refunds"} {
+		name := MakeTrashTableName(table_name, drop_time)
+		if len(name) > MYSQL_MAX_NAME_LENGTH {
+			t.Errorf("MakeTrashTableName(%v) = %v, longer than %v", table_name, name, MYSQL_MAX_NAME_LENGTH)
+		}
+		if other, ok := names[name]; ok {
+			t.Errorf("MakeTrashTableName(%v) collides with %v: %v", table_name, other, name)
+		}
+		names[name] = table_name
+
+		//截断后仍然可以取出删除时间，purge按它判断是否过期
+		if trash_time, ok := ParseTrashTime(name); !ok || !trash_time.Equal(drop_time) {
+			t.Errorf("ParseTrashTime(%v) = %v %v, want %v", name, trash_time, ok, drop_time)
+		}
+	}
+}